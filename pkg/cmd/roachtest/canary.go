@@ -0,0 +1,137 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"context"
+	gosql "database/sql"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// canarySample is the latency of a single canary write.
+type canarySample struct {
+	start   time.Time
+	latency time.Duration
+}
+
+// canaryWriter measures the latency a user would see while a test puts the
+// cluster under stress. It performs a single small write at a fixed interval,
+// one at a time, so that a stalled write delays the following ones instead of
+// being hidden by concurrent writes succeeding.
+type canaryWriter struct {
+	db       *gosql.DB
+	interval time.Duration
+
+	mu struct {
+		syncutil.Mutex
+		samples []canarySample
+	}
+}
+
+func newCanaryWriter(db *gosql.DB, interval time.Duration) *canaryWriter {
+	return &canaryWriter{db: db, interval: interval}
+}
+
+// run writes to the canary table until ctx is canceled. It returns the first
+// error encountered by a write.
+func (w *canaryWriter) run(ctx context.Context) error {
+	for _, stmt := range []string{
+		`CREATE DATABASE IF NOT EXISTS canary`,
+		`CREATE TABLE IF NOT EXISTS canary.canary (k INT PRIMARY KEY, ts TIMESTAMP)`,
+	} {
+		if _, err := w.db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(w.interval):
+		}
+		start := timeutil.Now()
+		if _, err := w.db.ExecContext(ctx,
+			`UPSERT INTO canary.canary VALUES ($1, now())`, i%1000,
+		); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		w.mu.Lock()
+		w.mu.samples = append(w.mu.samples, canarySample{start: start, latency: timeutil.Since(start)})
+		w.mu.Unlock()
+	}
+}
+
+// samples returns the samples of the writes started in [start, end).
+func (w *canaryWriter) samples(start, end time.Time) []canarySample {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var res []canarySample
+	for _, s := range w.mu.samples {
+		if !s.start.Before(start) && s.start.Before(end) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// canaryQuantile returns the q-th quantile (0 < q <= 1) of the latencies of
+// samples, or zero if there are none.
+func canaryQuantile(samples []canarySample, q float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	latencies := make([]time.Duration, len(samples))
+	for i, s := range samples {
+		latencies[i] = s.latency
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	idx := int(q*float64(len(latencies))+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return latencies[idx]
+}
+
+// canaryLongestStall returns the longest stretch of time covered by
+// consecutive samples which each took longer than threshold. Isolated slow
+// writes make for short stretches, while a stall shows up either as a single
+// very slow write or as a long run of slow ones.
+func canaryLongestStall(samples []canarySample, threshold time.Duration) time.Duration {
+	var longest time.Duration
+	var stallStart time.Time
+	inStall := false
+	for _, s := range samples {
+		if s.latency <= threshold {
+			inStall = false
+			continue
+		}
+		if !inStall {
+			inStall = true
+			stallStart = s.start
+		}
+		if d := s.start.Add(s.latency).Sub(stallStart); d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
@@ -16,9 +16,17 @@ package main
 
 import (
 	"context"
+	gosql "database/sql"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
 )
 
 // ChaosTimer configures a chaos schedule.
@@ -36,6 +44,10 @@ func (p Periodic) Timing() (time.Duration, time.Duration) {
 	return p.Period, p.DownTime
 }
 
+// chaosCheckpoint is the name of the checkpoint taken before each chaos event,
+// see Chaos.Checkpoint.
+const chaosCheckpoint = "chaos"
+
 // Chaos stops and restarts nodes in a cluster.
 type Chaos struct {
 	// Timing is consulted before each chaos event. It provides the duration of
@@ -50,6 +62,11 @@ type Chaos struct {
 	// DrainAndQuit is used to determine if want to kill the node vs draining it
 	// first and shutting down gracefully.
 	DrainAndQuit bool
+	// Checkpoint, if set, lists the CockroachDB nodes which are checkpointed
+	// (see cluster.Checkpoint) under the name chaosCheckpoint before each chaos
+	// event, so that a failure can be investigated starting from the state
+	// right before the last event.
+	Checkpoint nodeListOption
 }
 
 // Runner returns a closure that runs chaos against the given cluster without
@@ -81,6 +98,12 @@ func (ch *Chaos) Runner(c *cluster, m *monitor) func(context.Context) error {
 
 			period, downTime := ch.Timer.Timing()
 
+			if len(ch.Checkpoint) > 0 {
+				if err := c.Checkpoint(ctx, ch.Checkpoint, chaosCheckpoint); err != nil {
+					return err
+				}
+			}
+
 			target := ch.Target()
 			m.ExpectDeath()
 
@@ -104,6 +127,128 @@ func (ch *Chaos) Runner(c *cluster, m *monitor) func(context.Context) error {
 			l.Printf("restarting %v after %s of downtime\n", target, downTime)
 			t.Reset(period)
 			c.Start(ctx, c.t.(*test), target)
+			for _, node := range target {
+				c.WaitForSQLReady(ctx, node, time.Minute)
+			}
+		}
+	}
+}
+
+// nodeWithSystemLeases returns the node which holds the leases for the most
+// critical system ranges, i.e. the meta ranges and the node liveness range.
+// If these leases are spread over several nodes, the node holding the most of
+// them is returned. Killing this node exercises the worst case for a chaos
+// event, as opposed to killing a node which may hold only user ranges.
+//
+// Note that this assumes a single store per node, so that the leaseholder's
+// store ID equals its node ID.
+func nodeWithSystemLeases(ctx context.Context, db *gosql.DB) (int, error) {
+	var node int
+	err := db.QueryRowContext(ctx, `
+SELECT lease_holder
+  FROM crdb_internal.ranges
+ WHERE start_pretty = '/Min'
+    OR start_pretty LIKE '/Meta%'
+    OR start_pretty LIKE '/System/NodeLiveness%'
+ GROUP BY lease_holder
+ ORDER BY count(*) DESC, lease_holder
+ LIMIT 1`).Scan(&node)
+	return node, err
+}
+
+// systemLeasesTarget returns a Chaos.Target which picks the node among nodes
+// that holds the most system range leases (see nodeWithSystemLeases), so that
+// every chaos event exercises the worst case. The leases are looked up through
+// a random one of nodes. If the lookup fails, or the leases are held outside
+// of nodes, a random one of nodes is picked instead.
+func systemLeasesTarget(ctx context.Context, c *cluster, nodes nodeListOption) func() nodeListOption {
+	return func() nodeListOption {
+		db, err := c.ConnE(ctx, nodes.randNode()[0])
+		if err != nil {
+			c.l.Printf("looking up the system range leases: %s; picking a random node\n", err)
+			return nodes.randNode()
+		}
+		defer db.Close()
+		node, err := nodeWithSystemLeases(ctx, db)
+		if err != nil {
+			c.l.Printf("looking up the system range leases: %s; picking a random node\n", err)
+			return nodes.randNode()
+		}
+		for _, n := range nodes {
+			if n == node {
+				return c.Node(node)
+			}
+		}
+		c.l.Printf("the system range leases are on n%d, outside of %s; picking a random node\n",
+			node, nodes)
+		return nodes.randNode()
+	}
+}
+
+// chaosLeaseholders transfers the leases of a random fraction of the ranges
+// of table away from their current leaseholders, each to another one of the
+// range's replicas, and returns the number of leases it moved. The random
+// choices are drawn from rng, so that seeding it makes them reproducible.
+//
+// The ranges are addressed by their start keys, which requires table to have
+// a single INT primary key column. This assumes a single store per node.
+func chaosLeaseholders(
+	ctx context.Context, db *gosql.DB, rng *rand.Rand, table string, fraction float64,
+) (int, error) {
+	type rangeLease struct {
+		start       int64
+		replicas    []int64
+		leaseholder int64
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+SELECT start_key, replicas, lease_holder
+  FROM [SHOW EXPERIMENTAL_RANGES FROM TABLE %s]
+ ORDER BY range_id`, table))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var ranges []rangeLease
+	for rows.Next() {
+		var start gosql.NullString
+		var r rangeLease
+		if err := rows.Scan(&start, pq.Array(&r.replicas), &r.leaseholder); err != nil {
+			return 0, err
+		}
+		// The first range of the table has no start key within the table.
+		r.start = math.MinInt64
+		if start.Valid {
+			if r.start, err = strconv.ParseInt(strings.TrimPrefix(start.String, "/"), 10, 64); err != nil {
+				return 0, errors.Wrapf(err, "parsing start key %s", start.String)
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rng.Shuffle(len(ranges), func(i, j int) {
+		ranges[i], ranges[j] = ranges[j], ranges[i]
+	})
+	var moved int
+	for _, r := range ranges[:int(math.Ceil(fraction*float64(len(ranges))))] {
+		var targets []int64
+		for _, replica := range r.replicas {
+			if replica != r.leaseholder {
+				targets = append(targets, replica)
+			}
+		}
+		if len(targets) == 0 {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(
+			`ALTER TABLE %s EXPERIMENTAL_RELOCATE LEASE VALUES ($1, $2)`, table),
+			targets[rng.Intn(len(targets))], r.start,
+		); err != nil {
+			return moved, err
 		}
+		moved++
 	}
+	return moved, nil
 }
@@ -19,6 +19,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	gosql "database/sql"
 	"encoding/json"
 	"fmt"
@@ -27,6 +28,8 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/cookiejar"
 	"net/url"
 	"os"
 	"os/exec"
@@ -40,10 +43,16 @@ import (
 	"time"
 
 	"github.com/armon/circbuf"
+	"github.com/cockroachdb/cockroach/pkg/server/serverpb"
+	"github.com/cockroachdb/cockroach/pkg/server/status/statuspb"
+	"github.com/cockroachdb/cockroach/pkg/sql/lex"
+	"github.com/cockroachdb/cockroach/pkg/sql/stats"
+	"github.com/cockroachdb/cockroach/pkg/util/httputil"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	// "postgres" gosql driver
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
 )
@@ -567,10 +576,14 @@ func (s *clusterSpec) args() []string {
 	return args
 }
 
+// defaultClusterLifetime is the lifetime of a cluster which doesn't specify
+// one.
+const defaultClusterLifetime = 12 * time.Hour
+
 func (s *clusterSpec) expiration() time.Time {
 	l := s.Lifetime
 	if l == 0 {
-		l = 12 * time.Hour
+		l = defaultClusterLifetime
 	}
 	return timeutil.Now().Add(l)
 }
@@ -874,6 +887,19 @@ func (c *cluster) Node(i int) nodeListOption {
 	return c.Range(i, i)
 }
 
+// PGUrlTemplate returns the placeholder which roachprod expands to the
+// postgres URLs of the given nodes, e.g. "{pgurl:1-3}", for use in commands
+// passed to c.Run and friends. An empty node list stands for all the nodes.
+func (c *cluster) PGUrlTemplate(nodes nodeListOption) string {
+	return "{pgurl" + nodes.String() + "}"
+}
+
+// PGPortTemplate returns the placeholder which roachprod expands to the
+// postgres port of the given node, e.g. "{pgport:3}".
+func (c *cluster) PGPortTemplate(node int) string {
+	return fmt.Sprintf("{pgport:%d}", node)
+}
+
 // FetchLogs downloads the logs from the cluster using `roachprod get`.
 // The logs will be placed in the test's artifacts dir.
 func (c *cluster) FetchLogs(ctx context.Context) error {
@@ -1101,6 +1127,63 @@ func racks(n int) option {
 	return startArgs(fmt.Sprintf("--racks=%d", n))
 }
 
+// env is an option which sets the given environment variables for the
+// started nodes. The variables are passed in sorted order so that the
+// resulting roachprod invocation is deterministic.
+func env(vars map[string]string) option {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	args := make([]string, len(names))
+	for i, name := range names {
+		args[i] = fmt.Sprintf("--env=%s=%s", name, vars[name])
+	}
+	return startArgs(args...)
+}
+
+// storesPerNode is an option which starts each node with n stores, all of
+// which live in the node's usual store directory. It doesn't work with
+// encryption at rest, which roachprod only sets up for a single store.
+func storesPerNode(n int) option {
+	args := make([]string, n)
+	for i := range args {
+		args[i] = fmt.Sprintf("--args=--store=path={store-dir}/s%d", i+1)
+	}
+	return startArgs(args...)
+}
+
+// encryptionKeys is an option which starts the nodes with encryption at rest,
+// using the given store key. Data encrypted with oldKey remains readable,
+// which allows rotating the store key by restarting the nodes with a new key
+// and the previous one as oldKey. The keys are the names of files in the
+// nodes' store directories (see `cockroach gen encryption-key`), or "plain"
+// for no encryption. It replaces the encryption set up by roachprod.
+func encryptionKeys(key, oldKey string) option {
+	path := func(key string) string {
+		if key == "plain" {
+			return key
+		}
+		return "{store-dir}/" + key
+	}
+	return startArgs("--encrypt=false", fmt.Sprintf(
+		"--args=--enterprise-encryption=path={store-dir},key=%s,old-key=%s", path(key), path(oldKey)))
+}
+
+// raftElectionTimeoutEnv is the environment variable which overrides the
+// number of raft ticks after which a follower which hasn't heard from the
+// leader calls an election.
+const raftElectionTimeoutEnv = "COCKROACH_RAFT_ELECTION_TIMEOUT_TICKS"
+
+// raftElectionTimeout is an option which makes the started nodes call raft
+// elections after the given number of ticks instead of the default of 15 ticks
+// (3s with the 200ms tick interval). Shorter timeouts make leadership fail
+// over faster when a node dies.
+func raftElectionTimeout(ticks int) option {
+	return env(map[string]string{raftElectionTimeoutEnv: strconv.Itoa(ticks)})
+}
+
 // stopArgs specifies extra arguments that are passed to `roachprod` during `c.Stop`.
 func stopArgs(extraArgs ...string) option {
 	return roachprodArgOption(extraArgs)
@@ -1144,7 +1227,53 @@ func (c *cluster) StartE(ctx context.Context, opts ...option) error {
 	if !argExists(args, "--encrypt") && c.encryptDefault {
 		args = append(args, "--encrypt")
 	}
-	return execCmd(ctx, c.l, args...)
+	if err := execCmd(ctx, c.l, args...); err != nil {
+		return err
+	}
+	if impl, ok := c.t.(*test); ok && len(impl.spec.ClusterSettings) > 0 {
+		// The merged node list is sorted, and empty if all nodes were started.
+		var nodes nodeListOption
+		for _, o := range opts {
+			if s, ok := o.(nodeSelector); ok {
+				nodes = s.merge(nodes)
+			}
+		}
+		if len(nodes) == 0 || nodes[0] == 1 {
+			db, err := c.ConnE(ctx, 1)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			return applyClusterSettings(ctx, db, impl.spec.ClusterSettings)
+		}
+	}
+	return nil
+}
+
+// clusterSettingStmts returns the statements setting the given cluster
+// settings, ordered by the names of the settings.
+func clusterSettingStmts(settings map[string]string) []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stmts := make([]string, len(names))
+	for i, name := range names {
+		stmts[i] = fmt.Sprintf("SET CLUSTER SETTING %s = %s", name, settings[name])
+	}
+	return stmts
+}
+
+// applyClusterSettings sets the given cluster settings, see
+// testSpec.ClusterSettings.
+func applyClusterSettings(ctx context.Context, db *gosql.DB, settings map[string]string) error {
+	for _, stmt := range clusterSettingStmts(settings) {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return errors.Wrap(err, stmt)
+		}
+	}
+	return nil
 }
 
 // Start is like StartE() except it takes a test and, on error, calls t.Fatal().
@@ -1219,6 +1348,70 @@ func (c *cluster) Wipe(ctx context.Context, opts ...option) {
 	}
 }
 
+// checkpointDir returns the directory, on each node, in which Checkpoint
+// keeps the checkpoint of the node's store with the given name.
+func checkpointDir(name string) string {
+	return "{store-dir}.checkpoints/" + name
+}
+
+// Checkpoint captures the stores of the given CockroachDB nodes, so that they
+// can later be reset to the captured state with RestoreCheckpoint, e.g. to
+// iterate on a failure without reproducing it from scratch. A previous
+// checkpoint with the same name is replaced.
+//
+// The nodes are paused while their stores are captured, which makes the
+// checkpoint equivalent to the state the cluster would be left in by a
+// simultaneous crash of all the nodes. Immutable files are hard linked, so
+// this only takes a moment. The checkpoints are kept on the nodes, and a
+// description of them is written to the test's artifacts. They are lost when
+// the cluster is destroyed, so run with --debug to keep them around when a
+// test fails.
+func (c *cluster) Checkpoint(ctx context.Context, nodes nodeListOption, name string) error {
+	c.l.Printf("checkpointing %s as %q\n", nodes, name)
+	dir := checkpointDir(name)
+	if err := c.RunE(ctx, nodes, "pkill -STOP -x cockroach || true"); err != nil {
+		return err
+	}
+	// Resume the nodes even if ctx has been canceled in the meantime.
+	defer func() {
+		if err := c.RunE(context.Background(), nodes, "pkill -CONT -x cockroach || true"); err != nil {
+			c.l.Printf("failed to resume nodes after checkpoint: %s\n", err)
+		}
+	}()
+	// Everything but the sstables may be modified in place once the nodes
+	// resume, so these files get copied rather than linked.
+	if err := c.RunE(ctx, nodes, fmt.Sprintf(`rm -rf %[1]s && mkdir -p $(dirname %[1]s) && `+
+		`cp -al {store-dir} %[1]s && `+
+		`find %[1]s -type f ! -name '*.sst' -exec sh -c 'cp "$0" "$0.tmp" && mv "$0.tmp" "$0"' {} \;`,
+		dir)); err != nil {
+		return err
+	}
+
+	path := filepath.Join(c.t.ArtifactsDir(), "checkpoints", name+".txt")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(fmt.Sprintf(
+		"checkpoint %q of cluster %s taken at %s\n"+
+			"stores copied to %s on nodes %s\n"+
+			"to restore, stop the nodes and replace {store-dir} with the copy, "+
+			"or use cluster.RestoreCheckpoint\n",
+		name, c.name, timeutil.Now().Format(time.RFC3339), dir, nodes)), 0644)
+}
+
+// RestoreCheckpoint stops the given CockroachDB nodes and resets their stores
+// to the given checkpoint, which must have been taken of the same nodes with
+// Checkpoint. The checkpoint is left in place, so it can be restored again.
+// The caller has to restart the nodes.
+func (c *cluster) RestoreCheckpoint(ctx context.Context, nodes nodeListOption, name string) error {
+	c.l.Printf("restoring checkpoint %q on %s\n", name, nodes)
+	if err := c.StopE(ctx, nodes); err != nil {
+		return err
+	}
+	return c.RunE(ctx, nodes, fmt.Sprintf(
+		`test -d %[1]s && rm -rf {store-dir} && cp -a %[1]s {store-dir}`, checkpointDir(name)))
+}
+
 // Run a command on the specified node.
 func (c *cluster) Run(ctx context.Context, node nodeListOption, args ...string) {
 	err := c.RunL(ctx, c.l, node, args...)
@@ -1379,6 +1572,78 @@ func (c *cluster) ExternalAdminUIAddr(ctx context.Context, node nodeListOption)
 	return addrs
 }
 
+// adminUIPages are the admin UI pages and endpoints which tests can smoke check
+// with CheckAdminUIPages.
+var adminUIPages = []string{
+	"/",
+	"/_status/vars",
+	"/_status/nodes",
+	"/_admin/v1/databases",
+	"/_admin/v1/events",
+}
+
+// CheckAdminUIPages fetches each of the given paths from the admin UI of the
+// specified node and checks that it is served successfully with a non-empty
+// body. On secure clusters, a session cookie is obtained first by logging in
+// with the credentials from the node's pgurl.
+func (c *cluster) CheckAdminUIPages(ctx context.Context, node int, paths []string) error {
+	pgURL, err := url.Parse(c.ExternalPGUrl(ctx, c.Node(node))[0])
+	if err != nil {
+		return err
+	}
+	sslMode := pgURL.Query().Get("sslmode")
+	secure := sslMode != "" && sslMode != "disable"
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Jar: jar, Timeout: 30 * time.Second}
+	base := "http://" + c.ExternalAdminUIAddr(ctx, c.Node(node))[0]
+	if secure {
+		base = "https://" + c.ExternalAdminUIAddr(ctx, c.Node(node))[0]
+		// The cluster's certificates are self-signed.
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		if pgURL.User == nil {
+			return errors.Errorf("n%d: no user to log in to the admin UI with", node)
+		}
+		password, _ := pgURL.User.Password()
+		req := serverpb.UserLoginRequest{
+			Username: pgURL.User.Username(),
+			Password: password,
+		}
+		var resp serverpb.UserLoginResponse
+		if err := httputil.PostJSON(client, base+"/login", &req, &resp); err != nil {
+			return errors.Wrapf(err, "n%d: logging in to the admin UI", node)
+		}
+	}
+
+	for _, path := range paths {
+		req, err := http.NewRequest("GET", base+path, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return errors.Wrapf(err, "n%d: fetching %s", node, path)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return errors.Wrapf(err, "n%d: reading %s", node, path)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("n%d: fetching %s returned %s", node, path, resp.Status)
+		}
+		if len(body) == 0 {
+			return errors.Errorf("n%d: fetching %s returned an empty body", node, path)
+		}
+	}
+	return nil
+}
+
 // InternalAddr returns the internal address in the form host:port for the
 // specified nodes.
 func (c *cluster) InternalAddr(ctx context.Context, node nodeListOption) []string {
@@ -1440,6 +1705,433 @@ func (c *cluster) ConnE(ctx context.Context, node int) (*gosql.DB, error) {
 	return db, nil
 }
 
+// ConnWithTimeout is like Conn, except that every statement run through the
+// returned DB is canceled if it doesn't complete within the given duration.
+// This keeps queries against a cluster which is restarting or draining nodes
+// from blocking the test indefinitely. The timeout is passed as the
+// statement_timeout session variable in the connection URL, so it applies to
+// all of the connections opened by the DB. The caller is responsible for
+// closing the returned DB.
+func (c *cluster) ConnWithTimeout(ctx context.Context, node int, d time.Duration) *gosql.DB {
+	pgURL, err := withStatementTimeout(c.ExternalPGUrl(ctx, c.Node(node))[0], d)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	db, err := gosql.Open("postgres", pgURL)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return db
+}
+
+// withStatementTimeout adds the statement_timeout session variable, in
+// milliseconds, to the given postgres URL.
+func withStatementTimeout(pgurl string, d time.Duration) (string, error) {
+	u, err := url.Parse(pgurl)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("statement_timeout", strconv.FormatInt(int64(d/time.Millisecond), 10))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// WaitForSQLReady blocks until the SQL layer on the specified node serves a
+// trivial query. Start returns once the cockroach process is up, which may be
+// before the node accepts SQL connections (for example, while startup
+// migrations are still running). The test is failed if the node does not
+// become ready within the timeout.
+func (c *cluster) WaitForSQLReady(ctx context.Context, node int, timeout time.Duration) {
+	db := c.Conn(ctx, node)
+	defer db.Close()
+
+	c.status(fmt.Sprintf("waiting for SQL on n%d", node))
+	defer c.status()
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var err error
+	for r := retry.StartWithCtx(waitCtx, retry.Options{MaxBackoff: time.Second}); r.Next(); {
+		if _, err = db.ExecContext(waitCtx, `SELECT 1`); err == nil {
+			return
+		}
+	}
+	if err == nil {
+		err = waitCtx.Err()
+	}
+	c.t.Fatalf("n%d: SQL not ready after %s: %v", node, timeout, err)
+}
+
+// hotRange describes a range reported by the hot ranges status endpoint.
+type hotRange struct {
+	RangeID     int64
+	QPS         float64
+	LeaseHolder int
+}
+
+// HotRanges returns the topN ranges with the highest QPS in the cluster,
+// sorted by decreasing QPS, as reported by the hot ranges status endpoint of
+// the first node. The leaseholder of each range is looked up through db.
+func (c *cluster) HotRanges(ctx context.Context, db *gosql.DB, topN int) ([]hotRange, error) {
+	url := "http://" + c.ExternalAdminUIAddr(ctx, c.Node(1))[0] + "/_status/hotranges"
+	var response serverpb.HotRangesResponse
+	if err := httputil.GetJSON(http.Client{}, url, &response); err != nil {
+		return nil, err
+	}
+
+	// Only the leaseholder of a range serves queries, so the replica reporting
+	// the highest QPS determines the QPS of the range.
+	qps := make(map[int64]float64)
+	for nodeID, n := range response.HotRangesByNodeID {
+		if n.ErrorMessage != "" {
+			return nil, errors.Errorf("n%d: %s", nodeID, n.ErrorMessage)
+		}
+		for _, s := range n.Stores {
+			for _, r := range s.HotRanges {
+				id := int64(r.Desc.RangeID)
+				if r.QueriesPerSecond > qps[id] {
+					qps[id] = r.QueriesPerSecond
+				}
+			}
+		}
+	}
+	ranges := make([]hotRange, 0, len(qps))
+	for id, q := range qps {
+		ranges = append(ranges, hotRange{RangeID: id, QPS: q})
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].QPS > ranges[j].QPS
+	})
+	if len(ranges) > topN {
+		ranges = ranges[:topN]
+	}
+
+	ids := make([]int64, len(ranges))
+	for i := range ranges {
+		ids[i] = ranges[i].RangeID
+	}
+	rows, err := db.QueryContext(ctx,
+		`SELECT range_id, lease_holder FROM crdb_internal.ranges WHERE range_id = ANY ($1)`,
+		pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	leaseHolders := make(map[int64]int, len(ranges))
+	for rows.Next() {
+		var id int64
+		var leaseHolder int
+		if err := rows.Scan(&id, &leaseHolder); err != nil {
+			return nil, err
+		}
+		leaseHolders[id] = leaseHolder
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range ranges {
+		ranges[i].LeaseHolder = leaseHolders[ranges[i].RangeID]
+	}
+	return ranges, nil
+}
+
+// topologyNode, topologyStore and topologyRange make up the cluster topology
+// written by DumpTopology.
+type topologyNode struct {
+	NodeID   int             `json:"node_id"`
+	Address  string          `json:"address"`
+	Locality json.RawMessage `json:"locality"`
+}
+
+type topologyStore struct {
+	NodeID     int `json:"node_id"`
+	StoreID    int `json:"store_id"`
+	RangeCount int `json:"range_count"`
+	LeaseCount int `json:"lease_count"`
+}
+
+type topologyRange struct {
+	RangeID     int64   `json:"range_id"`
+	StartKey    string  `json:"start_key"`
+	Database    string  `json:"database"`
+	Table       string  `json:"table"`
+	Replicas    []int64 `json:"replicas"`
+	LeaseHolder int     `json:"lease_holder"`
+}
+
+// DumpTopology writes the node localities, the store assignments and the
+// replica distribution of the cluster, as seen through db, to a JSON file at
+// localPath relative to the test's artifacts directory. Dumping the topology
+// when a test begins allows correlating its behavior with the layout of the
+// cluster without having to re-run it.
+func (c *cluster) DumpTopology(ctx context.Context, db *gosql.DB, localPath string) error {
+	var topo struct {
+		Nodes  []topologyNode  `json:"nodes"`
+		Stores []topologyStore `json:"stores"`
+		Ranges []topologyRange `json:"ranges"`
+	}
+	// query runs stmt and calls scan for each of the resulting rows.
+	query := func(stmt string, scan func(*gosql.Rows) error) error {
+		rows, err := db.QueryContext(ctx, stmt)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			if err := scan(rows); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+
+	if err := query(
+		`SELECT node_id, address, locality::STRING FROM crdb_internal.gossip_nodes ORDER BY node_id`,
+		func(rows *gosql.Rows) error {
+			var n topologyNode
+			var locality string
+			if err := rows.Scan(&n.NodeID, &n.Address, &locality); err != nil {
+				return err
+			}
+			n.Locality = json.RawMessage(locality)
+			topo.Nodes = append(topo.Nodes, n)
+			return nil
+		},
+	); err != nil {
+		return errors.Wrap(err, "querying nodes")
+	}
+
+	if err := query(`
+SELECT node_id, store_id, range_count, lease_count
+  FROM crdb_internal.kv_store_status
+ ORDER BY node_id, store_id`,
+		func(rows *gosql.Rows) error {
+			var s topologyStore
+			if err := rows.Scan(&s.NodeID, &s.StoreID, &s.RangeCount, &s.LeaseCount); err != nil {
+				return err
+			}
+			topo.Stores = append(topo.Stores, s)
+			return nil
+		},
+	); err != nil {
+		return errors.Wrap(err, "querying stores")
+	}
+
+	if err := query(`
+SELECT range_id, start_pretty, database_name, table_name, replicas, lease_holder
+  FROM crdb_internal.ranges
+ ORDER BY start_key`,
+		func(rows *gosql.Rows) error {
+			var r topologyRange
+			if err := rows.Scan(
+				&r.RangeID, &r.StartKey, &r.Database, &r.Table, pq.Array(&r.Replicas), &r.LeaseHolder,
+			); err != nil {
+				return err
+			}
+			topo.Ranges = append(topo.Ranges, r)
+			return nil
+		},
+	); err != nil {
+		return errors.Wrap(err, "querying ranges")
+	}
+
+	b, err := json.MarshalIndent(topo, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(c.t.ArtifactsDir(), localPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// ThrottleReplication limits the bandwidth of the traffic sent from fromNode
+// to toNode, which includes the raft traffic the replicas on fromNode send to
+// their peers on toNode, to bytesPerSec. The traffic is shaped with tc on
+// fromNode. The returned closure removes the limit again and should be called
+// when the test is done with the throttled link. Throttling isn't supported on
+// local clusters, where all nodes share the loopback interface.
+func (c *cluster) ThrottleReplication(
+	ctx context.Context, fromNode, toNode int, bytesPerSec int,
+) (clear func() error, _ error) {
+	if c.isLocal() {
+		return nil, errors.New("throttling replication is not supported on local clusters")
+	}
+	ip := c.InternalIP(ctx, c.Node(toNode))[0]
+	// The interface fromNode uses to reach toNode.
+	dev := fmt.Sprintf(`$(ip route get %s | grep -oP 'dev \K\S+')`, ip)
+	clear = func() error {
+		// Remove the limit even if ctx has been canceled in the meantime.
+		return c.RunE(context.Background(), c.Node(fromNode), "sudo tc qdisc del dev "+dev+" root")
+	}
+	// Traffic goes to the unrestricted class 1:1 by default, unless it's
+	// headed to toNode.
+	for _, cmd := range []string{
+		"sudo tc qdisc add dev " + dev + " root handle 1: htb default 1",
+		"sudo tc class add dev " + dev + " parent 1: classid 1:1 htb rate 100gbit",
+		fmt.Sprintf("sudo tc class add dev %s parent 1: classid 1:2 htb rate %[2]dbit ceil %[2]dbit",
+			dev, bytesPerSec*8),
+		fmt.Sprintf("sudo tc filter add dev %s protocol ip parent 1: prio 1 u32 match ip dst %s/32 flowid 1:2",
+			dev, ip),
+	} {
+		if err := c.RunE(ctx, c.Node(fromNode), cmd); err != nil {
+			// Don't leave a partially configured qdisc behind.
+			_ = clear()
+			return nil, err
+		}
+	}
+	return clear, nil
+}
+
+// NodeEnv returns the environment variables which affect the configuration of
+// the cockroach process on node, as reported by its status endpoint.
+func (c *cluster) NodeEnv(ctx context.Context, node int) ([]string, error) {
+	url := "http://" + c.ExternalAdminUIAddr(ctx, c.Node(node))[0] + "/_status/nodes/local"
+	var status statuspb.NodeStatus
+	if err := httputil.GetJSON(http.Client{Timeout: 10 * time.Second}, url, &status); err != nil {
+		return nil, err
+	}
+	return status.Env, nil
+}
+
+// GoroutineCount returns the number of goroutines on node, as reported by the
+// node's goroutine profile.
+func (c *cluster) GoroutineCount(ctx context.Context, node int) (int, error) {
+	url := "http://" + c.ExternalAdminUIAddr(ctx, c.Node(node))[0] + "/debug/pprof/goroutine?debug=1"
+	req, err := http.NewRequest("GET", url, nil /* body */)
+	if err != nil {
+		return 0, err
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// The profile starts with the total, e.g. "goroutine profile: total 270".
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	if _, err := fmt.Sscanf(line, "goroutine profile: total %d", &n); err != nil {
+		return 0, errors.Wrapf(err, "n%d: parsing goroutine profile header %q", node, line)
+	}
+	return n, nil
+}
+
+// FetchGoroutineDumps writes the stacks of all goroutines on each of the given
+// nodes, as served by their admin UI, to the test's artifacts. Nodes whose
+// stacks can't be fetched are logged and skipped, as the dumps are only
+// diagnostics for a test which has already failed.
+func (c *cluster) FetchGoroutineDumps(ctx context.Context, nodes nodeListOption) {
+	dir := filepath.Join(c.t.ArtifactsDir(), "goroutines")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		c.l.Printf("fetching goroutine dumps: %s\n", err)
+		return
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	for _, node := range nodes {
+		url := "http://" + c.ExternalAdminUIAddr(ctx, c.Node(node))[0] + "/debug/pprof/goroutine?debug=2"
+		if err := func() error {
+			req, err := http.NewRequest("GET", url, nil /* body */)
+			if err != nil {
+				return err
+			}
+			resp, err := client.Do(req.WithContext(ctx))
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			f, err := os.Create(filepath.Join(dir, fmt.Sprintf("n%d.txt", node)))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(f, resp.Body)
+			return err
+		}(); err != nil {
+			c.l.Printf("fetching goroutine dump of n%d: %s\n", node, err)
+		}
+	}
+}
+
+// FetchCPUProfiles records a CPU profile of the given duration on each of the
+// given nodes concurrently, as served by their admin UI, and writes them to
+// the test's artifacts as profiles/<name>.n<node>.pprof. It returns once all
+// the profiles have been recorded. Nodes whose profile can't be recorded are
+// logged and skipped, as the profiles are only diagnostics.
+func (c *cluster) FetchCPUProfiles(
+	ctx context.Context, nodes nodeListOption, name string, duration time.Duration,
+) {
+	dir := filepath.Join(c.t.ArtifactsDir(), "profiles")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		c.l.Printf("fetching cpu profiles: %s\n", err)
+		return
+	}
+	// The node only responds once it's done profiling.
+	client := http.Client{Timeout: duration + 30*time.Second}
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		node := node
+		url := fmt.Sprintf("http://%s/debug/pprof/profile?seconds=%d",
+			c.ExternalAdminUIAddr(ctx, c.Node(node))[0], int(duration.Seconds()))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := func() error {
+				req, err := http.NewRequest("GET", url, nil /* body */)
+				if err != nil {
+					return err
+				}
+				resp, err := client.Do(req.WithContext(ctx))
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					return errors.Errorf("%s: %s", url, resp.Status)
+				}
+				f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%s.n%d.pprof", name, node)))
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				_, err = io.Copy(f, resp.Body)
+				return err
+			}(); err != nil {
+				c.l.Printf("fetching cpu profile of n%d: %s\n", node, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// verifyRaftElectionTimeout checks that node runs with the raft election
+// timeout set through raftElectionTimeout, or with the default one if ticks is
+// zero.
+func (c *cluster) verifyRaftElectionTimeout(ctx context.Context, node int, ticks int) error {
+	env, err := c.NodeEnv(ctx, node)
+	if err != nil {
+		return err
+	}
+	var found string
+	for _, v := range env {
+		if strings.HasPrefix(v, raftElectionTimeoutEnv+"=") {
+			found = v
+		}
+	}
+	switch expected := fmt.Sprintf("%s=%d", raftElectionTimeoutEnv, ticks); {
+	case ticks == 0 && found != "":
+		return errors.Errorf("n%d: expected default raft election timeout, found %s", node, found)
+	case ticks != 0 && found != expected:
+		return errors.Errorf("n%d: expected %s, found %q", node, expected, found)
+	}
+	return nil
+}
+
 func (c *cluster) makeNodes(opts ...option) string {
 	var r nodeListOption
 	for _, o := range opts {
@@ -1497,6 +2189,17 @@ type monitor struct {
 	cancel    func()
 	g         *errgroup.Group
 	expDeaths int32 // atomically
+
+	// onDeath, if set, is called with the first node which dies unexpectedly.
+	onDeath func(node int, err error)
+
+	mu struct {
+		syncutil.Mutex
+		// abortErr is the reason the monitor was aborted, if it was.
+		abortErr error
+		// workloads are the workloads started with GoWorkload.
+		workloads []*workloadHandle
+	}
 }
 
 func newMonitor(ctx context.Context, c *cluster, opts ...option) *monitor {
@@ -1526,6 +2229,62 @@ func (m *monitor) ResetDeaths() {
 	atomic.StoreInt32(&m.expDeaths, 0)
 }
 
+// abort cancels the monitor's context, failing the test with err. The first
+// abort wins.
+func (m *monitor) abort(err error) {
+	m.mu.Lock()
+	if m.mu.abortErr == nil {
+		m.mu.abortErr = err
+	}
+	m.mu.Unlock()
+	m.cancel()
+}
+
+// AbortIfStalled aborts the monitor, failing the test, if metric (e.g. the
+// throughput of a workload as reported by workloadProgress.OpsPerSec) stays
+// below threshold for the given duration. This saves waiting out the full
+// duration of a workload on a cluster which has wedged. A metric which has not
+// yet reached the threshold isn't considered stalled, so that the time it
+// takes to set up a workload isn't mistaken for a stall.
+func (m *monitor) AbortIfStalled(metric func() float64, threshold float64, duration time.Duration) {
+	go func() {
+		var started bool
+		var stalledSince time.Time
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if metric() >= threshold {
+				started = true
+				stalledSince = time.Time{}
+				continue
+			}
+			if !started {
+				continue
+			}
+			if stalledSince.IsZero() {
+				stalledSince = timeutil.Now()
+			}
+			if stalled := timeutil.Since(stalledSince); stalled >= duration {
+				m.abort(errors.Errorf("throughput stalled below %.1f for %s", threshold, stalled))
+				return
+			}
+		}
+	}()
+}
+
+// OnDeath registers fn to be called with the first node the monitor sees die
+// unexpectedly, and the error the monitor fails with, before the monitor's
+// context is canceled. This allows capturing the state of the test at the
+// time of the death. It must be called before Wait.
+func (m *monitor) OnDeath(fn func(node int, err error)) {
+	m.onDeath = fn
+}
+
 var errGoexit = errors.New("Goexit() was called")
 
 func (m *monitor) Go(fn func(context.Context) error) {
@@ -1680,7 +2439,11 @@ func (m *monitor) wait(args ...string) error {
 			var s string
 			if n, _ := fmt.Sscanf(msg, "%d: %s", &id, &s); n == 2 {
 				if strings.Contains(s, "dead") && atomic.AddInt32(&m.expDeaths, -1) < 0 {
-					setErr(fmt.Errorf("unexpected node event: %s", msg))
+					err := fmt.Errorf("unexpected node event: %s", msg)
+					if m.onDeath != nil {
+						m.onDeath(id, err)
+					}
+					setErr(err)
 					return
 				}
 			}
@@ -1688,9 +2451,64 @@ func (m *monitor) wait(args ...string) error {
 	}()
 
 	wg.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mu.abortErr != nil {
+		// The abort is what made the workers fail, so report it instead of
+		// whatever they returned when their context was canceled.
+		return m.mu.abortErr
+	}
 	return err
 }
 
+// configureZone applies the given zone config settings (in the form accepted by
+// CONFIGURE ZONE USING) to target, e.g. "RANGE default" or "TABLE kv.kv".
+func configureZone(ctx context.Context, db *gosql.DB, target, settings string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`ALTER %s CONFIGURE ZONE USING %s`, target, settings))
+	return err
+}
+
+// SetReplicationFactor sets the number of replicas of target (see
+// configureZone) to n. It does not wait for the replication changes to happen.
+func (c *cluster) SetReplicationFactor(
+	ctx context.Context, db *gosql.DB, target string, n int,
+) error {
+	return configureZone(ctx, db, target, fmt.Sprintf("num_replicas = %d", n))
+}
+
+// SetGCTTL sets the GC TTL of target (see configureZone), i.e. the time after
+// which overwritten and deleted values become eligible for garbage collection.
+func (c *cluster) SetGCTTL(
+	ctx context.Context, db *gosql.DB, target string, ttl time.Duration,
+) error {
+	return configureZone(ctx, db, target, fmt.Sprintf("gc.ttlseconds = %d", int64(ttl.Seconds())))
+}
+
+// longTxn is a handle on a transaction which is held open, e.g. to read at a
+// fixed timestamp while the rest of the test modifies the data it reads.
+type longTxn struct {
+	*gosql.Tx
+	// Timestamp is the transaction's timestamp, as returned by
+	// cluster_logical_timestamp().
+	Timestamp string
+}
+
+// BeginLongTxn begins a transaction on db and fixes its timestamp, so that all
+// its reads observe the data as of the time BeginLongTxn was called. The
+// caller has to commit or roll back the transaction.
+func (c *cluster) BeginLongTxn(ctx context.Context, db *gosql.DB) (*longTxn, error) {
+	tx, err := db.BeginTx(ctx, nil /* opts */)
+	if err != nil {
+		return nil, err
+	}
+	var ts string
+	if err := tx.QueryRowContext(ctx, `SELECT cluster_logical_timestamp()`).Scan(&ts); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return &longTxn{Tx: tx, Timestamp: ts}, nil
+}
+
 func waitForFullReplication(t *test, db *gosql.DB) {
 	for ok := false; !ok; time.Sleep(time.Second) {
 		if err := db.QueryRow(
@@ -1700,3 +2518,210 @@ func waitForFullReplication(t *test, db *gosql.DB) {
 		}
 	}
 }
+
+// waitForReplicationFactor waits until all the ranges of table, given as
+// database.table, or of the whole cluster if table is empty, have exactly rf
+// replicas. Unlike waitForFullReplication, it waits for down-replication too.
+// It fails if that doesn't happen within timeout.
+func waitForReplicationFactor(
+	ctx context.Context, db *gosql.DB, table string, rf int, timeout time.Duration,
+) error {
+	query := `
+SELECT min(array_length(replicas, 1)) = $1 AND max(array_length(replicas, 1)) = $1
+  FROM crdb_internal.ranges`
+	args := []interface{}{rf}
+	if table != "" {
+		parts := strings.SplitN(table, ".", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("expected a table of the form database.table, found %q", table)
+		}
+		query += ` WHERE database_name = $2 AND table_name = $3`
+		args = append(args, parts[0], parts[1])
+	}
+	for start := timeutil.Now(); ; {
+		var ok bool
+		if err := db.QueryRowContext(ctx, query, args...).Scan(&ok); err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if timeutil.Since(start) > timeout {
+			return errors.Errorf("ranges weren't replicated %d times after %s", rf, timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// liveNodeCount returns the number of nodes whose liveness record, as seen
+// through gossip by the node db is connected to, has not expired.
+func liveNodeCount(ctx context.Context, db *gosql.DB) (int, error) {
+	rows, err := db.QueryContext(ctx, `SELECT expiration FROM crdb_internal.gossip_liveness`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	now := timeutil.Now()
+	var live int
+	for rows.Next() {
+		var expiration string
+		if err := rows.Scan(&expiration); err != nil {
+			return 0, err
+		}
+		// The expiration is an HLC timestamp of the form <seconds>.<nanos>,<logical>.
+		wall, err := strconv.ParseFloat(strings.Split(expiration, ",")[0], 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "parsing liveness expiration %q", expiration)
+		}
+		if wall > float64(now.UnixNano())/1e9 {
+			live++
+		}
+	}
+	return live, rows.Err()
+}
+
+// assertLiveNodes checks that exactly the expected number of nodes are live.
+// Since liveness records of nodes which went down take a few seconds to
+// expire, the check is retried for up to a minute.
+func assertLiveNodes(ctx context.Context, db *gosql.DB, expected int) error {
+	waitCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	var live int
+	var err error
+	for r := retry.StartWithCtx(waitCtx, retry.Options{MaxBackoff: time.Second}); r.Next(); {
+		live, err = liveNodeCount(waitCtx, db)
+		if err == nil && live == expected {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return errors.Errorf("expected %d live nodes, found %d", expected, live)
+}
+
+// planAnnotationRE matches the lines of an optimizer plan which carry cost and
+// cardinality estimates rather than describing the shape of the plan.
+var planAnnotationRE = regexp.MustCompile(`^[\s│├└─]*(stats|cost):`)
+
+// ExplainOpt returns the plan the optimizer chooses for query, as printed by
+// EXPLAIN (OPT). Cost and row estimates are stripped from the plan so that
+// it only changes when the shape of the plan does.
+func (c *cluster) ExplainOpt(ctx context.Context, db *gosql.DB, query string) (string, error) {
+	rows, err := db.QueryContext(ctx, `EXPLAIN (OPT) `+query)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var buf strings.Builder
+	for rows.Next() {
+		var text string
+		if err := rows.Scan(&text); err != nil {
+			return "", err
+		}
+		for _, line := range strings.Split(text, "\n") {
+			if line = strings.TrimRight(line, " "); line == "" || planAnnotationRE.MatchString(line) {
+				continue
+			}
+			buf.WriteString(line)
+			buf.WriteString("\n")
+		}
+	}
+	return buf.String(), rows.Err()
+}
+
+// assertPlanContains checks that plan, as returned by ExplainOpt, contains
+// expectedOperator. The operator has to be spelled out the way the optimizer
+// prints it, e.g. "inner-join (lookup def)" for a lookup join into def, or
+// "inner-join" for a hash join.
+func assertPlanContains(plan, expectedOperator string) error {
+	for _, line := range strings.Split(plan, "\n") {
+		if strings.TrimLeft(line, " │├└─") == expectedOperator {
+			return nil
+		}
+	}
+	return errors.Errorf("expected plan to contain %s:\n%s", expectedOperator, plan)
+}
+
+// CreateStatistics collects fresh statistics on the default columns of table.
+// CREATE STATISTICS runs as a job, but the statement only returns once the job
+// has finished, so the statistics are visible to the optimizer afterwards.
+func (c *cluster) CreateStatistics(ctx context.Context, db *gosql.DB, table string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`CREATE STATISTICS roachtest FROM %s`, table))
+	return err
+}
+
+// columnStats are the statistics the optimizer sees for a set of columns.
+type columnStats struct {
+	Columns       []string
+	RowCount      int64
+	DistinctCount int64
+	NullCount     int64
+}
+
+// tableStats returns the most recent statistics of each set of columns of
+// table for which statistics have been collected.
+func tableStats(ctx context.Context, db *gosql.DB, table string) ([]columnStats, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+SELECT column_names, row_count, distinct_count, null_count
+  FROM [SHOW STATISTICS FOR TABLE %s]
+ ORDER BY created`, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []columnStats
+	latest := make(map[string]int)
+	for rows.Next() {
+		var s columnStats
+		if err := rows.Scan(
+			pq.Array(&s.Columns), &s.RowCount, &s.DistinctCount, &s.NullCount,
+		); err != nil {
+			return nil, err
+		}
+		key := strings.Join(s.Columns, ",")
+		if i, ok := latest[key]; ok {
+			result[i] = s
+			continue
+		}
+		latest[key] = len(result)
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
+
+// injectedStats are the statistics InjectStatistics sets on a table, one entry
+// per set of columns. Only the counts are injected, not histograms.
+type injectedStats []columnStats
+
+// InjectStatistics replaces the statistics of table with the injected ones.
+// This allows tests to put the optimizer in a particular plan regime, e.g. a
+// table with 10M rows and 5 distinct values in a column, without having to
+// load a representative dataset.
+func (c *cluster) InjectStatistics(
+	ctx context.Context, db *gosql.DB, table string, injected injectedStats,
+) error {
+	createdAt := timeutil.Now().UTC().Format("2006-01-02 15:04:05.999999-07:00")
+	jsonStats := make([]stats.JSONStatistic, len(injected))
+	for i, s := range injected {
+		jsonStats[i] = stats.JSONStatistic{
+			Name:          "roachtest",
+			CreatedAt:     createdAt,
+			Columns:       s.Columns,
+			RowCount:      uint64(s.RowCount),
+			DistinctCount: uint64(s.DistinctCount),
+			NullCount:     uint64(s.NullCount),
+		}
+	}
+	b, err := json.Marshal(jsonStats)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf(
+		`ALTER TABLE %s INJECT STATISTICS %s`, table, lex.EscapeSQLString(string(b))))
+	return err
+}
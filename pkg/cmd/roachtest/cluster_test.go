@@ -19,12 +19,15 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"reflect"
 	"regexp"
 	"runtime"
 	"testing"
 	"time"
 
+	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
 	"github.com/pkg/errors"
 )
 
@@ -57,6 +60,52 @@ func TestClusterNodes(t *testing.T) {
 	}
 }
 
+func TestClusterTemplates(t *testing.T) {
+	c := &cluster{nodes: 4}
+	nodes := c.nodes - 1
+	// The forms used by registerKVQuiescenceDead and its neighbors.
+	testCases := []struct {
+		template string
+		expected string
+	}{
+		{c.PGUrlTemplate(c.Node(1)), "{pgurl:1}"},
+		{c.PGUrlTemplate(c.Range(1, nodes)), fmt.Sprintf("{pgurl:1-%d}", nodes)},
+		{c.PGUrlTemplate(c.Range(1, nodes-1)), fmt.Sprintf("{pgurl:1-%d}", nodes-1)},
+		{c.PGUrlTemplate(nodeListOption{1, 3}), "{pgurl:1,3}"},
+		{c.PGUrlTemplate(nil), "{pgurl}"},
+		{c.PGPortTemplate(nodes), fmt.Sprintf("{pgport:%d}", nodes)},
+	}
+	for _, tc := range testCases {
+		if tc.expected != tc.template {
+			t.Errorf("expected %s, but found %s", tc.expected, tc.template)
+		}
+	}
+}
+
+func TestWithStatementTimeout(t *testing.T) {
+	testCases := []struct {
+		pgurl    string
+		timeout  time.Duration
+		expected string
+	}{
+		{"postgres://root@10.0.0.1:26257", 5 * time.Second,
+			"postgres://root@10.0.0.1:26257?statement_timeout=5000"},
+		{"postgres://root@10.0.0.1:26257?sslmode=disable", time.Minute,
+			"postgres://root@10.0.0.1:26257?sslmode=disable&statement_timeout=60000"},
+		{"postgres://root@10.0.0.1:26257?statement_timeout=1", 1500 * time.Microsecond,
+			"postgres://root@10.0.0.1:26257?statement_timeout=1"},
+	}
+	for _, tc := range testCases {
+		pgurl, err := withStatementTimeout(tc.pgurl, tc.timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.expected != pgurl {
+			t.Errorf("expected %s, but found %s", tc.expected, pgurl)
+		}
+	}
+}
+
 type testWrapper struct {
 	*testing.T
 }
@@ -253,3 +302,95 @@ func TestClusterMachineType(t *testing.T) {
 		})
 	}
 }
+
+func TestClusterEnvOption(t *testing.T) {
+	args := roachprodArgs([]option{
+		env(map[string]string{
+			"COCKROACH_SCAN_MAX_IDLE_TIME": "5ms",
+			"COCKROACH_MEMPROF_INTERVAL":   "1m",
+		}),
+		startArgs("--sequential"),
+	})
+	expected := []string{
+		"--env=COCKROACH_MEMPROF_INTERVAL=1m",
+		"--env=COCKROACH_SCAN_MAX_IDLE_TIME=5ms",
+		"--sequential",
+	}
+	if !reflect.DeepEqual(expected, args) {
+		t.Fatalf("expected %s, but found %s", expected, args)
+	}
+}
+
+func TestWaitForReplicationFactor(t *testing.T) {
+	ctx := context.Background()
+	s, db, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	if _, err := db.Exec(`CREATE DATABASE d; CREATE TABLE d.t (k INT PRIMARY KEY)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`ALTER TABLE d.t CONFIGURE ZONE USING num_replicas = 1`); err != nil {
+		t.Fatal(err)
+	}
+	// A single node cluster can't have more than one replica of any range.
+	for _, table := range []string{"d.t", ""} {
+		start := time.Now()
+		if err := waitForReplicationFactor(ctx, db, table, 1, time.Minute); err != nil {
+			t.Fatalf("%q: %s", table, err)
+		}
+		if d := time.Since(start); d > 10*time.Second {
+			t.Errorf("%q: took %s to notice the ranges were replicated", table, d)
+		}
+	}
+	if err := waitForReplicationFactor(ctx, db, "d.t", 3, time.Millisecond); !testutils.IsError(err,
+		`ranges weren't replicated 3 times after 1ms`) {
+		t.Errorf("expected a timeout, found %v", err)
+	}
+	if err := waitForReplicationFactor(ctx, db, "t", 1, time.Minute); !testutils.IsError(err,
+		`expected a table of the form database.table`) {
+		t.Errorf("expected an invalid table error, found %v", err)
+	}
+}
+
+func TestClusterSettingStmts(t *testing.T) {
+	settings := map[string]string{
+		"server.time_until_store_dead":                      "'1m30s'",
+		"kv.range_merge.queue_enabled":                      "false",
+		"kv.allocator.load_based_lease_rebalancing.enabled": "false",
+	}
+	expected := []string{
+		"SET CLUSTER SETTING kv.allocator.load_based_lease_rebalancing.enabled = false",
+		"SET CLUSTER SETTING kv.range_merge.queue_enabled = false",
+		"SET CLUSTER SETTING server.time_until_store_dead = '1m30s'",
+	}
+	// The order mustn't depend on the iteration order of the map.
+	for i := 0; i < 10; i++ {
+		if stmts := clusterSettingStmts(settings); !reflect.DeepEqual(expected, stmts) {
+			t.Fatalf("expected %s, but found %s", expected, stmts)
+		}
+	}
+}
+
+func TestApplyClusterSettings(t *testing.T) {
+	ctx := context.Background()
+	s, db, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	if err := applyClusterSettings(ctx, db, map[string]string{
+		"server.time_until_store_dead": "'1m30s'",
+		"kv.range_merge.queue_enabled": "false",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var enabled bool
+	if err := db.QueryRow(`SHOW CLUSTER SETTING kv.range_merge.queue_enabled`).Scan(&enabled); err != nil {
+		t.Fatal(err)
+	} else if enabled {
+		t.Error("expected kv.range_merge.queue_enabled to be false")
+	}
+	if err := applyClusterSettings(ctx, db, map[string]string{
+		"no.such.setting": "true",
+	}); !testutils.IsError(err, `SET CLUSTER SETTING no\.such\.setting = true: .*unknown cluster setting`) {
+		t.Errorf("expected an unknown setting error, found %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/pkg/errors"
+)
+
+func registerCompactionStall(r *registry) {
+	// This test writes large values over a bounded set of keys, which keeps
+	// the storage engines busy flushing and compacting, and checks that
+	// foreground writes, as seen by a canary, don't stall during compaction
+	// bursts. Brief latency spikes are tolerated, sustained stalls are not.
+	const (
+		// Canary writes slower than stallThreshold count towards a stall.
+		stallThreshold = time.Second
+		// The test fails if canary writes stall for longer than maxStall.
+		maxStall = 10 * time.Second
+		interval = 30 * time.Second
+	)
+	r.Add(testSpec{
+		Name:       "kv/compaction-stall/nodes=3",
+		Cluster:    makeClusterSpec(4, cpu(8)),
+		MinVersion: "v2.1.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			nodes := c.nodes - 1
+			c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
+			c.Put(ctx, workload, "./workload", c.Node(nodes+1))
+			c.Start(ctx, t, c.Range(1, nodes))
+			c.WaitForSQLReady(ctx, 1, time.Minute)
+			dumpKVTopology(ctx, t, c)
+
+			db := c.Conn(ctx, 1)
+			defer db.Close()
+
+			duration := 10 * time.Minute
+			if local {
+				duration = time.Minute
+			}
+			canary := newCanaryWriter(db, 100*time.Millisecond)
+			canaryCtx, cancelCanary := context.WithCancel(ctx)
+			defer cancelCanary()
+
+			m := newMonitor(ctx, c, c.Range(1, nodes))
+			m.Go(func(ctx context.Context) error {
+				defer cancelCanary()
+				t.WorkerStatus("running workload")
+				defer t.WorkerStatus()
+				return c.RunE(ctx, c.Node(nodes+1), fmt.Sprintf(
+					"./workload run kv --init --read-percent=0 --splits=100 --concurrency=%d"+
+						" --min-block-bytes=16384 --max-block-bytes=65536 --cycle-length=100000"+
+						" --duration=%s %s",
+					nodes*32, duration, c.PGUrlTemplate(c.Range(1, nodes))))
+			})
+			m.Go(func(context.Context) error {
+				return canary.run(canaryCtx)
+			})
+			m.Go(func(ctx context.Context) error {
+				// Correlate the canary's latency with the engine activity over
+				// each interval, so that a stall can be matched with compactions.
+				var history []string
+				prev, err := getEngineStats(ctx, c, c.Range(1, nodes))
+				if err != nil {
+					return err
+				}
+				for start := timeutil.Now(); ; start = start.Add(interval) {
+					select {
+					case <-canaryCtx.Done():
+						return nil
+					case <-time.After(time.Until(start.Add(interval))):
+					}
+					cur, err := getEngineStats(ctx, c, c.Range(1, nodes))
+					if err != nil {
+						return err
+					}
+					samples := canary.samples(start, start.Add(interval))
+					stall := canaryLongestStall(samples, stallThreshold)
+					history = append(history, fmt.Sprintf(
+						"canary p99 %s, longest stall %s; +%.0f compactions, +%.0f flushes, %.0f sstables, read amplification %.0f",
+						canaryQuantile(samples, 0.99), stall,
+						cur.Compactions-prev.Compactions, cur.Flushes-prev.Flushes, cur.SSTables, cur.ReadAmp))
+					t.l.Printf("%s\n", history[len(history)-1])
+					if stall > maxStall {
+						return errors.Errorf("foreground writes stalled for %s\nengine stats: %s\nhistory:\n%s",
+							stall, cur, strings.Join(history, "\n"))
+					}
+					prev = cur
+				}
+			})
+			m.Wait()
+		},
+	})
+}
@@ -0,0 +1,177 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// degradationThresholds holds, for the metrics detectDegradation checks, the
+// largest acceptable change of the metric over a run, relative to its mean. A
+// negative threshold flags metrics which decrease by more than it, a positive
+// one metrics which increase by more than it.
+var degradationThresholds = map[string]float64{
+	// The throughput must not drop by more than 20%.
+	"sql.query.count": -0.2,
+	// Latency must not rise by more than 50%.
+	"sql.service.latency-p99": 0.5,
+	// Memory usage must not grow by more than 50%, which would indicate a leak.
+	"sys.rss": 0.5,
+	// Neither must the number of goroutines, which would indicate a goroutine
+	// leak.
+	goroutinesMetric: 0.5,
+}
+
+// counterMetrics are metrics which count events. Their trends are fitted to
+// their rates rather than to their values.
+var counterMetrics = map[string]bool{
+	"sql.query.count": true,
+}
+
+// degradationWarmup is the fraction of each time series which is ignored when
+// fitting trends, as caches fill up and the load settles at the start of a run.
+const degradationWarmup = 0.2
+
+// metricTrend is a linear trend fitted to the time series of a metric on a
+// node.
+type metricTrend struct {
+	Node int
+	Name string
+	// Change is the change of the metric over the time series according to the
+	// trend, relative to the mean of the metric.
+	Change float64
+	// Series is the time series the trend was fitted to, i.e. without the
+	// warmup.
+	Series []metricSample
+}
+
+func (t metricTrend) String() string {
+	return fmt.Sprintf("n%d %s: %+.1f%%", t.Node, t.Name, 100*t.Change)
+}
+
+// degradationReport is the result of detectDegradation.
+type degradationReport struct {
+	Trends []metricTrend
+	// Degraded holds the trends which exceed their degradation threshold.
+	Degraded []metricTrend
+}
+
+func (r *degradationReport) String() string {
+	var buf strings.Builder
+	for _, t := range r.Trends {
+		fmt.Fprintf(&buf, "%s\n", t)
+	}
+	if len(r.Degraded) > 0 {
+		fmt.Fprintf(&buf, "degraded:\n")
+		for _, t := range r.Degraded {
+			fmt.Fprintf(&buf, "  %s (threshold %+.1f%%), values:", t, 100*degradationThresholds[t.Name])
+			for _, s := range t.Series {
+				fmt.Fprintf(&buf, " %g", s.Value)
+			}
+			fmt.Fprintf(&buf, "\n")
+		}
+	}
+	return buf.String()
+}
+
+// detectDegradation fits a linear trend to the time series of each metric on
+// each node in samples, as recorded by a metricRecorder, and reports the
+// trends which show that the cluster got gradually worse over the run, e.g.
+// due to a leak, according to degradationThresholds.
+func detectDegradation(samples []metricSample) (*degradationReport, error) {
+	type seriesKey struct {
+		node int
+		name string
+	}
+	series := make(map[seriesKey][]metricSample)
+	for _, s := range samples {
+		k := seriesKey{s.Node, s.Name}
+		series[k] = append(series[k], s)
+	}
+	keys := make([]seriesKey, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].node != keys[j].node {
+			return keys[i].node < keys[j].node
+		}
+		return keys[i].name < keys[j].name
+	})
+
+	r := &degradationReport{}
+	for _, k := range keys {
+		s := series[k]
+		s = s[int(degradationWarmup*float64(len(s))):]
+		var xs, ys []float64
+		for i := range s {
+			if !counterMetrics[k.name] {
+				xs = append(xs, s[i].Time.Sub(s[0].Time).Seconds())
+				ys = append(ys, s[i].Value)
+				continue
+			}
+			if i == 0 {
+				continue
+			}
+			elapsed := s[i].Time.Sub(s[i-1].Time).Seconds()
+			xs = append(xs, s[i].Time.Sub(s[0].Time).Seconds())
+			ys = append(ys, (s[i].Value-s[i-1].Value)/elapsed)
+		}
+		const minPoints = 10
+		if len(xs) < minPoints {
+			return nil, errors.Errorf("n%d %s: %d data points are too few to fit a trend (need %d)",
+				k.node, k.name, len(xs), minPoints)
+		}
+		slope, mean := fitTrend(xs, ys)
+		t := metricTrend{Node: k.node, Name: k.name, Series: s}
+		if mean != 0 {
+			t.Change = slope * (xs[len(xs)-1] - xs[0]) / mean
+		}
+		r.Trends = append(r.Trends, t)
+		if threshold, ok := degradationThresholds[k.name]; ok {
+			if (threshold < 0 && t.Change < threshold) || (threshold > 0 && t.Change > threshold) {
+				r.Degraded = append(r.Degraded, t)
+			}
+		}
+	}
+	return r, nil
+}
+
+// fitTrend returns the slope of the least squares linear fit of ys over xs,
+// and the mean of ys.
+func fitTrend(xs, ys []float64) (slope, mean float64) {
+	n := float64(len(xs))
+	var sumX, sumY float64
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+	}
+	meanX := sumX / n
+	mean = sumY / n
+	var cov, varX float64
+	for i := range xs {
+		cov += (xs[i] - meanX) * (ys[i] - mean)
+		varX += (xs[i] - meanX) * (xs[i] - meanX)
+	}
+	if varX == 0 {
+		return 0, mean
+	}
+	return cov / varX, mean
+}
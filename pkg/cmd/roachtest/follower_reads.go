@@ -0,0 +1,319 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"context"
+	gosql "database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	toxiproxy "github.com/Shopify/toxiproxy/client"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/pkg/errors"
+)
+
+// assertFollowerReadFreshness writes a new value for key to the
+// followerreads.kv table and checks that historical reads of it, which are
+// eligible to be served by followers, are exactly as stale as requested:
+//
+//   - a read at the timestamp of the write returns the new value,
+//   - a read maxStaleness in the past, issued right after the write, returns
+//     either the new value or the one it overwrote, but nothing older,
+//   - the same read, issued once maxStaleness has passed, returns the new value.
+//
+// Values only ever increase, which allows telling them apart by age.
+func assertFollowerReadFreshness(
+	ctx context.Context, db *gosql.DB, key int, maxStaleness time.Duration,
+) error {
+	tx, err := db.BeginTx(ctx, nil /* opts */)
+	if err != nil {
+		return err
+	}
+	var prev int
+	if err := tx.QueryRowContext(ctx,
+		`SELECT v FROM followerreads.kv WHERE k = $1`, key,
+	).Scan(&prev); err != nil && err != gosql.ErrNoRows {
+		_ = tx.Rollback()
+		return err
+	}
+	cur := prev + 1
+	var writeTS string
+	if _, err := tx.ExecContext(ctx, `UPSERT INTO followerreads.kv VALUES ($1, $2)`, key, cur); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.QueryRowContext(ctx, `SELECT cluster_logical_timestamp()`).Scan(&writeTS); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	written := timeutil.Now()
+
+	read := func(asOf string) (int, error) {
+		var v int
+		err := db.QueryRowContext(ctx, fmt.Sprintf(
+			`SELECT v FROM followerreads.kv AS OF SYSTEM TIME %s WHERE k = $1`, asOf), key,
+		).Scan(&v)
+		if err == gosql.ErrNoRows {
+			// The key was first written after the read timestamp.
+			return 0, nil
+		}
+		return v, err
+	}
+
+	if v, err := read(writeTS); err != nil {
+		return err
+	} else if v != cur {
+		return errors.Errorf("read at write timestamp %s returned %d, expected %d", writeTS, v, cur)
+	}
+
+	stale := fmt.Sprintf("'-%s'", maxStaleness)
+	if v, err := read(stale); err != nil {
+		return err
+	} else if v != prev && v != cur {
+		return errors.Errorf("read %s in the past returned %d, expected %d or %d",
+			maxStaleness, v, prev, cur)
+	}
+
+	// Leave some slack for the clock offset between the nodes.
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Until(written.Add(maxStaleness + time.Second))):
+	}
+	if v, err := read(stale); err != nil {
+		return err
+	} else if v != cur {
+		return errors.Errorf("read %s in the past returned %d more than %s after %d was written",
+			maxStaleness, v, maxStaleness, cur)
+	}
+	return nil
+}
+
+// relocateLeases moves the leases of all the ranges of table to store. The
+// ranges are addressed by their start keys, which requires table to have a
+// single INT primary key column.
+func relocateLeases(ctx context.Context, db *gosql.DB, table string, store int) error {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+SELECT start_key FROM [SHOW EXPERIMENTAL_RANGES FROM TABLE %s] WHERE lease_holder != $1`, table),
+		store)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var starts []int64
+	for rows.Next() {
+		var start gosql.NullString
+		if err := rows.Scan(&start); err != nil {
+			return err
+		}
+		// The first range of the table has no start key within the table.
+		key := int64(math.MinInt64)
+		if start.Valid {
+			if key, err = strconv.ParseInt(strings.TrimPrefix(start.String, "/"), 10, 64); err != nil {
+				return errors.Wrapf(err, "parsing start key %s", start.String)
+			}
+		}
+		starts = append(starts, key)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, key := range starts {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(
+			`ALTER TABLE %s EXPERIMENTAL_RELOCATE LEASE VALUES ($1, $2)`, table), store, key,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func registerFollowerReads(r *registry) {
+	// This test writes a key over and over through all the gateways and
+	// checks that historical reads of it, which followers may serve based on
+	// the closed timestamps they have been informed of, are never staler than
+	// requested. It checks correctness only; there is no load.
+	const closedTimestampTarget = 3 * time.Second
+	const maxStaleness = 5 * time.Second
+
+	r.Add(testSpec{
+		Name:       "follower-reads/freshness/nodes=3",
+		Cluster:    makeClusterSpec(3),
+		MinVersion: "v2.1.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			c.Put(ctx, cockroach, "./cockroach")
+			c.Start(ctx, t)
+
+			dbs := make([]*gosql.DB, c.nodes)
+			for i := range dbs {
+				dbs[i] = c.Conn(ctx, i+1)
+				defer dbs[i].Close()
+			}
+			for _, stmt := range []string{
+				`SET CLUSTER SETTING kv.closed_timestamp.follower_reads_enabled = true`,
+				fmt.Sprintf(`SET CLUSTER SETTING kv.closed_timestamp.target_duration = '%s'`,
+					closedTimestampTarget),
+				`CREATE DATABASE followerreads`,
+				`CREATE TABLE followerreads.kv (k INT PRIMARY KEY, v INT NOT NULL)`,
+			} {
+				if _, err := dbs[0].ExecContext(ctx, stmt); err != nil {
+					t.Fatal(err)
+				}
+			}
+			waitForFullReplication(t, dbs[0])
+
+			duration := 5 * time.Minute
+			if local {
+				duration = 30 * time.Second
+			}
+			var checks int
+			for start := timeutil.Now(); timeutil.Since(start) < duration; checks++ {
+				db := dbs[checks%len(dbs)]
+				if err := assertFollowerReadFreshness(ctx, db, 1 /* key */, maxStaleness); err != nil {
+					t.Fatalf("n%d: %s", checks%len(dbs)+1, err)
+				}
+			}
+			t.l.Printf("%d freshness checks passed\n", checks)
+		},
+	})
+
+	// This test writes through n1, which holds all the leases of the kv table,
+	// and reads, historically enough for followers to serve them, through the
+	// other nodes. Once n1 is partitioned away from the rest of the cluster,
+	// the reads must keep being served by the followers, so their throughput
+	// mustn't drop below minReadFraction of what it was before.
+	const minReadFraction = 0.5
+	const readStaleness = 10 * time.Second
+	r.Add(testSpec{
+		Name:       "kv/followerreads/nodes=3",
+		Cluster:    makeClusterSpec(4),
+		MinVersion: "v2.1.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			nodes := c.nodes - 1
+			serverNodes, loadNode := c.Range(1, nodes), c.Node(nodes+1)
+			c.Put(ctx, cockroach, "./cockroach", serverNodes)
+			c.Put(ctx, workload, "./workload", loadNode)
+			tc := Toxify(ctx, c, serverNodes)
+			tc.Start(ctx, t, serverNodes)
+
+			db := tc.Conn(ctx, 2)
+			defer db.Close()
+			for _, stmt := range []string{
+				`SET CLUSTER SETTING kv.closed_timestamp.follower_reads_enabled = true`,
+				fmt.Sprintf(`SET CLUSTER SETTING kv.closed_timestamp.target_duration = '%s'`,
+					closedTimestampTarget),
+			} {
+				if _, err := db.ExecContext(ctx, stmt); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c.Run(ctx, loadNode, "./workload init kv --splits=10 "+c.PGUrlTemplate(c.Node(1)))
+			waitForFullReplication(t, db)
+			if err := relocateLeases(ctx, db, "kv.kv", 1 /* store */); err != nil {
+				t.Fatal(err)
+			}
+
+			baseline, partition := 2*time.Minute, 2*time.Minute
+			if local {
+				baseline, partition = 30*time.Second, 30*time.Second
+			}
+			duration := baseline + partition + time.Minute
+
+			t.Status("running workloads")
+			reads := newWorkloadProgress(nil /* ticks */)
+			m := newMonitor(ctx, c, serverNodes)
+			m.Go(func(ctx context.Context) error {
+				return c.RunE(ctx, loadNode, fmt.Sprintf(
+					"./workload run kv --read-percent=0 --concurrency=16 --tolerate-errors"+
+						" --duration=%s %s", duration, c.PGUrlTemplate(c.Node(1))))
+			})
+			m.Go(func(ctx context.Context) error {
+				return c.RunWithProgress(ctx, loadNode, reads, fmt.Sprintf(
+					"./workload run kv --read-percent=100 --follower-read-staleness=%s"+
+						" --concurrency=32 --tolerate-errors --duration=%s %s",
+					readStaleness, duration, c.PGUrlTemplate(c.Range(2, nodes))))
+			})
+			m.Go(func(ctx context.Context) error {
+				// meanReadQPS samples the read throughput for the given duration.
+				meanReadQPS := func(d time.Duration) (float64, error) {
+					ticker := time.NewTicker(5 * time.Second)
+					defer ticker.Stop()
+					var sum float64
+					var n int
+					for end := time.After(d); ; {
+						select {
+						case <-ctx.Done():
+							return 0, ctx.Err()
+						case <-end:
+							if n == 0 {
+								return 0, nil
+							}
+							return sum / float64(n), nil
+						case <-ticker.C:
+							sum += reads.OpsPerSec()
+							n++
+						}
+					}
+				}
+
+				before, err := meanReadQPS(baseline)
+				if err != nil {
+					return err
+				}
+
+				t.WorkerStatus("partitioning n1")
+				defer t.WorkerStatus()
+				proxy := tc.Proxy(1)
+				for _, direction := range []string{"upstream", "downstream"} {
+					if _, err := proxy.AddToxic("", "timeout", direction, 1, toxiproxy.Attributes{
+						"timeout": 0, // forever
+					}); err != nil {
+						return err
+					}
+				}
+				during, err := meanReadQPS(partition)
+				if err != nil {
+					return err
+				}
+				toxics, err := proxy.Toxics()
+				if err != nil {
+					return err
+				}
+				for _, toxic := range toxics {
+					if err := proxy.RemoveToxic(toxic.Name); err != nil {
+						return err
+					}
+				}
+
+				t.l.Printf("follower reads: %.1f reads/sec before partitioning n1, %.1f during\n",
+					before, during)
+				if during < minReadFraction*before {
+					return errors.Errorf("reads dropped from %.1f/sec to %.1f/sec with the leaseholder partitioned",
+						before, during)
+				}
+				return nil
+			})
+			m.Wait()
+		},
+	})
+}
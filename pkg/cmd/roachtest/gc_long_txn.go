@@ -0,0 +1,154 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"context"
+	gosql "database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func registerGCLongTxn(r *registry) {
+	// This test holds a read transaction open while the data it reads is
+	// overwritten over and over under a GC TTL which is much shorter than the
+	// transaction's lifetime. Nothing protects the transaction's snapshot from
+	// being garbage collected, so the transaction may legitimately be refused
+	// once the GC threshold passes its timestamp. What it must never do is
+	// return data other than what it read initially, e.g. a partially collected
+	// snapshot.
+	const rows = 1000
+	const payloadSize = 1 << 10
+
+	r.Add(testSpec{
+		Name:       "gc/ttl/long-txn/nodes=3",
+		Cluster:    makeClusterSpec(3),
+		MinVersion: "v2.1.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			c.Put(ctx, cockroach, "./cockroach")
+			c.Start(ctx, t)
+			db := c.Conn(ctx, 1)
+			defer db.Close()
+
+			duration := 10 * time.Minute
+			if local {
+				duration = time.Minute
+			}
+
+			t.Status("loading data")
+			for _, stmt := range []string{
+				`CREATE DATABASE gcttl`,
+				`CREATE TABLE gcttl.kv (k INT PRIMARY KEY, v INT NOT NULL, payload STRING NOT NULL)`,
+				fmt.Sprintf(`INSERT INTO gcttl.kv SELECT i, 0, repeat('x', %d) FROM generate_series(1, %d) AS g(i)`,
+					payloadSize, rows),
+			} {
+				if _, err := db.ExecContext(ctx, stmt); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.SetGCTTL(ctx, db, "TABLE gcttl.kv", time.Second); err != nil {
+				t.Fatal(err)
+			}
+
+			type snapshot struct {
+				count, sum int64
+			}
+			read := func(ctx context.Context, q interface {
+				QueryRowContext(context.Context, string, ...interface{}) *gosql.Row
+			}) (snapshot, error) {
+				var s snapshot
+				err := q.QueryRowContext(ctx, `SELECT count(*), sum(v) FROM gcttl.kv`).Scan(&s.count, &s.sum)
+				return s, err
+			}
+
+			// Read through a different gateway than the one the updates go to.
+			txnDB := c.Conn(ctx, 2)
+			defer txnDB.Close()
+			txn, err := c.BeginLongTxn(ctx, txnDB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = txn.Rollback() }()
+			initial, err := read(ctx, txn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.l.Printf("long-running txn at %s read %+v\n", txn.Timestamp, initial)
+			if initial != (snapshot{count: rows}) {
+				t.Fatalf("unexpected initial data: %+v", initial)
+			}
+
+			// verify re-reads the data in the long-running txn. It returns false
+			// once the data the txn needs has been garbage collected.
+			verify := func(ctx context.Context) (bool, error) {
+				s, err := read(ctx, txn)
+				if err != nil {
+					if strings.Contains(err.Error(), "must be after GC threshold") {
+						t.l.Printf("long-running txn refused after its data was GC'ed: %s\n", err)
+						return false, nil
+					}
+					return false, err
+				}
+				if s != initial {
+					return false, errors.Errorf(
+						"long-running txn at %s read %+v, but initially read %+v", txn.Timestamp, s, initial)
+				}
+				return true, nil
+			}
+
+			t.Status("generating garbage")
+			done := time.After(duration)
+			var rounds, verifications int
+			alive := true
+		Loop:
+			for {
+				select {
+				case <-done:
+					break Loop
+				case <-ctx.Done():
+					t.Fatal(ctx.Err())
+				default:
+				}
+				if _, err := db.ExecContext(ctx,
+					`UPDATE gcttl.kv SET v = v + 1, payload = repeat('y', length(payload))`,
+				); err != nil {
+					t.Fatal(err)
+				}
+				rounds++
+				if alive && rounds%10 == 0 {
+					if alive, err = verify(ctx); err != nil {
+						t.Fatal(err)
+					}
+					verifications++
+				}
+			}
+			t.l.Printf("%d rounds of updates, long-running txn verified %d times\n",
+				rounds, verifications)
+
+			// The writes have to be visible to everyone else.
+			cur, err := read(ctx, db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exp := (snapshot{count: rows, sum: int64(rows * rounds)}); cur != exp {
+				t.Fatalf("expected %+v after %d rounds of updates, found %+v", exp, rounds, cur)
+			}
+		},
+	})
+}
@@ -0,0 +1,225 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/workload"
+	"github.com/codahale/hdrhistogram"
+	"github.com/pkg/errors"
+)
+
+// histogramSummary summarizes the throughput and latencies of one of the
+// operations of a workload run over the whole run.
+type histogramSummary struct {
+	Name      string  `json:"name"`
+	Ops       int64   `json:"ops"`
+	OpsPerSec float64 `json:"opsPerSec"`
+	P50Millis float64 `json:"p50Millis"`
+	P95Millis float64 `json:"p95Millis"`
+	P99Millis float64 `json:"p99Millis"`
+	MaxMillis float64 `json:"maxMillis"`
+}
+
+// summarizeHistograms parses the histograms written by `./workload run
+// --histograms`, i.e. one JSON encoded workload.SnapshotTick per line, and
+// summarizes each operation. The summaries are sorted by operation name.
+func summarizeHistograms(r io.Reader) ([]histogramSummary, error) {
+	type opHistogram struct {
+		hist       *hdrhistogram.Histogram
+		start, end time.Time
+	}
+	ops := make(map[string]*opHistogram)
+	dec := json.NewDecoder(r)
+	for {
+		var tick workload.SnapshotTick
+		if err := dec.Decode(&tick); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "parsing histograms")
+		}
+		if tick.Hist == nil {
+			return nil, errors.Errorf("tick of %s at %s has no histogram", tick.Name, tick.Now)
+		}
+		h := hdrhistogram.Import(tick.Hist)
+		start := tick.Now.Add(-tick.Elapsed)
+		op, ok := ops[tick.Name]
+		if !ok {
+			ops[tick.Name] = &opHistogram{hist: h, start: start, end: tick.Now}
+			continue
+		}
+		op.hist.Merge(h)
+		if start.Before(op.start) {
+			op.start = start
+		}
+		if tick.Now.After(op.end) {
+			op.end = tick.Now
+		}
+	}
+
+	millis := func(nanos int64) float64 {
+		return float64(nanos) / float64(time.Millisecond)
+	}
+	summaries := make([]histogramSummary, 0, len(ops))
+	for name, op := range ops {
+		s := histogramSummary{
+			Name:      name,
+			Ops:       op.hist.TotalCount(),
+			P50Millis: millis(op.hist.ValueAtQuantile(50)),
+			P95Millis: millis(op.hist.ValueAtQuantile(95)),
+			P99Millis: millis(op.hist.ValueAtQuantile(99)),
+			MaxMillis: millis(op.hist.Max()),
+		}
+		if d := op.end.Sub(op.start); d > 0 {
+			s.OpsPerSec = float64(s.Ops) / d.Seconds()
+		}
+		summaries = append(summaries, s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Name < summaries[j].Name
+	})
+	return summaries, nil
+}
+
+// mergeHistograms merges the histograms written by concurrent runs of a
+// workload, e.g. one on each of several load nodes, into the histograms of a
+// single run, which it writes to w in the same format. The n-th tick of an
+// operation in one run is merged with the n-th tick of that operation in all
+// the others. A tick covers the period [Now-Elapsed,Now), and the merged tick
+// covers the union of the periods of the ticks it was merged from.
+func mergeHistograms(w io.Writer, runs ...io.Reader) error {
+	type mergedTick struct {
+		hist       *hdrhistogram.Histogram
+		start, now time.Time
+	}
+	ticks := make(map[string][]*mergedTick)
+	var numTicks int
+	for _, r := range runs {
+		seen := make(map[string]int)
+		dec := json.NewDecoder(r)
+		for {
+			var tick workload.SnapshotTick
+			if err := dec.Decode(&tick); err == io.EOF {
+				break
+			} else if err != nil {
+				return errors.Wrap(err, "parsing histograms")
+			}
+			if tick.Hist == nil {
+				return errors.Errorf("tick of %s at %s has no histogram", tick.Name, tick.Now)
+			}
+			h := hdrhistogram.Import(tick.Hist)
+			i := seen[tick.Name]
+			seen[tick.Name]++
+			if i == len(ticks[tick.Name]) {
+				ticks[tick.Name] = append(ticks[tick.Name],
+					&mergedTick{hist: h, start: tick.Now.Add(-tick.Elapsed), now: tick.Now})
+				if i >= numTicks {
+					numTicks = i + 1
+				}
+				continue
+			}
+			m := ticks[tick.Name][i]
+			m.hist.Merge(h)
+			if start := tick.Now.Add(-tick.Elapsed); start.Before(m.start) {
+				m.start = start
+			}
+			if tick.Now.After(m.now) {
+				m.now = tick.Now
+			}
+		}
+	}
+
+	names := make([]string, 0, len(ticks))
+	for name := range ticks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	enc := json.NewEncoder(w)
+	for i := 0; i < numTicks; i++ {
+		for _, name := range names {
+			if i >= len(ticks[name]) {
+				continue
+			}
+			m := ticks[name][i]
+			if err := enc.Encode(workload.SnapshotTick{
+				Name:    name,
+				Hist:    m.hist.Export(),
+				Elapsed: m.now.Sub(m.start),
+				Now:     m.now,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compareHistograms compares the histograms of two runs of a workload, as
+// written to the baseline and candidate files by `./workload run --histograms`.
+// It returns an error if the p99 latency of any operation of the candidate
+// exceeds that of the baseline by more than maxP99RegressionPct percent.
+// Operations which only one of the runs performed are ignored.
+func compareHistograms(baseline, candidate string, maxP99RegressionPct float64) error {
+	summarize := func(path string) (map[string]histogramSummary, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		summaries, err := summarizeHistograms(f)
+		if err != nil {
+			return nil, errors.Wrap(err, path)
+		}
+		m := make(map[string]histogramSummary, len(summaries))
+		for _, s := range summaries {
+			m[s.Name] = s
+		}
+		return m, nil
+	}
+	before, err := summarize(baseline)
+	if err != nil {
+		return err
+	}
+	after, err := summarize(candidate)
+	if err != nil {
+		return err
+	}
+
+	var regressions []string
+	for name, b := range before {
+		a, ok := after[name]
+		if !ok || b.P99Millis == 0 {
+			continue
+		}
+		if pct := 100 * (a.P99Millis - b.P99Millis) / b.P99Millis; pct > maxP99RegressionPct {
+			regressions = append(regressions, fmt.Sprintf(
+				"%s: p99 went from %.2fms to %.2fms (+%.1f%%)", name, b.P99Millis, a.P99Millis, pct))
+		}
+	}
+	if len(regressions) > 0 {
+		sort.Strings(regressions)
+		return errors.Errorf("p99 latency regressed by more than %.1f%%:\n%s",
+			maxP99RegressionPct, strings.Join(regressions, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/workload"
+	"github.com/codahale/hdrhistogram"
+)
+
+func TestSummarizeHistograms(t *testing.T) {
+	start := time.Date(2018, 11, 1, 0, 0, 0, 0, time.UTC)
+	// tick returns a tick of name, ending elapsed after start, during which
+	// there was one operation for each of the latencies.
+	tick := func(name string, elapsed time.Duration, latencies ...time.Duration) workload.SnapshotTick {
+		h := hdrhistogram.New(time.Microsecond.Nanoseconds(), time.Minute.Nanoseconds(), 3)
+		for _, l := range latencies {
+			if err := h.RecordValue(l.Nanoseconds()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return workload.SnapshotTick{
+			Name:    name,
+			Hist:    h.Export(),
+			Elapsed: time.Second,
+			Now:     start.Add(elapsed),
+		}
+	}
+
+	// The histograms file, as written by the workload, interleaves the ticks
+	// of the operations.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, tick := range []workload.SnapshotTick{
+		tick("write", 1*time.Second, 2*time.Millisecond, 2*time.Millisecond),
+		tick("read", 1*time.Second, time.Millisecond),
+		tick("write", 2*time.Second, 2*time.Millisecond, 10*time.Millisecond),
+		tick("read", 2*time.Second, time.Millisecond),
+	} {
+		if err := enc.Encode(tick); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	summaries, err := summarizeHistograms(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 2 || summaries[0].Name != "read" || summaries[1].Name != "write" {
+		t.Fatalf("expected summaries of read and write, found %+v", summaries)
+	}
+	read, write := summaries[0], summaries[1]
+	if read.Ops != 2 || read.OpsPerSec != 1 {
+		t.Errorf("expected 2 reads at 1/sec, found %+v", read)
+	}
+	if write.Ops != 4 || write.OpsPerSec != 2 {
+		t.Errorf("expected 4 writes at 2/sec, found %+v", write)
+	}
+	// The latencies are only as precise as the histograms' significant
+	// figures.
+	approx := func(a, b float64) bool {
+		return a > b*0.99 && a < b*1.01
+	}
+	if !approx(read.P99Millis, 1) || !approx(read.MaxMillis, 1) {
+		t.Errorf("expected read latencies of 1ms, found %+v", read)
+	}
+	if !approx(write.P50Millis, 2) || !approx(write.P99Millis, 10) || !approx(write.MaxMillis, 10) {
+		t.Errorf("expected write latencies of 2ms at the median and 10ms at most, found %+v", write)
+	}
+
+	if _, err := summarizeHistograms(strings.NewReader(`{"Name": "read", "Hist": `)); !testutils.IsError(err,
+		"parsing histograms") {
+		t.Errorf("expected a parsing error, found %v", err)
+	}
+}
+
+func TestCompareHistograms(t *testing.T) {
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	// writeStats writes a histograms file with one tick of each of the given
+	// operations, during which there was one operation for each of the
+	// latencies.
+	writeStats := func(name string, ops map[string][]time.Duration) string {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for op, latencies := range ops {
+			h := hdrhistogram.New(time.Microsecond.Nanoseconds(), time.Minute.Nanoseconds(), 3)
+			for _, l := range latencies {
+				if err := h.RecordValue(l.Nanoseconds()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := enc.Encode(workload.SnapshotTick{
+				Name:    op,
+				Hist:    h.Export(),
+				Elapsed: time.Second,
+				Now:     time.Date(2018, 11, 1, 0, 0, 1, 0, time.UTC),
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	baseline := writeStats("baseline.json", map[string][]time.Duration{
+		"read":  {10 * time.Millisecond},
+		"write": {20 * time.Millisecond},
+	})
+	slightlySlower := writeStats("slightly-slower.json", map[string][]time.Duration{
+		"read":  {11 * time.Millisecond},
+		"write": {20 * time.Millisecond},
+		// Operations missing from the baseline are ignored.
+		"scan": {time.Second},
+	})
+	muchSlower := writeStats("much-slower.json", map[string][]time.Duration{
+		"read":  {10 * time.Millisecond},
+		"write": {30 * time.Millisecond},
+	})
+
+	if err := compareHistograms(baseline, baseline, 0); err != nil {
+		t.Errorf("expected no regression against itself, found %v", err)
+	}
+	if err := compareHistograms(baseline, slightlySlower, 20); err != nil {
+		t.Errorf("expected a regression within the tolerance, found %v", err)
+	}
+	if err := compareHistograms(baseline, slightlySlower, 5); !testutils.IsError(err,
+		`read: p99 went from 10\.\d+ms to 11\.\d+ms`) {
+		t.Errorf("expected a read regression, found %v", err)
+	}
+	if err := compareHistograms(baseline, muchSlower, 20); !testutils.IsError(err,
+		`write: p99 went from 20\.\d+ms to 30\.\d+ms \(\+\d+\.\d%\)`) {
+		t.Errorf("expected a write regression, found %v", err)
+	}
+	if err := compareHistograms(baseline, filepath.Join(dir, "missing.json"), 20); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestMergeHistograms(t *testing.T) {
+	start := time.Date(2018, 11, 1, 0, 0, 0, 0, time.UTC)
+	// run returns the histograms file of a run, started at the given offset,
+	// with one tick of each of the given operations per second, during which
+	// there were as many operations of 1ms as the tick's count.
+	run := func(offset time.Duration, ops map[string][]int) *bytes.Buffer {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for op, counts := range ops {
+			for i, n := range counts {
+				h := hdrhistogram.New(time.Microsecond.Nanoseconds(), time.Minute.Nanoseconds(), 3)
+				if err := h.RecordValues(time.Millisecond.Nanoseconds(), int64(n)); err != nil {
+					t.Fatal(err)
+				}
+				if err := enc.Encode(workload.SnapshotTick{
+					Name:    op,
+					Hist:    h.Export(),
+					Elapsed: time.Second,
+					Now:     start.Add(time.Duration(i+1)*time.Second + offset),
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return &buf
+	}
+
+	var merged bytes.Buffer
+	if err := mergeHistograms(&merged,
+		run(0, map[string][]int{"read": {1, 2}, "write": {3}}),
+		run(10*time.Millisecond, map[string][]int{"read": {4, 5, 6}}),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	var ticks []string
+	dec := json.NewDecoder(&merged)
+	for dec.More() {
+		var tick workload.SnapshotTick
+		if err := dec.Decode(&tick); err != nil {
+			t.Fatal(err)
+		}
+		ticks = append(ticks, fmt.Sprintf("%s@%s+%s: %d ops", tick.Name,
+			tick.Now.Add(-tick.Elapsed).Sub(start), tick.Elapsed, hdrhistogram.Import(tick.Hist).TotalCount()))
+	}
+	// The merged ticks span the ticks of both runs.
+	expected := []string{
+		"read@0s+1.01s: 5 ops",
+		"write@0s+1s: 3 ops",
+		"read@1s+1.01s: 7 ops",
+		"read@2.01s+1s: 6 ops",
+	}
+	if !reflect.DeepEqual(ticks, expected) {
+		t.Errorf("expected merged ticks %v, found %v", expected, ticks)
+	}
+
+	if err := mergeHistograms(&merged, strings.NewReader(`{"Name": "read", "Hist": `)); !testutils.IsError(err,
+		"parsing histograms") {
+		t.Errorf("expected a parsing error, found %v", err)
+	}
+}
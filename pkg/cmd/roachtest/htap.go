@@ -0,0 +1,143 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+func registerHTAP(r *registry) {
+	// This test runs a kv workload and, once a baseline for the latency of
+	// point writes has been established, full table aggregations over the
+	// same table. The analytical queries are expected to slow down the point
+	// writes somewhat, but not by more than maxP99Ratio. The runtime of the
+	// analytical queries is reported, but doesn't fail the test.
+	const maxP99Ratio = 4
+	// p99 latencies up to minP99Bound are acceptable regardless of the
+	// baseline, so that a very fast baseline doesn't make the test flaky.
+	const minP99Bound = 50 * time.Millisecond
+
+	r.Add(testSpec{
+		Name:       "kv/htap/nodes=3",
+		Cluster:    makeClusterSpec(4),
+		MinVersion: "v2.1.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			nodes := c.nodes - 1
+			c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
+			c.Put(ctx, workload, "./workload", c.Node(nodes+1))
+			c.Start(ctx, t, c.Range(1, nodes))
+			c.WaitForSQLReady(ctx, 1, time.Minute)
+			dumpKVTopology(ctx, t, c)
+
+			baseline, duration, rows := 5*time.Minute, 15*time.Minute, 5000000
+			if local {
+				baseline, duration, rows = 20*time.Second, time.Minute, 10000
+			}
+
+			t.Status("loading data")
+			c.Run(ctx, c.Node(nodes+1), fmt.Sprintf(
+				"./workload run kv --init --read-percent=0 --splits=100 --concurrency=%d"+
+					" --min-block-bytes=1024 --max-block-bytes=1024 --max-ops=%d %s",
+				nodes*64, rows, c.PGUrlTemplate(c.Range(1, nodes))))
+
+			db := c.Conn(ctx, 1)
+			defer db.Close()
+			canary := newCanaryWriter(db, 100*time.Millisecond)
+			canaryCtx, cancelCanary := context.WithCancel(ctx)
+			defer cancelCanary()
+
+			start := timeutil.Now()
+			olapStart := start.Add(baseline)
+			m := newMonitor(ctx, c, c.Range(1, nodes))
+			m.Go(func(ctx context.Context) error {
+				defer cancelCanary()
+				t.WorkerStatus("running OLTP workload")
+				defer t.WorkerStatus()
+				return c.RunE(ctx, c.Node(nodes+1), fmt.Sprintf(
+					"./workload run kv --read-percent=50 --concurrency=%d"+
+						" --min-block-bytes=1024 --max-block-bytes=1024 --duration=%s %s",
+					nodes*16, duration, c.PGUrlTemplate(c.Range(1, nodes))))
+			})
+			m.Go(func(context.Context) error {
+				return canary.run(canaryCtx)
+			})
+			var runtimes []time.Duration
+			m.Go(func(ctx context.Context) error {
+				select {
+				case <-canaryCtx.Done():
+					return nil
+				case <-time.After(time.Until(olapStart)):
+				}
+				t.WorkerStatus("running analytical queries")
+				defer t.WorkerStatus()
+				// Run the queries through another gateway than the canary.
+				olapDB := c.Conn(ctx, 2)
+				defer olapDB.Close()
+				for {
+					select {
+					case <-canaryCtx.Done():
+						return nil
+					default:
+					}
+					queryStart := timeutil.Now()
+					var count, bytes int64
+					if err := olapDB.QueryRowContext(canaryCtx,
+						`SELECT count(*), sum(length(v)) FROM kv.kv`,
+					).Scan(&count, &bytes); err != nil {
+						if canaryCtx.Err() != nil {
+							return nil
+						}
+						return err
+					}
+					runtime := timeutil.Since(queryStart)
+					t.l.Printf("aggregated %d rows (%d bytes) in %s\n", count, bytes, runtime)
+					runtimes = append(runtimes, runtime)
+				}
+			})
+			m.Wait()
+
+			baselineP99 := canaryQuantile(canary.samples(start, olapStart), 0.99)
+			olapP99 := canaryQuantile(canary.samples(olapStart, timeutil.Now()), 0.99)
+			t.l.Printf("OLTP p99: %s baseline, %s with analytical queries\n", baselineP99, olapP99)
+			if len(runtimes) == 0 {
+				t.l.Printf("no analytical query completed\n")
+			} else {
+				var total, slowest time.Duration
+				for _, runtime := range runtimes {
+					total += runtime
+					if runtime > slowest {
+						slowest = runtime
+					}
+				}
+				t.l.Printf("analytical queries: %d completed, mean runtime %s, max %s\n",
+					len(runtimes), total/time.Duration(len(runtimes)), slowest)
+			}
+
+			bound := maxP99Ratio * baselineP99
+			if bound < minP99Bound {
+				bound = minP99Bound
+			}
+			if olapP99 > bound {
+				t.Fatalf("OLTP p99 rose from %s to %s (bound %s) under analytical load",
+					baselineP99, olapP99, bound)
+			}
+		},
+	})
+}
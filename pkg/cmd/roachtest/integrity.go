@@ -0,0 +1,202 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	gosql "database/sql"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/pkg/errors"
+)
+
+// The seeded data lives in seededDataTable. The number of rows written for a
+// seed is recorded in seededMetaTable once all of them have been written.
+const (
+	seededDataTable = "integrity.data"
+	seededMetaTable = "integrity.meta"
+)
+
+// seededValue returns the value of key k in the data written for seed.
+func seededValue(seed int64, k int) []byte {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(seed))
+	binary.BigEndian.PutUint64(buf[8:], uint64(k))
+	sum := sha256.Sum256(buf[:])
+	return sum[:]
+}
+
+// writeSeededData writes rows deterministic rows, derived from seed, into
+// seededDataTable. Batches which fail, e.g. because the gateway was killed,
+// are retried through the next of the given connections until they succeed.
+func writeSeededData(ctx context.Context, dbs []*gosql.DB, seed int64, rows int) error {
+	for _, stmt := range []string{
+		`CREATE DATABASE IF NOT EXISTS integrity`,
+		`CREATE TABLE IF NOT EXISTS ` + seededDataTable + ` (seed INT, k INT, v BYTES, PRIMARY KEY (seed, k))`,
+		`CREATE TABLE IF NOT EXISTS ` + seededMetaTable + ` (seed INT PRIMARY KEY, rows INT)`,
+	} {
+		if _, err := dbs[0].ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	next := 0
+	exec := func(stmt string, args ...interface{}) error {
+		var err error
+		for r := retry.StartWithCtx(ctx, retry.Options{MaxBackoff: time.Second}); r.Next(); {
+			if _, err = dbs[next%len(dbs)].ExecContext(ctx, stmt, args...); err == nil {
+				return nil
+			}
+			next++
+		}
+		return errors.Wrap(err, "giving up")
+	}
+
+	const batchSize = 100
+	for start := 0; start < rows; start += batchSize {
+		var buf strings.Builder
+		buf.WriteString(`UPSERT INTO ` + seededDataTable + ` VALUES `)
+		var args []interface{}
+		for k := start; k < start+batchSize && k < rows; k++ {
+			if k > start {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(&buf, "($%d, $%d, $%d)", len(args)+1, len(args)+2, len(args)+3)
+			args = append(args, seed, k, seededValue(seed, k))
+		}
+		if err := exec(buf.String(), args...); err != nil {
+			return err
+		}
+	}
+	return exec(`UPSERT INTO `+seededMetaTable+` VALUES ($1, $2)`, seed, rows)
+}
+
+// verifyChecksums reads back the data written by writeSeededData for seed and
+// checks that every row is present and holds the value derived from the seed.
+// Unlike the consistency checker, which compares replicas with each other,
+// this catches corruption anywhere along the write and read paths.
+func verifyChecksums(ctx context.Context, db *gosql.DB, seed int64) error {
+	var expected int
+	if err := db.QueryRowContext(ctx,
+		`SELECT rows FROM `+seededMetaTable+` WHERE seed = $1`, seed,
+	).Scan(&expected); err != nil {
+		return errors.Wrapf(err, "looking up the number of rows written for seed %d", seed)
+	}
+	rows, err := db.QueryContext(ctx,
+		`SELECT k, v FROM `+seededDataTable+` WHERE seed = $1 ORDER BY k`, seed)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	next := 0
+	for rows.Next() {
+		var k int
+		var v []byte
+		if err := rows.Scan(&k, &v); err != nil {
+			return err
+		}
+		if k != next {
+			return errors.Errorf("seed %d: row %d missing", seed, next)
+		}
+		if exp := seededValue(seed, k); !bytes.Equal(v, exp) {
+			return errors.Errorf("seed %d: row %d holds %x, expected %x", seed, k, v, exp)
+		}
+		next++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if next != expected {
+		return errors.Errorf("seed %d: found %d rows, expected %d", seed, next, expected)
+	}
+	return nil
+}
+
+func registerKVChecksums(r *registry) {
+	// This test writes deterministic data while nodes are being killed and
+	// restarted, then reads everything back and compares it with the values
+	// derived from the seed. The seed is logged so that the expected data can
+	// be reproduced when investigating a failure.
+	r.Add(testSpec{
+		Name:       "kv/checksums/chaos/nodes=3",
+		Cluster:    makeClusterSpec(3),
+		MinVersion: "v2.1.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			c.Put(ctx, cockroach, "./cockroach", c.All())
+			c.Start(ctx, t, c.All())
+			c.WaitForSQLReady(ctx, 1, time.Minute)
+			dumpKVTopology(ctx, t, c)
+
+			var dbs []*gosql.DB
+			for i := 1; i <= c.nodes; i++ {
+				db := c.Conn(ctx, i)
+				defer db.Close()
+				dbs = append(dbs, db)
+			}
+
+			_, seed := randutil.NewPseudoRand()
+			t.l.Printf("writing data for seed %d\n", seed)
+			rows := 200000
+			if local {
+				rows = 1000
+			}
+
+			m := newMonitor(ctx, c)
+			done := make(chan time.Time)
+			ch := Chaos{
+				Timer:   Periodic{Period: 30 * time.Second, DownTime: 10 * time.Second},
+				Target:  c.All().randNode,
+				Stopper: done,
+				// Keep the state before the last kill around for debugging
+				// checksum mismatches.
+				Checkpoint: c.All(),
+			}
+			m.Go(ch.Runner(c, m))
+			m.Go(func(ctx context.Context) error {
+				defer close(done)
+				t.WorkerStatus("writing")
+				defer t.WorkerStatus()
+				return writeSeededData(ctx, dbs, seed, rows)
+			})
+			m.Wait()
+
+			t.Status("verifying")
+			if err := verifyChecksums(ctx, dbs[0], seed); err != nil {
+				// Replay the writes from the state before the last chaos event,
+				// without chaos, to tell whether that event caused the mismatch.
+				t.Status("replaying from the checkpoint")
+				if restoreErr := c.RestoreCheckpoint(ctx, c.All(), chaosCheckpoint); restoreErr != nil {
+					t.Fatalf("%s\nrestoring checkpoint %q: %v", err, chaosCheckpoint, restoreErr)
+				}
+				c.Start(ctx, t, c.All())
+				c.WaitForSQLReady(ctx, 1, time.Minute)
+				replayErr := writeSeededData(ctx, dbs, seed, rows)
+				if replayErr == nil {
+					replayErr = verifyChecksums(ctx, dbs[0], seed)
+				}
+				t.Fatalf("%s\nreplaying the writes from checkpoint %q without chaos: %v",
+					err, chaosCheckpoint, replayErr)
+			}
+		},
+	})
+}
@@ -16,43 +16,415 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	gosql "database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/server"
+	"github.com/cockroachdb/cockroach/pkg/server/serverpb"
 	"github.com/cockroachdb/cockroach/pkg/ts/tspb"
 	"github.com/cockroachdb/cockroach/pkg/util/httputil"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
 )
 
+// kvHistogramFormat is the format in which the kv workload writes its
+// histograms.
+type kvHistogramFormat int
+
+const (
+	// kvHistogramsJSON is a single JSON file with every op's incremental
+	// histograms, aggregated once per tick.
+	kvHistogramsJSON kvHistogramFormat = iota
+	// kvHistogramsHDR is a directory with an HDR histogram of every op's
+	// latencies over the whole run.
+	kvHistogramsHDR
+)
+
+// kvHistogramMaxLatency is the highest latency tracked by the histograms in
+// the kvHistogramsHDR format.
+const kvHistogramMaxLatency = 10 * time.Second
+
+// flags returns the workload flags which make it write its histograms to the
+// given directory, and a shell command which fails unless it wrote them.
+func (f kvHistogramFormat) flags(dir string) (flags, check string) {
+	switch f {
+	case kvHistogramsJSON:
+		path := dir + "/stats.json"
+		return " --histograms=" + path, "test -s " + path
+	case kvHistogramsHDR:
+		path := dir + "/hdr"
+		return fmt.Sprintf(" --histograms=%s --histograms-format=hdr --histograms-max-latency=%s",
+				path, kvHistogramMaxLatency),
+			fmt.Sprintf("ls %[1]s/*.hdr > /dev/null && for f in %[1]s/*.hdr; do test -s $f || exit 1; done", path)
+	default:
+		panic(fmt.Sprintf("unknown histogram format %d", f))
+	}
+}
+
 func registerKV(r *registry) {
-	runKV := func(ctx context.Context, t *test, c *cluster, percent int, encryption option) {
-		nodes := c.nodes - 1
+	// kvOpMix is the mix of operations the workload runs. Operations which are
+	// neither reads nor read-modify-writes are writes.
+	type kvOpMix struct {
+		readPercent int
+		// rmwPercent is the percentage of read-modify-write transactions, which
+		// read keys and update them in the same explicit transaction.
+		rmwPercent int
+	}
+	type kvOptions struct {
+		mix        kvOpMix
+		encryption bool
+		// splits is the number of ranges the kv table is pre-split into. If
+		// zero, the workload's default is used.
+		splits int
+		// replicationFactor, if non-zero, is the replication factor of the kv
+		// table. It takes effect before the workload starts.
+		replicationFactor int
+		// loadNodes is the number of nodes, at the end of the cluster, which run
+		// the workload. Each of them runs its share of the concurrency against
+		// all the cockroach nodes. Zero means one.
+		loadNodes int
+		// histograms is the format of the workload's histograms.
+		histograms kvHistogramFormat
+		// valueBytes, if non-zero, is the size of the values the workload
+		// writes. Otherwise, the workload's default applies.
+		valueBytes int
+		// gatewayNodes are the nodes the workload sends its queries to. If
+		// empty, it uses all the cockroach nodes.
+		gatewayNodes nodeListOption
+		// storesPerNode, if greater than one, is the number of stores each
+		// node is started with. The test then checks that the replicas end up
+		// spread across all the stores.
+		storesPerNode int
+		// sequential makes the workload write sequential keys, which keeps
+		// all the writes on the last range of the table. The test then checks
+		// that load-based splitting splits the hotspot. It is incompatible
+		// with splits.
+		sequential bool
+		// captureProfiles records a CPU profile of every node while the
+		// workload runs, for performance investigations.
+		captureProfiles bool
+		// disableLoadBasedSplits turns load-based splitting off before the
+		// workload starts, so that the table is only split as requested by
+		// splits, or by size.
+		disableLoadBasedSplits bool
+		// readGateways and writeGateways, if set, split the workload in two:
+		// each load node runs one invocation which only reads, through
+		// readGateways, and another one which only writes, through
+		// writeGateways, with half of the concurrency each. mix and
+		// gatewayNodes don't apply then.
+		readGateways, writeGateways nodeListOption
+		// checkConcurrency fails the test if, a minute into the workload, the
+		// cluster has fewer than 90% of the requested connections open. It
+		// only applies to workloads which keep all their connections busy.
+		checkConcurrency bool
+	}
+	runKV := func(ctx context.Context, t *test, c *cluster, opts kvOptions) {
+		loadNodes := opts.loadNodes
+		if loadNodes == 0 {
+			loadNodes = 1
+		}
+		nodes := c.nodes - loadNodes
 		c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
-		c.Put(ctx, workload, "./workload", c.Node(nodes+1))
-		c.Start(ctx, t, c.Range(1, nodes), encryption)
+		c.Put(ctx, workload, "./workload", c.Range(nodes+1, c.nodes))
+		startOpts := []option{c.Range(1, nodes), startArgs(fmt.Sprintf("--encrypt=%t", opts.encryption))}
+		if opts.storesPerNode > 1 {
+			startOpts = append(startOpts, storesPerNode(opts.storesPerNode))
+		}
+		c.Start(ctx, t, startOpts...)
+		for i := 1; i <= nodes; i++ {
+			c.WaitForSQLReady(ctx, i, time.Minute)
+		}
+		dumpKVTopology(ctx, t, c)
+		defer func() {
+			// Capture what the servers were doing, e.g. when the workload got
+			// stuck.
+			if t.Failed() {
+				c.FetchGoroutineDumps(ctx, c.Range(1, nodes))
+			}
+		}()
+		defer assertHealthyAtEnd(ctx, t, c, 1)
+
+		if opts.disableLoadBasedSplits {
+			db := c.Conn(ctx, 1)
+			defer db.Close()
+			if err := disableLoadBasedSplitting(ctx, db); err != nil {
+				t.Fatal(err)
+			}
+			t.l.Printf("disabled load-based splitting\n")
+		}
+
+		gatewayNodes := opts.gatewayNodes
+		if len(gatewayNodes) == 0 {
+			gatewayNodes = c.Range(1, nodes)
+		}
+
+		splits := kvSplitsFlag(opts.splits)
+		if loadNodes > 1 || opts.replicationFactor != 0 || opts.sequential || len(opts.readGateways) > 0 {
+			// Initialize the table once, rather than from every invocation of
+			// the workload.
+			t.Status("initializing workload")
+			c.Run(ctx, c.Node(nodes+1), "./workload init kv"+splits+" "+c.PGUrlTemplate(c.Node(1)))
+		}
+		if opts.replicationFactor != 0 {
+			t.Status("setting replication factor")
+			db := c.Conn(ctx, 1)
+			defer db.Close()
+			if err := c.SetReplicationFactor(ctx, db, "TABLE kv.kv", opts.replicationFactor); err != nil {
+				t.Fatal(err)
+			}
+			if err := waitForReplicationFactor(
+				ctx, db, "kv.kv", opts.replicationFactor, 10*time.Minute,
+			); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if opts.sequential {
+			// Only load-based splitting should split the kv table, so keep it
+			// from splitting as it grows.
+			db := c.Conn(ctx, 1)
+			defer db.Close()
+			if err := configureZone(ctx, db, "TABLE kv.kv",
+				"range_max_bytes = 10737418240, range_min_bytes = 16777216"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Each load node runs every one of the invocations of the workload.
+		type kvInvocation struct {
+			// name, if set, tells the invocation apart from the others run by
+			// the same load node.
+			name        string
+			readPercent int
+			gateways    nodeListOption
+		}
+		invocations := []kvInvocation{{readPercent: opts.mix.readPercent, gateways: gatewayNodes}}
+		if len(opts.readGateways) > 0 {
+			invocations = []kvInvocation{
+				{name: "reads", readPercent: 100, gateways: opts.readGateways},
+				{name: "writes", readPercent: 0, gateways: opts.writeGateways},
+			}
+		}
 
 		t.Status("running workload")
 		m := newMonitor(ctx, c, c.Range(1, nodes))
-		m.Go(func(ctx context.Context) error {
-			concurrency := ifLocal("", " --concurrency="+fmt.Sprint(nodes*64))
-			duration := " --duration=" + ifLocal("10s", "10m")
-			cmd := fmt.Sprintf(
-				"./workload run kv --init --read-percent=%d --splits=1000 --histograms=logs/stats.json"+
-					concurrency+duration+
-					" {pgurl:1-%d}",
-				percent, nodes)
-			c.Run(ctx, c.Node(nodes+1), cmd)
-			return nil
-		})
+		progress := make([]*workloadProgress, loadNodes*len(invocations))
+		opsPerSec := func() float64 {
+			var sum float64
+			for _, p := range progress {
+				sum += p.OpsPerSec()
+			}
+			return sum
+		}
+		recordCtx, stopRecording := context.WithCancel(ctx)
+		defer stopRecording()
+		running := int32(len(progress))
+		histogramsNodes, histogramsDirs := make([]int, len(progress)), make([]string, len(progress))
+		for i := range progress {
+			i := i
+			loadNode, inv := nodes+1+i/len(invocations), invocations[i%len(invocations)]
+			progress[i] = newWorkloadProgress(nil /* ticks */)
+			// With several load nodes, each one writes its histograms to a
+			// directory of its own so that they don't clash once the logs of all
+			// the nodes are fetched, and can be merged into one set of stats
+			// below. Likewise for the invocations sharing a load node.
+			histogramsDir := "logs"
+			if loadNodes > 1 {
+				histogramsDir = fmt.Sprintf("logs/load=%d", loadNode-nodes)
+			}
+			if inv.name != "" {
+				histogramsDir += "/" + inv.name
+			}
+			histogramsNodes[i], histogramsDirs[i] = loadNode, histogramsDir
+			m.Go(func(ctx context.Context) error {
+				defer func() {
+					if atomic.AddInt32(&running, -1) == 0 {
+						stopRecording()
+					}
+				}()
+				concurrency := ifLocal("", " --concurrency="+fmt.Sprint(nodes*64/len(progress)))
+				ctx, d, cancel := boundWorkload(ctx, t, soakOr(10*time.Minute))
+				defer cancel()
+				duration := " --duration=" + ifLocal("10s", d.String())
+				var rmw string
+				if opts.mix.rmwPercent != 0 && inv.name == "" {
+					rmw = fmt.Sprintf(" --rmw-percent=%d", opts.mix.rmwPercent)
+				}
+				var sequential string
+				if opts.sequential {
+					sequential = " --sequential"
+				}
+				var blockBytes string
+				if opts.valueBytes != 0 {
+					blockBytes = fmt.Sprintf(" --min-block-bytes=%[1]d --max-block-bytes=%[1]d",
+						opts.valueBytes)
+				}
+				histograms, checkHistograms := opts.histograms.flags(histogramsDir)
+				cmd := fmt.Sprintf(
+					"./workload run kv --init --read-percent=%d"+
+						histograms+rmw+sequential+blockBytes+splits+concurrency+duration+
+						" %s",
+					inv.readPercent, c.PGUrlTemplate(inv.gateways))
+				if err := c.RunWithProgress(ctx, c.Node(loadNode), progress[i], cmd); err != nil {
+					if ctx.Err() == context.DeadlineExceeded {
+						return errors.Wrapf(err, "workload on n%d didn't exit in time", loadNode)
+					}
+					return err
+				}
+				if err := c.RunE(ctx, c.Node(loadNode), checkHistograms); err != nil {
+					return errors.Wrapf(err, "workload on n%d wrote no histograms", loadNode)
+				}
+				return nil
+			})
+		}
+		var recorder *metricRecorder
+		if soakDuration > 0 {
+			// Record the time series a soak needs to spot gradual degradation.
+			recorder = newMetricRecorder(c, c.Range(1, nodes), time.Minute,
+				"sql.query.count", "sql.service.latency-p99", "sys.rss", goroutinesMetric)
+			m.Go(func(context.Context) error {
+				return recorder.run(recordCtx, "metrics.csv")
+			})
+		}
+		m.AbortIfStalled(opsPerSec, 1 /* threshold */, 2*time.Minute)
+		if opts.captureProfiles {
+			m.Go(func(ctx context.Context) error {
+				// Skip the workload's ramp up, and stop well before it ends.
+				delay, duration := time.Minute, 2*time.Minute
+				if local {
+					delay, duration = 2*time.Second, 5*time.Second
+				}
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(delay):
+				}
+				t.WorkerStatus("recording cpu profiles")
+				defer t.WorkerStatus()
+				c.FetchCPUProfiles(ctx, c.Range(1, nodes), "kv", duration)
+				return nil
+			})
+		}
+		if opts.sequential && !local {
+			m.Go(func(ctx context.Context) error {
+				db, err := c.ConnE(ctx, 1)
+				if err != nil {
+					return err
+				}
+				defer db.Close()
+				return waitForLoadBasedSplit(ctx, db, "kv.kv", 5*time.Minute)
+			})
+		}
+		if opts.checkConcurrency && !local && t.IsBuildVersion("v2.2.0") {
+			m.Go(func(ctx context.Context) error {
+				// Give the workload time to open its connections, then verify that
+				// the cluster is actually serving the requested concurrency.
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(time.Minute):
+				}
+				s, err := getSQLConcurrency(ctx, c, c.Range(1, nodes))
+				if err != nil {
+					return err
+				}
+				t.l.Printf("achieved SQL concurrency: %s (%.1f ops/sec)\n", s, opsPerSec())
+				if requested := nodes * 64; s.Conns < requested*9/10 {
+					return errors.Errorf("achieved %s, but requested concurrency is %d", s, requested)
+				}
+				return nil
+			})
+		}
 		m.Wait()
+
+		if len(progress) > 1 && opts.histograms == kvHistogramsJSON {
+			t.Status("merging histograms")
+			if err := mergeKVHistograms(ctx, c, histogramsNodes, histogramsDirs); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if recorder != nil {
+			report, err := detectDegradation(recorder.samples())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.l.Printf("trends over the soak:\n%s", report)
+			if len(report.Degraded) > 0 {
+				t.Fatalf("cluster degraded over the soak:\n%s", report)
+			}
+		}
+
+		if opts.storesPerNode > 1 {
+			t.Status("checking the distribution of replicas across stores")
+			db := c.Conn(ctx, 1)
+			defer db.Close()
+			if err := waitForReplicasOnAllStores(ctx, db, nodes*opts.storesPerNode, 5*time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Smoke check that the admin UI still works after the workload.
+		if err := c.CheckAdminUIPages(ctx, 1, adminUIPages); err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	for _, p := range []int{0, 95} {
 		p := p
+		for _, n := range []int{1, 3} {
+			for _, cpus := range []int{4, 8, 16} {
+				for _, e := range []bool{false, true} {
+					e := e
+					minVersion := "v2.0.0"
+					if e {
+						minVersion = "v2.1.0"
+					}
+					name := fmt.Sprintf("kv%d/encrypt=%t/nodes=%d", p, e, n)
+					// The 8 cpu variants predate the others, and keep their names so
+					// that their history is preserved.
+					if cpus != 8 {
+						name += fmt.Sprintf("/cpu=%d", cpus)
+					}
+					r.Add(testSpec{
+						Name:       name,
+						MinVersion: minVersion,
+						Cluster:    makeClusterSpec(n+1, cpu(cpus)),
+						Run: func(ctx context.Context, t *test, c *cluster) {
+							runKV(ctx, t, c, kvOptions{
+								mix: kvOpMix{readPercent: p}, encryption: e, splits: 1000,
+								checkConcurrency: true,
+							})
+						},
+					})
+				}
+			}
+		}
+	}
+
+	// The read-modify-write variants contend on the keys they update, as every
+	// transaction reads its keys before writing them.
+	for _, mix := range []kvOpMix{
+		{readPercent: 0, rmwPercent: 50},
+		{readPercent: 50, rmwPercent: 50},
+	} {
+		mix := mix
 		for _, n := range []int{1, 3} {
 			for _, e := range []bool{false, true} {
 				e := e
@@ -61,16 +433,409 @@ func registerKV(r *registry) {
 					minVersion = "v2.1.0"
 				}
 				r.Add(testSpec{
-					Name:       fmt.Sprintf("kv%d/encrypt=%t/nodes=%d", p, e, n),
+					Name: fmt.Sprintf("kvrmw%d/read=%d/encrypt=%t/nodes=%d",
+						mix.rmwPercent, mix.readPercent, e, n),
 					MinVersion: minVersion,
 					Cluster:    makeClusterSpec(n+1, cpu(8)),
 					Run: func(ctx context.Context, t *test, c *cluster) {
-						runKV(ctx, t, c, p, startArgs(fmt.Sprintf("--encrypt=%t", e)))
+						runKV(ctx, t, c, kvOptions{mix: mix, encryption: e, splits: 1000})
 					},
 				})
 			}
 		}
 	}
+
+	// The pre-split variants show how the number of ranges, rather than the
+	// load, affects the cluster. splits=0 leaves the table to split on its own.
+	for _, p := range []int{0, 95} {
+		p := p
+		for _, splits := range []int{0, 10000} {
+			splits := splits
+			r.Add(testSpec{
+				Name:       fmt.Sprintf("kv%d/splits=%d/nodes=3", p, splits),
+				MinVersion: "v2.0.0",
+				Cluster:    makeClusterSpec(4, cpu(8)),
+				Run: func(ctx context.Context, t *test, c *cluster) {
+					runKV(ctx, t, c, kvOptions{mix: kvOpMix{readPercent: p}, splits: splits})
+				},
+			})
+		}
+	}
+
+	// A single load node can't generate enough load to saturate a larger
+	// cluster, so spread the workload across several.
+	for _, p := range []int{0, 95} {
+		p := p
+		r.Add(testSpec{
+			Name:       fmt.Sprintf("kv%d/loadnodes=2/nodes=6", p),
+			MinVersion: "v2.0.0",
+			Cluster:    makeClusterSpec(8, cpu(8)),
+			Run: func(ctx context.Context, t *test, c *cluster) {
+				runKV(ctx, t, c, kvOptions{
+					mix: kvOpMix{readPercent: p}, splits: 1000, loadNodes: 2,
+				})
+			},
+		})
+	}
+
+	// Sending all the load through a single gateway makes it a hotspot, even
+	// though the leases are spread out.
+	r.Add(testSpec{
+		Name:       "kv0/gateway=single/nodes=3",
+		MinVersion: "v2.0.0",
+		Cluster:    makeClusterSpec(4, cpu(8)),
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			runKV(ctx, t, c, kvOptions{
+				mix: kvOpMix{readPercent: 0}, splits: 1000, gatewayNodes: nodeListOption{1},
+			})
+		},
+	})
+
+	// Large values amplify the cost of writes throughout the storage layer,
+	// which the default, small values hardly exercise.
+	for _, size := range []int{64, 1024, 65536} {
+		size := size
+		r.Add(testSpec{
+			Name:       fmt.Sprintf("kv0/size=%d/nodes=3", size),
+			MinVersion: "v2.0.0",
+			Cluster:    makeClusterSpec(4, cpu(8)),
+			Run: func(ctx context.Context, t *test, c *cluster) {
+				runKV(ctx, t, c, kvOptions{
+					mix: kvOpMix{readPercent: 0}, splits: 1000, valueBytes: size,
+				})
+			},
+		})
+	}
+
+	// The same workload as kv0/encrypt=false/nodes=3, but with the nodes spread
+	// across three regions, which shows the cost of replicating writes over
+	// long distances. The nodes' localities are derived from their zones when
+	// they are started.
+	r.Add(testSpec{
+		Name:       "kv0/geo/nodes=3",
+		MinVersion: "v2.0.0",
+		Cluster: makeClusterSpec(4, cpu(8), geo(),
+			zones("us-east1-b,us-west1-b,europe-west2-b")),
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			runKV(ctx, t, c, kvOptions{mix: kvOpMix{readPercent: 0}, splits: 1000})
+		},
+	})
+
+	// Multiple stores per node exercise the rebalancing of replicas between
+	// the stores of a node, as well as across nodes.
+	r.Add(testSpec{
+		Name:       "kv0/stores=2/nodes=3",
+		MinVersion: "v2.0.0",
+		Cluster:    makeClusterSpec(4, cpu(8)),
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			runKV(ctx, t, c, kvOptions{
+				mix: kvOpMix{readPercent: 0}, splits: 1000, storesPerNode: 2,
+			})
+		},
+	})
+
+	// Writing sequential keys makes the last range of the table a hotspot,
+	// which only load-based splitting can spread out.
+	r.Add(testSpec{
+		Name:       "kv0/sequential/nodes=3",
+		MinVersion: "v2.2.0",
+		Cluster:    makeClusterSpec(4, cpu(8)),
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			runKV(ctx, t, c, kvOptions{mix: kvOpMix{readPercent: 0}, sequential: true})
+		},
+	})
+
+	// Without load-based splitting, the kv table is only split by the
+	// workload's manual splits, which isolates their effect.
+	r.Add(testSpec{
+		Name:       "kv0/lbsplit=off/nodes=3",
+		MinVersion: "v2.2.0",
+		Cluster:    makeClusterSpec(4, cpu(8)),
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			runKV(ctx, t, c, kvOptions{
+				mix: kvOpMix{readPercent: 0}, splits: 1000, disableLoadBasedSplits: true,
+			})
+		},
+	})
+
+	// Reads and writes go through disjoint sets of gateways, which shows how
+	// much each of them interferes with the other one.
+	r.Add(testSpec{
+		Name:       "kv/rwsplit/nodes=4",
+		MinVersion: "v2.0.0",
+		Cluster:    makeClusterSpec(5, cpu(8)),
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			runKV(ctx, t, c, kvOptions{
+				splits: 1000, readGateways: c.Range(1, 2), writeGateways: c.Node(3),
+			})
+		},
+	})
+
+	// The same workload as kv95/encrypt=false/nodes=3, but exporting HDR
+	// histograms of every op for ingestion elsewhere.
+	r.Add(testSpec{
+		Name:       "kv95/histograms=hdr/nodes=3",
+		MinVersion: "v2.0.0",
+		Cluster:    makeClusterSpec(4, cpu(8)),
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			runKV(ctx, t, c, kvOptions{
+				mix: kvOpMix{readPercent: 95}, splits: 1000, histograms: kvHistogramsHDR,
+			})
+		},
+	})
+
+	// Without replication, every write commits on a single node and losing
+	// a node means losing its data.
+	for _, n := range []int{1, 3} {
+		r.Add(testSpec{
+			Name:       fmt.Sprintf("kv0/rf=1/nodes=%d", n),
+			MinVersion: "v2.1.0",
+			Cluster:    makeClusterSpec(n+1, cpu(8)),
+			Run: func(ctx context.Context, t *test, c *cluster) {
+				runKV(ctx, t, c, kvOptions{
+					mix: kvOpMix{readPercent: 0}, splits: 1000, replicationFactor: 1,
+				})
+			},
+		})
+	}
+}
+
+// kvSplitsFlag returns the flag which makes the kv workload pre-split its
+// table into the given number of ranges, or nothing if splits is zero, in
+// which case the workload's default applies. Local runs use few splits.
+func kvSplitsFlag(splits int) string {
+	if splits == 0 {
+		return ""
+	}
+	return " --splits=" + ifLocal("100", fmt.Sprint(splits))
+}
+
+// kvTeardownMargin is the time a kv test keeps, out of its timeout, for the
+// checks that follow its workload and for the workload to wind down.
+const kvTeardownMargin = 5 * time.Minute
+
+// boundWorkload caps d, the duration for which a kv test would like to run its
+// workload, such that the workload ends kvTeardownMargin before the test times
+// out, given that it starts now. It returns the capped duration along with a
+// context which expires once the workload should have exited, so that a
+// workload stuck on a hung server fails the test with a clear error rather
+// than running into the test's timeout. If the test has no deadline, d and ctx
+// are returned as is.
+func boundWorkload(
+	ctx context.Context, t *test, d time.Duration,
+) (context.Context, time.Duration, func()) {
+	deadline, ok := t.Deadline()
+	if !ok {
+		return ctx, d, func() {}
+	}
+	deadline = deadline.Add(-kvTeardownMargin)
+	if left := deadline.Sub(timeutil.Now()) - time.Minute; left < d {
+		if left <= 0 {
+			left = time.Second
+		}
+		t.l.Printf("capping the workload's duration of %s to %s to end before the test's timeout\n",
+			d, left)
+		d = left
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	return ctx, d, cancel
+}
+
+// waitForLoadBasedSplit waits until table, which starts out as a single range
+// that is kept from splitting by size, has been split by load-based splitting,
+// and fails if that doesn't happen within timeout.
+func waitForLoadBasedSplit(
+	ctx context.Context, db *gosql.DB, table string, timeout time.Duration,
+) error {
+	for start := timeutil.Now(); ; {
+		ranges, err := tableRangeCount(ctx, db, table)
+		if err != nil {
+			return err
+		}
+		if ranges > 1 {
+			return nil
+		}
+		if timeutil.Since(start) > timeout {
+			return errors.Errorf("%s wasn't split by load after %s", table, timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// waitForReplicasOnAllStores waits until each of the expected number of
+// stores holds at least half of its fair share of the replicas, as
+// reported by crdb_internal.kv_store_status, and fails after timeout.
+func waitForReplicasOnAllStores(
+	ctx context.Context, db *gosql.DB, stores int, timeout time.Duration,
+) error {
+	rangeCounts := func() (counts map[string]int, total int, _ error) {
+		rows, err := db.QueryContext(ctx,
+			`SELECT node_id, store_id, range_count FROM crdb_internal.kv_store_status`)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer rows.Close()
+		counts = make(map[string]int)
+		for rows.Next() {
+			var nodeID, storeID, rangeCount int
+			if err := rows.Scan(&nodeID, &storeID, &rangeCount); err != nil {
+				return nil, 0, err
+			}
+			counts[fmt.Sprintf("n%d/s%d", nodeID, storeID)] = rangeCount
+			total += rangeCount
+		}
+		return counts, total, rows.Err()
+	}
+
+	var counts map[string]int
+	for start := timeutil.Now(); ; {
+		var total int
+		var err error
+		if counts, total, err = rangeCounts(); err != nil {
+			return err
+		}
+		if len(counts) != stores {
+			return errors.Errorf("expected %d stores, found %d: %v", stores, len(counts), counts)
+		}
+		balanced := true
+		for _, count := range counts {
+			if count < total/stores/2 {
+				balanced = false
+			}
+		}
+		if balanced {
+			return nil
+		}
+		if timeutil.Since(start) > timeout {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Second):
+		}
+	}
+	return errors.Errorf("replicas weren't spread across the stores after %s: %v", timeout, counts)
+}
+
+// mergeKVHistograms merges the stats.json files which the kv workload wrote to
+// the given directories of the given load nodes into a single stats.json in
+// the logs of the first of them, where a run on a single load node leaves it.
+func mergeKVHistograms(ctx context.Context, c *cluster, loadNodes []int, dirs []string) error {
+	runs := make([]io.Reader, len(dirs))
+	for i, dir := range dirs {
+		out, err := c.RunWithBuffer(ctx, c.l, c.Node(loadNodes[i]), "cat "+dir+"/stats.json")
+		if err != nil {
+			return errors.Wrapf(err, "fetching the histograms of n%d", loadNodes[i])
+		}
+		runs[i] = bytes.NewReader(out)
+	}
+	var buf bytes.Buffer
+	if err := mergeHistograms(&buf, runs...); err != nil {
+		return err
+	}
+	c.PutString(ctx, buf.String(), "logs/stats.json", 0644, c.Node(loadNodes[0]))
+	return nil
+}
+
+// assertHealthyAtEnd fails the test if, according to the stores' metrics as
+// reported through the given node, any ranges are unavailable or
+// under-replicated. It is meant to be deferred by tests which leave the
+// cluster running, so that they don't silently leave it in a bad state. The
+// metrics lag behind the replicate queue, so the ranges get a minute to catch
+// up. Tests which already failed aren't checked.
+func assertHealthyAtEnd(ctx context.Context, t *test, c *cluster, node int) {
+	if t.Failed() || ctx.Err() != nil {
+		return
+	}
+	db := c.ConnWithTimeout(ctx, node, time.Minute)
+	defer db.Close()
+
+	const timeout = time.Minute
+	var unavailable, underReplicated int
+	for start := timeutil.Now(); ; {
+		if err := db.QueryRowContext(ctx, `
+SELECT sum((metrics->>'ranges.unavailable')::DECIMAL)::INT,
+       sum((metrics->>'ranges.underreplicated')::DECIMAL)::INT
+FROM crdb_internal.kv_store_status`,
+		).Scan(&unavailable, &underReplicated); err != nil {
+			t.Fatal(errors.Wrap(err, "checking the health of the cluster"))
+		}
+		if unavailable == 0 && underReplicated == 0 {
+			return
+		}
+		if timeutil.Since(start) > timeout {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+	t.Fatalf("cluster unhealthy at the end of the test: %d unavailable, %d under-replicated ranges",
+		unavailable, underReplicated)
+}
+
+// warmup runs the kv workload on the given node at low concurrency for the
+// given duration, discarding its results, so that a subsequent measured run
+// doesn't include the cost of cold caches and of splitting the kv table.
+// target is the pgurl template of the gateways (see PGUrlTemplate), as for the
+// measured run. The warm-up uses a seed which differs from the default so that
+// the measured run doesn't just step into its footsteps. warmup returns once
+// the number of ranges has stopped changing, i.e. once the splits set off by
+// the warm-up have settled; node 1 must be up for that.
+func warmup(ctx context.Context, c *cluster, node int, duration time.Duration, target string) error {
+	cmd := fmt.Sprintf(
+		"./workload run kv --read-percent=0 --seed=0 --concurrency=%s --duration=%s %s",
+		ifLocal("2", "8"), duration, target)
+	if err := c.RunE(ctx, c.Node(node), cmd); err != nil {
+		return errors.Wrap(err, "warming up")
+	}
+
+	db, err := c.ConnE(ctx, 1)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	const timeout = 5 * time.Minute
+	prev := -1
+	for start := timeutil.Now(); timeutil.Since(start) < timeout; {
+		var ranges int
+		if err := db.QueryRowContext(ctx,
+			`SELECT count(*) FROM crdb_internal.ranges`,
+		).Scan(&ranges); err != nil {
+			return err
+		}
+		if ranges == prev {
+			return nil
+		}
+		prev = ranges
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Second):
+		}
+	}
+	return errors.Errorf("number of ranges still changing %s after warming up", timeout)
+}
+
+// dumpKVTopology writes the topology of the cluster to the test's artifacts as
+// it looks before the workload starts. Failing to do so is logged but doesn't
+// fail the test.
+func dumpKVTopology(ctx context.Context, t *test, c *cluster) {
+	db, err := c.ConnE(ctx, 1)
+	if err == nil {
+		err = c.DumpTopology(ctx, db, "topology.json")
+		db.Close()
+	}
+	if err != nil {
+		t.l.Printf("failed to dump topology: %s\n", err)
+	}
 }
 
 func registerKVQuiescenceDead(r *registry) {
@@ -83,6 +848,10 @@ func registerKVQuiescenceDead(r *registry) {
 			c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
 			c.Put(ctx, workload, "./workload", c.Node(nodes+1))
 			c.Start(ctx, t, c.Range(1, nodes))
+			for i := 1; i <= nodes; i++ {
+				c.WaitForSQLReady(ctx, i, time.Minute)
+			}
+			dumpKVTopology(ctx, t, c)
 
 			run := func(cmd string, lastDown bool) {
 				n := nodes
@@ -98,51 +867,70 @@ func registerKVQuiescenceDead(r *registry) {
 				m.Wait()
 			}
 
-			db := c.Conn(ctx, 1)
+			db := c.ConnWithTimeout(ctx, 1, time.Minute)
 			defer db.Close()
 
 			waitForFullReplication(t, db)
 
-			qps := func(f func()) float64 {
+			// The nodes which stay up throughout. Their raft ticks reveal whether
+			// the ranges quiesce.
+			liveNodes := c.Range(1, nodes-1)
 
-				numInserts := func() float64 {
-					var v float64
-					if err := db.QueryRowContext(
-						ctx, `SELECT value FROM crdb_internal.node_metrics WHERE name = 'sql.insert.count'`,
-					).Scan(&v); err != nil {
+			// measure runs f and returns the rates of inserts and of raft ticks
+			// on the live nodes while it ran.
+			measure := func(f func()) (qps, ticksPerSec float64) {
+				qps, err := measureRate(ctx, c, 1, "sql.insert.count", func() {
+					var err error
+					ticksPerSec, err = measureRateOf(func() (float64, error) {
+						return sumNodeMetric(ctx, c, liveNodes, "raft.ticks")
+					}, timeutil.Now, f)
+					if err != nil {
 						t.Fatal(err)
 					}
-					return v
+				})
+				if err != nil {
+					t.Fatal(err)
 				}
-
-				tBegin := timeutil.Now()
-				before := numInserts()
-				f()
-				after := numInserts()
-				return (after - before) / timeutil.Since(tBegin).Seconds()
+				return qps, ticksPerSec
 			}
 
 			const kv = "./workload run kv --duration=10m --read-percent=0"
 
 			// Initialize the database with ~10k ranges so that the absence of
 			// quiescence hits hard once a node goes down.
-			run("./workload run kv --init --max-ops=1 --splits 10000 --concurrency 100 {pgurl:1}", false)
-			run(kv+" --seed 0 {pgurl:1}", true) // warm-up
+			run("./workload run kv --init --max-ops=1 --splits 10000 --concurrency 100 "+c.PGUrlTemplate(c.Node(1)), false)
+			if err := warmup(ctx, c, nodes+1, 10*time.Minute, c.PGUrlTemplate(c.Node(1))); err != nil {
+				t.Fatal(err)
+			}
 			// Measure qps with all nodes up (i.e. with quiescence).
-			qpsAllUp := qps(func() {
-				run(kv+" --seed 1 {pgurl:1}", true)
+			qpsAllUp, ticksAllUp := measure(func() {
+				run(kv+" --seed 1 "+c.PGUrlTemplate(c.Node(1)), true)
 			})
 			// Gracefully shut down third node (doesn't matter whether it's graceful or not).
-			c.Run(ctx, c.Node(nodes), "./cockroach quit --insecure --host=:{pgport:3}")
-			c.Stop(ctx, c.Node(nodes))
+			drainAndStop(ctx, c, nodes)
+			if err := assertLiveNodes(ctx, db, nodes-1); err != nil {
+				t.Fatal(err)
+			}
 			// Measure qps with node down (i.e. without quiescence).
-			qpsOneDown := qps(func() {
+			qpsOneDown, ticksOneDown := measure(func() {
 				// Use a different seed to make sure it's not just stepping into the
 				// other earlier kv invocation's footsteps.
-				run(kv+" --seed 2 {pgurl:1}", true)
+				run(kv+" --seed 2 "+c.PGUrlTemplate(c.Node(1)), true)
 			})
+			t.l.Printf("raft ticks went from %.2f/s to %.2f/s with one node down\n",
+				ticksAllUp, ticksOneDown)
 
-			if minFrac, actFrac := 0.8, qpsOneDown/qpsAllUp; actFrac < minFrac {
+			// Ranges which fail to quiesce keep ticking, which is what costs
+			// throughput. Check for that directly, so that a failure points at
+			// quiescence rather than at general slowness.
+			if maxFactor, actFactor := 2.0, ticksOneDown/ticksAllUp; actFactor > maxFactor {
+				t.Fatalf(
+					"raft ticks went from %.2f/s to %.2f/s (factor of %.2f, max allowed %.2f); "+
+						"are ranges with a dead replica failing to quiesce?",
+					ticksAllUp, ticksOneDown, actFactor, maxFactor,
+				)
+			}
+			if minFrac, actFrac := 0.8, qpsOneDown/qpsAllUp; actFrac < minFrac {
 				t.Fatalf(
 					"QPS dropped from %.2f to %.2f (factor of %.2f, min allowed %.2f)",
 					qpsAllUp, qpsOneDown, actFrac, minFrac,
@@ -153,6 +941,316 @@ func registerKVQuiescenceDead(r *registry) {
 	})
 }
 
+// drainAndStop gracefully drains the given node using `cockroach quit` and
+// then stops it.
+func drainAndStop(ctx context.Context, c *cluster, node int) {
+	c.Run(ctx, c.Node(node), "./cockroach quit --insecure --host=:"+c.PGPortTemplate(node))
+	c.Stop(ctx, c.Node(node))
+}
+
+// drainLeases makes node transfer away its range leases, like draining it
+// would, but without shutting it down or refusing SQL clients. It returns the
+// number of leases the node held before the drain and the number of leases it
+// successfully transferred during the drain.
+func drainLeases(
+	ctx context.Context, c *cluster, node int,
+) (held, transferred float64, _ error) {
+	before, err := readMetricsFromNode(ctx, c, node,
+		[]string{"replicas.leaseholders", "leases.transfers.success"})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	url := "http://" + c.ExternalAdminUIAddr(ctx, c.Node(node))[0] + "/_admin/v1/drain"
+	body := fmt.Sprintf(`{"on": [%d]}`, serverpb.DrainMode_LEASES)
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set(httputil.ContentTypeHeader, httputil.JSONContentType)
+	// The drain gives up on the leases it can't transfer within seconds, so a
+	// node which doesn't answer within a minute is stuck.
+	client := http.Client{Timeout: time.Minute}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "draining n%d", node)
+	}
+	// The response is streamed once the drain has completed.
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, errors.Errorf("draining n%d: %s: %s", node, resp.Status, respBody)
+	}
+
+	after, err := readMetricsFromNode(ctx, c, node, []string{"leases.transfers.success"})
+	if err != nil {
+		return 0, 0, err
+	}
+	return before["replicas.leaseholders"],
+		after["leases.transfers.success"] - before["leases.transfers.success"], nil
+}
+
+// verifyDrainTransfersLeases drains the leases of node and checks that the
+// node proactively transferred them away. Leases that aren't transferred have
+// to expire before another node can take over, which shows up as a latency
+// blip for the ranges involved.
+func verifyDrainTransfersLeases(ctx context.Context, c *cluster, node int) error {
+	held, transferred, err := drainLeases(ctx, c, node)
+	if err != nil {
+		return err
+	}
+	c.l.Printf("n%d held %.0f leases and transferred %.0f of them when draining\n",
+		node, held, transferred)
+	if held > 0 && transferred == 0 {
+		return errors.Errorf("n%d didn't transfer any of its %.0f leases when draining", node, held)
+	}
+	return nil
+}
+
+// waitForLeasesDrained waits until the given node, which must be draining its
+// leases, doesn't hold any leases anymore. It fails with the number of leases
+// the node still holds if that doesn't happen within timeout.
+func waitForLeasesDrained(ctx context.Context, c *cluster, node int, timeout time.Duration) error {
+	var leases float64
+	for start := timeutil.Now(); ; {
+		var err error
+		if leases, err = c.NodeMetric(ctx, node, "replicas.leaseholders"); err != nil {
+			return err
+		}
+		if leases == 0 {
+			return nil
+		}
+		if timeutil.Since(start) > timeout {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	return errors.Errorf("n%d still holds %.0f leases %s after draining", node, leases, timeout)
+}
+
+// rateQuery returns a timeseries query for the cluster-wide rate of the
+// counter metric with the given name: the per-second rate of the metric, summed
+// over all nodes and averaged over each sample interval.
+func rateQuery(metric string) tspb.Query {
+	return tspb.Query{
+		Name:             metric,
+		Downsampler:      tspb.TimeSeriesQueryAggregator_AVG.Enum(),
+		SourceAggregator: tspb.TimeSeriesQueryAggregator_SUM.Enum(),
+		Derivative:       tspb.TimeSeriesQueryDerivative_NON_NEGATIVE_DERIVATIVE.Enum(),
+	}
+}
+
+// gaugeQuery returns a timeseries query for the worst value of the gauge metric
+// with the given name, e.g. a latency: the highest value of the metric on any
+// node in each sample interval.
+func gaugeQuery(metric string) tspb.Query {
+	return tspb.Query{
+		Name:             metric,
+		Downsampler:      tspb.TimeSeriesQueryAggregator_MAX.Enum(),
+		SourceAggregator: tspb.TimeSeriesQueryAggregator_MAX.Enum(),
+	}
+}
+
+// queryTimeseries runs query against the timeseries exposed by the admin UI of
+// the given node, between start and end, and returns one datapoint per
+// timeseries sample interval.
+func queryTimeseries(
+	ctx context.Context, c *cluster, node int, query tspb.Query, start, end time.Time,
+) ([]tspb.TimeSeriesDatapoint, error) {
+	adminURLs := c.ExternalAdminUIAddr(ctx, c.Node(node))
+	return postTimeseriesQuery(ctx, "http://"+adminURLs[0], query, start, end)
+}
+
+// timeseriesRetryOptions are the options with which postTimeseriesQuery
+// retries queries which fail because the queried node isn't serving, e.g.
+// while it restarts or drains.
+var timeseriesRetryOptions = retry.Options{
+	InitialBackoff: time.Second,
+	MaxBackoff:     10 * time.Second,
+	Multiplier:     2,
+	MaxRetries:     5,
+}
+
+// postTimeseriesQuery is like queryTimeseries, but queries the admin UI at the
+// given URL.
+func postTimeseriesQuery(
+	ctx context.Context, adminURL string, query tspb.Query, start, end time.Time,
+) ([]tspb.TimeSeriesDatapoint, error) {
+	request := tspb.TimeSeriesQueryRequest{
+		StartNanos: start.UnixNano(),
+		EndNanos:   end.UnixNano(),
+		// Check the performance in each timeseries sample interval.
+		SampleNanos: server.DefaultMetricsSampleInterval.Nanoseconds(),
+		Queries:     []tspb.Query{query},
+	}
+	var response tspb.TimeSeriesQueryResponse
+	var err error
+	for r := retry.StartWithCtx(ctx, timeseriesRetryOptions); r.Next(); {
+		var resp *http.Response
+		resp, err = httputil.PostJSONWithRequest(http.Client{}, adminURL+"/ts/query", &request, &response)
+		if err == nil {
+			break
+		}
+		unavailable := resp != nil && resp.StatusCode == http.StatusServiceUnavailable
+		if !unavailable && !strings.Contains(err.Error(), "connection refused") {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(response.Results) != 1 {
+		return nil, errors.Errorf("expected 1 timeseries query result, found %d", len(response.Results))
+	}
+	return response.Results[0].Datapoints, nil
+}
+
+// getQPSTimeseries returns the cluster-wide SQL query rate between start and
+// end, one datapoint per timeseries sample interval, as exposed by the admin UI
+// of the given node.
+func getQPSTimeseries(
+	ctx context.Context, c *cluster, node int, start, end time.Time,
+) ([]tspb.TimeSeriesDatapoint, error) {
+	return queryTimeseries(ctx, c, node, rateQuery("cr.node.sql.query.count"), start, end)
+}
+
+// verifyQPSFloor checks, using the timeseries exposed by the admin UI of the
+// first node, that the cluster-wide SQL query rate was at least minQPS in every
+// timeseries sample interval between start and end. The first sample is
+// ignored because at that time splits may still have been happening or the
+// cluster may still have been initializing.
+func verifyQPSFloor(
+	ctx context.Context, t *test, c *cluster, start, end time.Time, minQPS float64,
+) {
+	datapoints, err := getQPSTimeseries(ctx, c, 1, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datapoints) <= 1 {
+		t.Fatalf("not enough datapoints in timeseries query response: %+v", datapoints)
+	}
+
+	for i := 1; i < len(datapoints); i++ {
+		if qps := datapoints[i].Value; qps < minQPS {
+			t.Fatalf(
+				"QPS of %.2f at time %v is below minimum allowable QPS of %.2f; entire timeseries: %+v",
+				qps, timeutil.Unix(0, datapoints[i].TimestampNanos), minQPS, datapoints)
+		}
+	}
+}
+
+// assertLatencyBelow checks, using the timeseries exposed by the admin UI of
+// the given node, that the latency metric with the given name, e.g.
+// cr.node.sql.exec.latency-p99, stayed below maxMillis on every node in every
+// timeseries sample interval between start and end. Like verifyQPSFloor, it
+// ignores the first sample.
+func assertLatencyBelow(
+	ctx context.Context,
+	t *test,
+	c *cluster,
+	node int,
+	start, end time.Time,
+	metricName string,
+	maxMillis float64,
+) {
+	datapoints, err := queryTimeseries(ctx, c, node, gaugeQuery(metricName), start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datapoints) <= 1 {
+		t.Fatalf("not enough datapoints in timeseries query response: %+v", datapoints)
+	}
+
+	for i := 1; i < len(datapoints); i++ {
+		latency := time.Duration(datapoints[i].Value)
+		if millis := latency.Seconds() * 1000; millis > maxMillis {
+			t.Fatalf(
+				"%s of %s at time %v is above maximum allowable latency of %.0fms; entire timeseries: %+v",
+				metricName, latency, timeutil.Unix(0, datapoints[i].TimestampNanos), maxMillis, datapoints)
+		}
+	}
+}
+
+// failoverQPSTolerance is how far below its pre-kill value the query rate can
+// be for measureFailoverLatency to consider the cluster recovered.
+const failoverQPSTolerance = 0.2
+
+// measureFailoverLatency kills killNode and returns the time it takes for the
+// cluster-wide query rate to recover to within failoverQPSTolerance of its
+// value over the minute before the kill. The load must not be sent to
+// killNode, and callers running a monitor must expect its death. The query
+// rate comes from the timeseries, so the latency is only accurate to a sample
+// interval (10s). Once QPS has recovered, db, which must not be connected to
+// killNode, is used to confirm that the cluster considers killNode dead.
+func measureFailoverLatency(
+	ctx context.Context, c *cluster, db *gosql.DB, killNode int,
+) (time.Duration, error) {
+	// Query the timeseries through a node which stays up.
+	adminNode := 1
+	if killNode == adminNode {
+		adminNode = 2
+	}
+	before, err := getQPSTimeseries(ctx, c, adminNode, timeutil.Now().Add(-time.Minute), timeutil.Now())
+	if err != nil {
+		return 0, err
+	}
+	if len(before) == 0 {
+		return 0, errors.New("no QPS datapoints before the kill")
+	}
+	var baseline float64
+	for _, d := range before {
+		baseline += d.Value
+	}
+	baseline /= float64(len(before))
+	threshold := (1 - failoverQPSTolerance) * baseline
+	live, err := liveNodeCount(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	c.l.Printf("killing n%d at %.0f qps\n", killNode, baseline)
+
+	killed := timeutil.Now()
+	c.Stop(ctx, c.Node(killNode))
+
+	const maxWait = 5 * time.Minute
+	interval := server.DefaultMetricsSampleInterval
+	for timeutil.Since(killed) < maxWait {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(interval):
+		}
+		datapoints, err := getQPSTimeseries(ctx, c, adminNode, killed, timeutil.Now())
+		if err != nil {
+			return 0, err
+		}
+		for _, d := range datapoints {
+			if d.Value < threshold {
+				continue
+			}
+			// The datapoint covers the sample interval starting at its timestamp.
+			latency := timeutil.Unix(0, d.TimestampNanos).Add(interval).Sub(killed)
+			c.l.Printf("QPS recovered to %.0f after %s\n", d.Value, latency)
+			if err := assertLiveNodes(ctx, db, live-1); err != nil {
+				return 0, err
+			}
+			return latency, nil
+		}
+	}
+	return 0, errors.Errorf("QPS did not recover to %.0f within %s of killing n%d",
+		threshold, maxWait, killNode)
+}
+
 func registerKVGracefulDraining(r *registry) {
 	r.Add(testSpec{
 		Name:    "kv/gracefuldraining/nodes=3",
@@ -162,8 +1260,12 @@ func registerKVGracefulDraining(r *registry) {
 			c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
 			c.Put(ctx, workload, "./workload", c.Node(nodes+1))
 			c.Start(ctx, t, c.Range(1, nodes))
+			for i := 1; i <= nodes; i++ {
+				c.WaitForSQLReady(ctx, i, time.Minute)
+			}
+			dumpKVTopology(ctx, t, c)
 
-			db := c.Conn(ctx, 1)
+			db := c.ConnWithTimeout(ctx, 1, time.Minute)
 			defer db.Close()
 
 			waitForFullReplication(t, db)
@@ -171,18 +1273,25 @@ func registerKVGracefulDraining(r *registry) {
 			// Initialize the database with a lot of ranges so that there are
 			// definitely a large number of leases on the node that we shut down
 			// before it starts draining.
-			splitCmd := "./workload run kv --init --max-ops=1 --splits 100 {pgurl:1}"
+			splitCmd := "./workload run kv --init --max-ops=1 --splits 100 " + c.PGUrlTemplate(c.Node(1))
 			c.Run(ctx, c.Node(nodes+1), splitCmd)
+			gateways := c.PGUrlTemplate(c.Range(1, nodes-1))
+			if err := warmup(ctx, c, nodes+1, time.Minute, gateways); err != nil {
+				t.Fatal(err)
+			}
 
 			m := newMonitor(ctx, c, c.Range(1, nodes))
 
 			// Run kv for 5 minutes, during which we can gracefully kill nodes and
-			// determine whether doing so affects the cluster-wide qps.
+			// determine whether doing so affects the cluster-wide qps and latency.
 			const expectedQPS = 1000
+			// Queries that hit a lease which wasn't transferred away have to wait
+			// for it to expire, which takes seconds.
+			const maxP99Millis = 1000
 			m.Go(func(ctx context.Context) error {
 				cmd := fmt.Sprintf(
-					"./workload run kv --duration=5m --read-percent=0 --tolerate-errors --max-rate=%d {pgurl:1-%d}",
-					expectedQPS, nodes-1)
+					"./workload run kv --duration=5m --read-percent=0 --tolerate-errors --max-rate=%d %s",
+					expectedQPS, gateways)
 				t.WorkerStatus(cmd)
 				defer t.WorkerStatus()
 				return c.RunE(ctx, c.Node(nodes+1), cmd)
@@ -197,8 +1306,13 @@ func registerKVGracefulDraining(r *registry) {
 						return nil
 					case <-time.After(1 * time.Minute):
 					}
-					c.Run(ctx, c.Node(nodes), "./cockroach quit --insecure --host=:{pgport:3}")
-					c.Stop(ctx, c.Node(nodes))
+					if err := verifyDrainTransfersLeases(ctx, c, nodes); err != nil {
+						return err
+					}
+					if err := waitForLeasesDrained(ctx, c, nodes, time.Minute); err != nil {
+						return err
+					}
+					drainAndStop(ctx, c, nodes)
 					select {
 					case <-ctx.Done():
 						return nil
@@ -215,148 +1329,1750 @@ func registerKVGracefulDraining(r *registry) {
 
 			// Check that the QPS has been at the expected max rate for the entire
 			// test duration, even as one of the nodes was being stopped and started.
-			adminURLs := c.ExternalAdminUIAddr(ctx, c.Node(1))
-			url := "http://" + adminURLs[0] + "/ts/query"
+			//
+			// Because we're specifying a --max-rate well less than what cockroach
+			// should be capable of, draining one of the three nodes should have no
+			// effect on performance at all, meaning that a fairly aggressive
+			// threshold here should be ok.
 			now := timeutil.Now()
-			request := tspb.TimeSeriesQueryRequest{
-				StartNanos: now.Add(-runDuration).UnixNano(),
-				EndNanos:   now.UnixNano(),
-				// Check the performance in each timeseries sample interval.
-				SampleNanos: server.DefaultMetricsSampleInterval.Nanoseconds(),
-				Queries: []tspb.Query{
-					{
-						Name:             "cr.node.sql.query.count",
-						Downsampler:      tspb.TimeSeriesQueryAggregator_AVG.Enum(),
-						SourceAggregator: tspb.TimeSeriesQueryAggregator_SUM.Enum(),
-						Derivative:       tspb.TimeSeriesQueryDerivative_NON_NEGATIVE_DERIVATIVE.Enum(),
-					},
-				},
+			verifyQPSFloor(ctx, t, c, now.Add(-runDuration), now, expectedQPS*0.9)
+			assertLatencyBelow(ctx, t, c, 1, now.Add(-runDuration), now,
+				"cr.node.sql.exec.latency-p99", maxP99Millis)
+
+			m.Wait()
+		},
+	})
+
+	r.Add(testSpec{
+		Name:    "kv/gracefuldraining/rolling/nodes=3",
+		Cluster: makeClusterSpec(4),
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			nodes := c.nodes - 1
+			c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
+			c.Put(ctx, workload, "./workload", c.Node(nodes+1))
+			c.Start(ctx, t, c.Range(1, nodes))
+			for i := 1; i <= nodes; i++ {
+				c.WaitForSQLReady(ctx, i, time.Minute)
 			}
-			var response tspb.TimeSeriesQueryResponse
-			if err := httputil.PostJSON(http.Client{}, url, &request, &response); err != nil {
+			dumpKVTopology(ctx, t, c)
+
+			db := c.ConnWithTimeout(ctx, 1, time.Minute)
+			defer db.Close()
+
+			waitForFullReplication(t, db)
+
+			splitCmd := "./workload run kv --init --max-ops=1 --splits 100 " + c.PGUrlTemplate(c.Node(1))
+			c.Run(ctx, c.Node(nodes+1), splitCmd)
+			gateways := c.PGUrlTemplate(c.Range(1, nodes))
+			if err := warmup(ctx, c, nodes+1, time.Minute, gateways); err != nil {
 				t.Fatal(err)
 			}
-			if len(response.Results[0].Datapoints) <= 1 {
-				t.Fatalf("not enough datapoints in timeseries query response: %+v", response)
-			}
-			datapoints := response.Results[0].Datapoints
 
-			// Because we're specifying a --max-rate well less than what cockroach
-			// should be capable of, draining one of the three nodes should have no
-			// effect on performance at all, meaning that a fairly aggressive
-			// threshold here should be ok.
-			minQPS := expectedQPS * 0.9
+			m := newMonitor(ctx, c, c.Range(1, nodes))
+
+			// Unlike the test above, every node is drained at some point, so the
+			// workload has to use all of them as gateways.
+			const downTime = time.Minute
+			const expectedQPS = 1000
+			runDuration := time.Duration(2*nodes+1) * downTime
+			m.Go(func(ctx context.Context) error {
+				cmd := fmt.Sprintf(
+					"./workload run kv --duration=%s --read-percent=0 --tolerate-errors --max-rate=%d %s",
+					runDuration+time.Minute, expectedQPS, gateways)
+				t.WorkerStatus(cmd)
+				defer t.WorkerStatus()
+				return c.RunE(ctx, c.Node(nodes+1), cmd)
+			})
 
-			// Examine every data point except the first one, because at that time
-			// splits may still have been happening or the cluster may still have
-			// been initializing.
-			for i := 1; i < len(datapoints); i++ {
-				if qps := datapoints[i].Value; qps < minQPS {
-					t.Fatalf(
-						"QPS of %.2f at time %v is below minimum allowable QPS of %.2f; entire timeseries: %+v",
-						qps, timeutil.Unix(0, datapoints[i].TimestampNanos), minQPS, datapoints)
+			start := timeutil.Now()
+			m.Go(func(ctx context.Context) error {
+				// Gracefully shut down each node in turn, let the cluster run
+				// without it for a while, then restart it before moving on to the
+				// next one. A quorum is available throughout.
+				for node := 1; node <= nodes; node++ {
+					select {
+					case <-ctx.Done():
+						return nil
+					case <-time.After(downTime):
+					}
+					t.WorkerStatus(fmt.Sprintf("draining n%d", node))
+					if err := verifyDrainTransfersLeases(ctx, c, node); err != nil {
+						return err
+					}
+					if err := waitForLeasesDrained(ctx, c, node, time.Minute); err != nil {
+						return err
+					}
+					m.ExpectDeath()
+					drainAndStop(ctx, c, node)
+					select {
+					case <-ctx.Done():
+						return nil
+					case <-time.After(downTime):
+					}
+					c.Start(ctx, t, c.Node(node))
 				}
-			}
+				return nil
+			})
+
+			time.Sleep(runDuration)
+
+			// The workers connected to the node that is down can't issue queries
+			// while it is, so the floor is relative to the share of the max rate
+			// issued through the remaining gateways. Draining a node should not
+			// cost more than that, no matter which leases it held.
+			minQPS := expectedQPS * float64(nodes-1) / float64(nodes) * 0.9
+			verifyQPSFloor(ctx, t, c, start, timeutil.Now(), minQPS)
 
 			m.Wait()
 		},
 	})
 }
 
-func registerKVSplits(r *registry) {
-	for _, item := range []struct {
-		quiesce bool
-		splits  int
-		timeout time.Duration
-	}{
-		// NB: with 500000 splits, this test sometimes fails since it's pushing
-		// far past the number of replicas per node we support, at least if the
-		// ranges start to unquiesce (which can set off a cascade due to resource
-		// exhaustion).
-		{true, 300000, 2 * time.Hour},
-		// This version of the test prevents range quiescence to trigger the
-		// badness described above more reliably for when we wish to improve
-		// the performance.
-		{false, 100000, 2 * time.Hour},
-	} {
-		item := item // for use in closure below
+// rollingRestart gracefully drains and restarts the given nodes one at a time.
+// Before moving on to the next node, it waits for the cluster to be fully
+// replicated again, so that at most one replica of any range is unavailable at
+// any time. db must be connected to a node which isn't restarted. The nodes
+// are restarted with the given start options.
+func rollingRestart(
+	ctx context.Context,
+	t *test,
+	c *cluster,
+	m *monitor,
+	db *gosql.DB,
+	nodes nodeListOption,
+	opts ...option,
+) {
+	defer t.WorkerStatus()
+	for _, node := range nodes {
+		t.WorkerStatus(fmt.Sprintf("restarting n%d", node))
+		m.ExpectDeath()
+		drainAndStop(ctx, c, node)
+		c.Start(ctx, t, append([]option{c.Node(node)}, opts...)...)
+		waitForFullReplication(t, db)
+	}
+}
+
+// measureRecovery returns how long after restarted the cluster-wide QPS, as
+// exposed by the admin UI of node 1, took to get back within the fraction
+// minFrac of its average between baselineStart and killed. Only the
+// timeseries until end are considered, so the QPS must have recovered by then.
+// The recovery time is only accurate to a sample interval (10s).
+func measureRecovery(
+	ctx context.Context, c *cluster, baselineStart, killed, restarted, end time.Time, minFrac float64,
+) (time.Duration, error) {
+	before, err := getQPSTimeseries(ctx, c, 1, baselineStart, killed)
+	if err != nil {
+		return 0, err
+	}
+	if len(before) == 0 {
+		return 0, errors.New("no QPS datapoints before the kill")
+	}
+	var baseline float64
+	for _, d := range before {
+		baseline += d.Value
+	}
+	baseline /= float64(len(before))
+	threshold := minFrac * baseline
+
+	after, err := getQPSTimeseries(ctx, c, 1, restarted, end)
+	if err != nil {
+		return 0, err
+	}
+	interval := server.DefaultMetricsSampleInterval
+	for _, d := range after {
+		if d.Value < threshold {
+			continue
+		}
+		// The datapoint covers the sample interval starting at its timestamp.
+		recovery := timeutil.Unix(0, d.TimestampNanos).Add(interval).Sub(restarted)
+		c.l.Printf("QPS recovered to %.0f, from a baseline of %.0f, after %s\n",
+			d.Value, baseline, recovery)
+		return recovery, nil
+	}
+	return 0, errors.Errorf("QPS did not recover to %.0f (%.0f%% of %.0f) within %s of the restart: %+v",
+		threshold, 100*minFrac, baseline, end.Sub(restarted), after)
+}
+
+func registerKVRecovery(r *registry) {
+	// This test measures how long the throughput of the cluster stays degraded
+	// after a node which was killed rejoins the cluster, while it catches up on
+	// the writes it missed and gets its share of the leases back. Unlike
+	// kv0/failover, which measures the transient after the kill, it's the
+	// transient after the restart which is of interest here. The load is sent
+	// to the other nodes only, so that clients don't have to reconnect.
+	//
+	// The paused variant pauses the load while the node is killed and its
+	// leases expire, so that the recovery starts from a clean state rather
+	// than from the backlog the kill left behind.
+	for _, pause := range []bool{false, true} {
+		pause := pause
+		name := "kv0/recovery/nodes=3"
+		if pause {
+			name = "kv0/recovery/paused/nodes=3"
+		}
 		r.Add(testSpec{
-			Name:    fmt.Sprintf("kv/splits/nodes=3/quiesce=%t", item.quiesce),
-			Timeout: item.timeout,
-			Cluster: makeClusterSpec(4),
+			Name:       name,
+			Cluster:    makeClusterSpec(4),
+			MinVersion: "v2.1.0",
 			Run: func(ctx context.Context, t *test, c *cluster) {
-				nodes := c.nodes - 1
-				c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
-				c.Put(ctx, workload, "./workload", c.Node(nodes+1))
-				c.Start(ctx, t, c.Range(1, nodes),
-					startArgs(
-						"--env=COCKROACH_MEMPROF_INTERVAL=1m",
-						"--env=COCKROACH_DISABLE_QUIESCENCE="+strconv.FormatBool(!item.quiesce),
-						"--args=--cache=256MiB",
-					))
-
-				t.Status("running workload")
-				m := newMonitor(ctx, c, c.Range(1, nodes))
-				m.Go(func(ctx context.Context) error {
-					concurrency := ifLocal("", " --concurrency="+fmt.Sprint(nodes*64))
-					splits := " --splits=" + ifLocal("2000", fmt.Sprint(item.splits))
-					cmd := fmt.Sprintf(
-						"./workload run kv --init --max-ops=1"+
-							concurrency+splits+
-							" {pgurl:1-%d}",
-						nodes)
-					c.Run(ctx, c.Node(nodes+1), cmd)
-					return nil
-				})
-				m.Wait()
+				runKVRecovery(ctx, t, c, pause)
 			},
 		})
 	}
 }
 
-func registerKVScalability(r *registry) {
-	runScalability := func(ctx context.Context, t *test, c *cluster, percent int) {
-		nodes := c.nodes - 1
-
-		c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
-		c.Put(ctx, workload, "./workload", c.Node(nodes+1))
-
-		const maxPerNodeConcurrency = 64
-		for i := nodes; i <= nodes*maxPerNodeConcurrency; i += nodes {
-			c.Wipe(ctx, c.Range(1, nodes))
-			c.Start(ctx, t, c.Range(1, nodes))
+func runKVRecovery(ctx context.Context, t *test, c *cluster, pause bool) {
+	nodes := c.nodes - 1
+	c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
+	c.Put(ctx, workload, "./workload", c.Node(nodes+1))
+	c.Start(ctx, t, c.Range(1, nodes))
+	dumpKVTopology(ctx, t, c)
 
-			t.Status("running workload")
-			m := newMonitor(ctx, c, c.Range(1, nodes))
-			m.Go(func(ctx context.Context) error {
-				cmd := fmt.Sprintf("./workload run kv --init --read-percent=%d "+
-					"--splits=1000 --duration=1m "+fmt.Sprintf("--concurrency=%d", i)+
-					" {pgurl:1-%d}",
-					percent, nodes)
+	db := c.Conn(ctx, 1)
+	defer db.Close()
 
-				l, err := t.l.ChildLogger(fmt.Sprint(i))
-				if err != nil {
-					t.Fatal(err)
-				}
-				defer l.close()
+	c.Run(ctx, c.Node(nodes+1), "./workload init kv --splits=100 "+c.PGUrlTemplate(c.Node(1)))
+	waitForFullReplication(t, db)
 
-				return c.RunL(ctx, l, c.Node(nodes+1), cmd)
-			})
-			m.Wait()
-		}
+	const expectedQPS = 1000
+	baselineDur, downDur, recoveryDur := 3*time.Minute, time.Minute, 5*time.Minute
+	// pauseDur is how long the load is paused for after the kill, which leaves
+	// the leases of the killed node time to expire.
+	pauseDur := 20 * time.Second
+	if local {
+		baselineDur, downDur, recoveryDur = 30*time.Second, 10*time.Second, time.Minute
+	}
+	workloadDur := baselineDur + downDur + recoveryDur
+	start := timeutil.Now()
+	m := newMonitor(ctx, c, c.Range(1, nodes))
+	cmd := fmt.Sprintf(
+		"./workload run kv --read-percent=0 --max-rate=%d --tolerate-errors %s",
+		expectedQPS, c.PGUrlTemplate(c.Range(1, nodes-1)))
+	if pause {
+		// The handle takes care of the duration, not counting the pause.
+		m.GoWorkload(c, c.Node(nodes+1), cmd, workloadDur)
+	} else {
+		m.Go(func(ctx context.Context) error {
+			cmd := cmd + " --duration=" + workloadDur.String()
+			t.WorkerStatus(cmd)
+			defer t.WorkerStatus()
+			return c.RunE(ctx, c.Node(nodes+1), cmd)
+		})
 	}
 
-	// TODO(peter): work in progress adaption of `roachprod test kv{0,95}`.
-	if false {
-		for _, p := range []int{0, 95} {
-			p := p
-			r.Add(testSpec{
-				Name:    fmt.Sprintf("kv%d/scale/nodes=6", p),
-				Cluster: makeClusterSpec(7, cpu(8)),
-				Run: func(ctx context.Context, t *test, c *cluster) {
-					runScalability(ctx, t, c, p)
-				},
-			})
+	var baselineEnd, killed, restarted time.Time
+	var paused time.Duration
+	m.Go(func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(baselineDur):
+		}
+		baselineEnd = timeutil.Now()
+		if pause {
+			t.WorkerStatus("pausing the load")
+			if err := m.PauseWorkloads(ctx); err != nil {
+				return err
+			}
+		}
+		t.WorkerStatus(fmt.Sprintf("killing n%d", nodes))
+		defer t.WorkerStatus()
+		m.ExpectDeath()
+		killed = timeutil.Now()
+		c.Stop(ctx, c.Node(nodes))
+		if pause {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(pauseDur):
+			}
+			t.WorkerStatus("resuming the load")
+			if err := m.ResumeWorkloads(ctx); err != nil {
+				return err
+			}
+			paused = timeutil.Since(baselineEnd)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(downDur):
 		}
+		t.WorkerStatus(fmt.Sprintf("restarting n%d", nodes))
+		restarted = timeutil.Now()
+		c.Start(ctx, t, c.Node(nodes))
+		return nil
+	})
+	m.Wait()
+
+	// The first third of the baseline is left for the workload to ramp up, and
+	// the last sample for it to wind down.
+	baselineStart := start.Add(baselineDur / 3)
+	end := start.Add(workloadDur + paused - 10*time.Second)
+	recovery, err := measureRecovery(ctx, c, baselineStart, baselineEnd, restarted, end, 0.95)
+	if err != nil {
+		t.Fatal(err)
 	}
+	t.l.Printf("QPS recovered %s after n%d was restarted, having been down for %s\n",
+		recovery, nodes, restarted.Sub(killed))
+}
+
+func registerKVRollingRestart(r *registry) {
+	// This test restarts every node of the cluster in turn and checks that a
+	// workload which doesn't tolerate errors doesn't see any. A node being
+	// restarted can't serve as a gateway, so the workload runs in two phases:
+	// first against n1 while the other nodes are restarted, then against n2
+	// while n1 is restarted.
+	r.Add(testSpec{
+		Name:       "kv/rollingrestart/nodes=4",
+		Cluster:    makeClusterSpec(5),
+		MinVersion: "v2.1.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			nodes := c.nodes - 1
+			loadNode := c.Node(nodes + 1)
+			c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
+			c.Put(ctx, workload, "./workload", loadNode)
+			c.Start(ctx, t, c.Range(1, nodes))
+			dumpKVTopology(ctx, t, c)
+
+			c.Run(ctx, loadNode, "./workload init kv --splits=100 "+c.PGUrlTemplate(c.Node(1)))
+
+			for _, phase := range []struct {
+				gateway int
+				restart nodeListOption
+			}{
+				{gateway: 1, restart: c.Range(2, nodes)},
+				{gateway: 2, restart: c.Node(1)},
+			} {
+				db := c.Conn(ctx, phase.gateway)
+				defer db.Close()
+				waitForFullReplication(t, db)
+
+				t.Status(fmt.Sprintf("restarting %s with load on n%d", phase.restart, phase.gateway))
+				m := newMonitor(ctx, c, c.Range(1, nodes))
+				m.Go(func(ctx context.Context) error {
+					// Without --tolerate-errors, the workload exits with an error,
+					// failing the test, as soon as any of its operations fails.
+					cmd := fmt.Sprintf(
+						"./workload run kv --read-percent=50 --concurrency=32 --max-rate=1000 %s",
+						c.PGUrlTemplate(c.Node(phase.gateway)))
+					return c.RunE(ctx, loadNode, cmd)
+				})
+				m.Go(func(ctx context.Context) error {
+					select {
+					case <-ctx.Done():
+						return nil
+					case <-time.After(30 * time.Second):
+					}
+					rollingRestart(ctx, t, c, m, db, phase.restart)
+					// Let the workload shut down cleanly, so that it exits
+					// successfully unless it ran into errors.
+					return c.RunE(ctx, loadNode, "pkill -INT -f '^./workload run'")
+				})
+				m.Wait()
+			}
+		},
+	})
+}
+
+func registerKVEncryptionRotation(r *registry) {
+	// This test starts the cluster with encryption at rest, then rotates the
+	// store key of every node, restarting the nodes one at a time, and checks
+	// that a workload which doesn't tolerate errors doesn't see any. As in
+	// kv/rollingrestart, the workload runs against a node which isn't being
+	// restarted.
+	r.Add(testSpec{
+		Name:       "kv0/encrypt/rotate/nodes=3",
+		Cluster:    makeClusterSpec(4),
+		MinVersion: "v2.1.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			nodes := c.nodes - 1
+			loadNode := c.Node(nodes + 1)
+			c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
+			c.Put(ctx, workload, "./workload", loadNode)
+
+			const oldKey, newKey = "store-1.key", "store-2.key"
+			for _, key := range []string{oldKey, newKey} {
+				c.Run(ctx, c.Range(1, nodes), fmt.Sprintf(
+					"mkdir -p {store-dir} && ./cockroach gen encryption-key -s=128 {store-dir}/%s", key))
+			}
+			c.Start(ctx, t, c.Range(1, nodes), encryptionKeys(oldKey, "plain"))
+			dumpKVTopology(ctx, t, c)
+
+			c.Run(ctx, loadNode, "./workload init kv --splits=100 "+c.PGUrlTemplate(c.Node(1)))
+
+			for _, phase := range []struct {
+				gateway int
+				rotate  nodeListOption
+			}{
+				{gateway: 1, rotate: c.Range(2, nodes)},
+				{gateway: 2, rotate: c.Node(1)},
+			} {
+				db := c.Conn(ctx, phase.gateway)
+				defer db.Close()
+				waitForFullReplication(t, db)
+
+				t.Status(fmt.Sprintf("rotating the keys of %s with load on n%d", phase.rotate, phase.gateway))
+				m := newMonitor(ctx, c, c.Range(1, nodes))
+				m.Go(func(ctx context.Context) error {
+					// The reads make sure that the data written with the old key is
+					// still readable.
+					cmd := fmt.Sprintf(
+						"./workload run kv --read-percent=50 --concurrency=32 --max-rate=1000 %s",
+						c.PGUrlTemplate(c.Node(phase.gateway)))
+					return c.RunE(ctx, loadNode, cmd)
+				})
+				m.Go(func(ctx context.Context) error {
+					select {
+					case <-ctx.Done():
+						return nil
+					case <-time.After(30 * time.Second):
+					}
+					rollingRestart(ctx, t, c, m, db, phase.rotate, encryptionKeys(newKey, oldKey))
+					return c.RunE(ctx, loadNode, "pkill -INT -f '^./workload run'")
+				})
+				m.Wait()
+			}
+
+			// Check that the stores report their encryption status.
+			for _, addr := range c.InternalAdminUIAddr(ctx, c.Range(1, nodes)) {
+				if err := c.RunE(ctx, c.Node(1), fmt.Sprintf(
+					`curl http://%s/_status/stores/local | (! grep '"encryptionStatus": null')`, addr),
+				); err != nil {
+					t.Fatalf("encryption status from %s/_status/stores/local is null", addr)
+				}
+			}
+		},
+	})
+}
+
+// watchSplitProgress polls the number of ranges in the cluster until done is
+// closed or there are target ranges, logging the rate at which ranges are
+// created. It returns an error if no range is created for stallTimeout, so
+// that a test waiting for a large number of splits fails early rather than at
+// its timeout when splits stall. The number of ranges is derived from the
+// number of replicas on the given nodes, assuming 3x replication.
+func watchSplitProgress(
+	ctx context.Context,
+	c *cluster,
+	nodes nodeListOption,
+	target int,
+	stallTimeout time.Duration,
+	done <-chan struct{},
+) error {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	var last float64
+	lastTime := timeutil.Now()
+	progressTime := lastTime
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-done:
+			return nil
+		case <-ticker.C:
+		}
+		var replicas float64
+		for _, node := range nodes {
+			m, err := readMetricsFromNode(ctx, c, node, []string{"replicas"})
+			if err != nil {
+				return err
+			}
+			replicas += m["replicas"]
+		}
+		ranges := replicas / 3
+		now := timeutil.Now()
+		c.l.Printf("%.0f of %d ranges, created at %.1f/s\n",
+			ranges, target, (ranges-last)/now.Sub(lastTime).Seconds())
+		if ranges >= float64(target) {
+			return nil
+		}
+		if ranges > last {
+			progressTime = now
+		} else if stalled := now.Sub(progressTime); stalled > stallTimeout {
+			return errors.Errorf("no range created for %s, with %.0f of %d ranges",
+				stalled, ranges, target)
+		}
+		last, lastTime = ranges, now
+	}
+}
+
+// watchRangeCountMonotonic samples the number of ranges in the cluster, as
+// counted by the given nodes, every interval until done is closed. Splits only
+// ever add ranges, so it returns an error if the count drops more than
+// tolerance below the highest count seen, which means that ranges were merged
+// back. The tolerance absorbs ranges which aren't counted by any node while
+// their leases move.
+func watchRangeCountMonotonic(
+	ctx context.Context,
+	c *cluster,
+	nodes nodeListOption,
+	interval time.Duration,
+	tolerance int,
+	done <-chan struct{},
+) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var max float64
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-done:
+			return nil
+		case <-ticker.C:
+		}
+		ranges, err := sumNodeMetric(ctx, c, nodes, "ranges")
+		if err != nil {
+			return err
+		}
+		if ranges > max {
+			max = ranges
+		} else if max-ranges > float64(tolerance) {
+			return errors.Errorf("range count dropped from %.0f to %.0f (tolerance %d); "+
+				"were ranges merged?", max, ranges, tolerance)
+		}
+	}
+}
+
+func registerKVSplits(r *registry) {
+	for _, item := range []struct {
+		quiesce bool
+		splits  int
+		timeout time.Duration
+	}{
+		// NB: with 500000 splits, this test sometimes fails since it's pushing
+		// far past the number of replicas per node we support, at least if the
+		// ranges start to unquiesce (which can set off a cascade due to resource
+		// exhaustion).
+		{true, 300000, 2 * time.Hour},
+		// This version of the test prevents range quiescence to trigger the
+		// badness described above more reliably for when we wish to improve
+		// the performance.
+		{false, 100000, 2 * time.Hour},
+	} {
+		item := item // for use in closure below
+		r.Add(testSpec{
+			Name:    fmt.Sprintf("kv/splits/nodes=3/quiesce=%t", item.quiesce),
+			Timeout: item.timeout,
+			Cluster: makeClusterSpec(4),
+			Run: func(ctx context.Context, t *test, c *cluster) {
+				nodes := c.nodes - 1
+				c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
+				c.Put(ctx, workload, "./workload", c.Node(nodes+1))
+				c.Start(ctx, t, c.Range(1, nodes),
+					env(map[string]string{
+						"COCKROACH_MEMPROF_INTERVAL":   "1m",
+						"COCKROACH_DISABLE_QUIESCENCE": strconv.FormatBool(!item.quiesce),
+					}),
+					startArgs("--args=--cache=256MiB"),
+				)
+				dumpKVTopology(ctx, t, c)
+
+				t.Status("running workload")
+				target := item.splits
+				if local {
+					target = 2000
+				}
+				m := newMonitor(ctx, c, c.Range(1, nodes))
+				workloadDone := make(chan struct{})
+				m.Go(func(ctx context.Context) error {
+					defer close(workloadDone)
+					// The splits take as long as they take, but should be done before
+					// the test times out.
+					ctx, _, cancel := boundWorkload(ctx, t, item.timeout)
+					defer cancel()
+					concurrency := ifLocal("", " --concurrency="+fmt.Sprint(nodes*64))
+					splits := " --splits=" + fmt.Sprint(target)
+					cmd := fmt.Sprintf(
+						"./workload run kv --init --max-ops=1"+
+							concurrency+splits+
+							" %s",
+						c.PGUrlTemplate(c.Range(1, nodes)))
+					if err := c.RunE(ctx, c.Node(nodes+1), cmd); err != nil {
+						if ctx.Err() == context.DeadlineExceeded {
+							return errors.Wrapf(err, "splitting into %d ranges didn't finish in time", target)
+						}
+						return err
+					}
+					return nil
+				})
+				m.Go(func(ctx context.Context) error {
+					return watchSplitProgress(ctx, c, c.Range(1, nodes), target, 5*time.Minute, workloadDone)
+				})
+				m.Go(func(ctx context.Context) error {
+					// Reaching the target eventually could hide ranges getting merged
+					// along the way, e.g. under resource pressure.
+					return watchRangeCountMonotonic(
+						ctx, c, c.Range(1, nodes), 30*time.Second, target/100, workloadDone)
+				})
+				m.Wait()
+
+				// Quantify what quiescence buys: report how much memory the nodes use
+				// for all these replicas, to compare between the two variants.
+				mem, err := getReplicaMemory(ctx, c, c.Range(1, nodes))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, nodeMem := range mem {
+					t.l.Printf("quiesce=%t: %s\n", item.quiesce, nodeMem)
+				}
+			},
+		})
+	}
+}
+
+func registerKVScalability(r *registry) {
+	// scalabilityResult summarizes the run of the workload at one of the
+	// concurrencies.
+	type scalabilityResult struct {
+		Concurrency int                `json:"concurrency"`
+		Ops         []histogramSummary `json:"ops"`
+	}
+
+	// runScalability runs the workload at each of the given total
+	// concurrencies in turn, each time against a freshly wiped cluster. The
+	// results of every level are collected in the scalability.json artifact.
+	runScalability := func(
+		ctx context.Context, t *test, c *cluster, percent, splits int, concurrencies []int,
+	) {
+		nodes := c.nodes - 1
+
+		c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
+		c.Put(ctx, workload, "./workload", c.Node(nodes+1))
+
+		var results []scalabilityResult
+		for i, concurrency := range concurrencies {
+			concurrency := concurrency
+			c.Wipe(ctx, c.Range(1, nodes))
+			c.Start(ctx, t, c.Range(1, nodes))
+			if i == 0 {
+				dumpKVTopology(ctx, t, c)
+			}
+
+			t.Status(fmt.Sprintf("running workload at concurrency %d", concurrency))
+			m := newMonitor(ctx, c, c.Range(1, nodes))
+			m.OnDeath(func(node int, err error) {
+				// Record the concurrency at which the node died, which the test
+				// failure doesn't tell.
+				msg := fmt.Sprintf("n%d died at concurrency %d: %s\n", node, concurrency, err)
+				t.l.Printf("%s", msg)
+				if err := ioutil.WriteFile(
+					filepath.Join(t.ArtifactsDir(), "dead_node.txt"), []byte(msg), 0644,
+				); err != nil {
+					t.l.Printf("recording dead node: %s\n", err)
+				}
+			})
+			histograms := fmt.Sprintf("logs/concurrency=%d/stats.json", concurrency)
+			m.Go(func(ctx context.Context) error {
+				cmd := fmt.Sprintf("./workload run kv --init --read-percent=%d"+
+					kvSplitsFlag(splits)+" --duration=1m "+fmt.Sprintf("--concurrency=%d", concurrency)+
+					" --histograms="+histograms+" %s",
+					percent, c.PGUrlTemplate(c.Range(1, nodes)))
+
+				l, err := t.l.ChildLogger(fmt.Sprint(concurrency))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer l.close()
+
+				return c.RunL(ctx, l, c.Node(nodes+1), cmd)
+			})
+			if err := m.WaitE(); err != nil {
+				t.Fatalf("concurrency %d: %s", concurrency, err)
+			}
+
+			out, err := c.RunWithBuffer(ctx, t.l, c.Node(nodes+1), "cat "+histograms)
+			if err != nil {
+				t.Fatalf("concurrency %d: %s", concurrency, err)
+			}
+			ops, err := summarizeHistograms(bytes.NewReader(out))
+			if err != nil {
+				t.Fatalf("concurrency %d: %s", concurrency, err)
+			}
+			results = append(results, scalabilityResult{Concurrency: concurrency, Ops: ops})
+			// Write the results after every level, so that they aren't lost if a
+			// later one fails.
+			data, err := json.MarshalIndent(results, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(
+				filepath.Join(t.ArtifactsDir(), "scalability.json"), data, 0644,
+			); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The concurrencies match the levels our scaling reports are plotted at.
+	scalabilityConcurrencies := []int{8, 32, 128, 512}
+
+	// TODO(peter): work in progress adaption of `roachprod test kv{0,95}`.
+	if false {
+		for _, p := range []int{0, 95} {
+			p := p
+			r.Add(testSpec{
+				Name:    fmt.Sprintf("kv%d/scale/nodes=6", p),
+				Cluster: makeClusterSpec(7, cpu(8)),
+				Run: func(ctx context.Context, t *test, c *cluster) {
+					runScalability(ctx, t, c, p, 1000 /* splits */, scalabilityConcurrencies)
+				},
+			})
+		}
+	}
+}
+
+func registerKVSchemaChange(r *registry) {
+	// This test adds a column with a default value to the kv table halfway
+	// through a write workload, and checks that the backfill of the column
+	// doesn't stall the workload.
+	r.Add(testSpec{
+		Name:       "kv0/schemachange/nodes=3",
+		MinVersion: "v2.0.0",
+		Cluster:    makeClusterSpec(4),
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			nodes := c.nodes - 1
+			c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
+			c.Put(ctx, workload, "./workload", c.Node(nodes+1))
+			c.Start(ctx, t, c.Range(1, nodes))
+			dumpKVTopology(ctx, t, c)
+
+			db := c.Conn(ctx, 1)
+			defer db.Close()
+			waitForFullReplication(t, db)
+			c.Run(ctx, c.Node(nodes+1), "./workload init kv --splits=100 "+c.PGUrlTemplate(c.Node(1)))
+
+			// The rate is well below what the cluster can sustain, so the backfill
+			// competing with the workload for resources shouldn't slow it down
+			// much.
+			const expectedQPS = 1000
+			duration := 6 * time.Minute
+			if local {
+				duration = time.Minute
+			}
+			workloadStart := timeutil.Now()
+			m := newMonitor(ctx, c, c.Range(1, nodes))
+			m.Go(func(ctx context.Context) error {
+				cmd := fmt.Sprintf(
+					"./workload run kv --duration=%s --read-percent=0 --max-rate=%d %s",
+					duration, expectedQPS, c.PGUrlTemplate(c.Range(1, nodes)))
+				t.WorkerStatus(cmd)
+				defer t.WorkerStatus()
+				return c.RunE(ctx, c.Node(nodes+1), cmd)
+			})
+
+			var changeStart, changeEnd time.Time
+			m.Go(func(ctx context.Context) error {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(duration / 2):
+				}
+				t.WorkerStatus("adding a column")
+				defer t.WorkerStatus()
+				changeStart = timeutil.Now()
+				if _, err := db.ExecContext(ctx,
+					`ALTER TABLE kv.kv ADD COLUMN extra INT NOT NULL DEFAULT 1`,
+				); err != nil {
+					return err
+				}
+				changeEnd = timeutil.Now()
+				t.l.Printf("added a column in %s\n", changeEnd.Sub(changeStart))
+				return nil
+			})
+			m.Wait()
+
+			// Check the throughput while the column was being backfilled, as well
+			// as for a little while afterwards, but not past the end of the
+			// workload.
+			end := changeEnd.Add(time.Minute)
+			if workloadEnd := workloadStart.Add(duration - 10*time.Second); end.After(workloadEnd) {
+				end = workloadEnd
+			}
+			if !end.After(changeStart) {
+				t.Fatalf("the column was added after the workload ended")
+			}
+			verifyQPSFloor(ctx, t, c, changeStart, end, expectedQPS*0.8)
+		},
+	})
+}
+
+// maxAckedKeys bounds the number of acknowledged keys an ackedWriter records
+// so that its memory usage stays reasonable.
+const maxAckedKeys = 100000
+
+// ackedWritesTable is the table written to by an ackedWriter and checked by
+// verifyAcknowledgedWrites.
+const ackedWritesTable = "kv.acked"
+
+// ackedWriter inserts random keys into ackedWritesTable from the test harness
+// and records every key whose write was acknowledged by the cluster. Writes
+// which return an error are not recorded since their outcome is unknown.
+type ackedWriter struct {
+	db *gosql.DB
+	mu struct {
+		syncutil.Mutex
+		keys [][]byte
+	}
+}
+
+func (w *ackedWriter) run(ctx context.Context) error {
+	rng := newRand()
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		w.mu.Lock()
+		n := len(w.mu.keys)
+		w.mu.Unlock()
+		if n >= maxAckedKeys {
+			return nil
+		}
+
+		key := make([]byte, 16)
+		_, _ = rng.Read(key)
+		if _, err := w.db.ExecContext(
+			ctx, `INSERT INTO `+ackedWritesTable+` (k) VALUES ($1)`, key,
+		); err != nil {
+			// Errors are expected while nodes are down. Back off a little so that
+			// we don't spin against a dead cluster.
+			select {
+			case <-ctx.Done():
+			case <-time.After(100 * time.Millisecond):
+			}
+			continue
+		}
+		w.mu.Lock()
+		w.mu.keys = append(w.mu.keys, key)
+		w.mu.Unlock()
+	}
+}
+
+func (w *ackedWriter) ackedKeys() [][]byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([][]byte(nil), w.mu.keys...)
+}
+
+// verifyAcknowledgedWrites checks that every one of the given keys, all of
+// which were acknowledged as written, is present in ackedWritesTable.
+func verifyAcknowledgedWrites(ctx context.Context, db *gosql.DB, keys [][]byte) error {
+	const batchSize = 1000
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		keys = keys[len(batch):]
+
+		rows, err := db.QueryContext(
+			ctx, `SELECT k FROM `+ackedWritesTable+` WHERE k = ANY ($1)`, pq.Array(batch),
+		)
+		if err != nil {
+			return err
+		}
+		found := make(map[string]struct{}, len(batch))
+		for rows.Next() {
+			var k []byte
+			if err := rows.Scan(&k); err != nil {
+				rows.Close()
+				return err
+			}
+			found[string(k)] = struct{}{}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		var missing [][]byte
+		for _, k := range batch {
+			if _, ok := found[string(k)]; !ok {
+				missing = append(missing, k)
+			}
+		}
+		if len(missing) > 0 {
+			return errors.Errorf("%d of %d acknowledged writes lost (e.g. %x)",
+				len(missing), len(batch), missing[0])
+		}
+	}
+	return nil
+}
+
+func registerKVAckedWrites(r *registry) {
+	r.Add(testSpec{
+		Name:       "kv/acked-writes/hard-kill/nodes=3",
+		Cluster:    makeClusterSpec(3),
+		MinVersion: "v2.1.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			c.Put(ctx, cockroach, "./cockroach", c.All())
+			c.Start(ctx, t, c.All())
+			c.WaitForSQLReady(ctx, 1, time.Minute)
+			dumpKVTopology(ctx, t, c)
+
+			db := c.Conn(ctx, 1)
+			defer db.Close()
+			for _, stmt := range []string{
+				`CREATE DATABASE IF NOT EXISTS kv`,
+				`CREATE TABLE ` + ackedWritesTable + ` (k BYTES PRIMARY KEY)`,
+			} {
+				if _, err := db.ExecContext(ctx, stmt); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			t.Status("writing")
+			w := &ackedWriter{db: db}
+			writeCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- w.run(writeCtx)
+			}()
+
+			writeDuration := time.Minute
+			if local {
+				writeDuration = 10 * time.Second
+			}
+			time.Sleep(writeDuration)
+
+			// Hard kill every node while writes are in flight, then restart them
+			// and keep writing for a bit to make sure the cluster is healthy.
+			t.Status("killing all nodes")
+			c.Stop(ctx, c.All())
+			c.Start(ctx, t, c.All())
+			c.WaitForSQLReady(ctx, 1, time.Minute)
+			time.Sleep(writeDuration / 2)
+
+			cancel()
+			if err := <-errCh; err != nil {
+				t.Fatal(err)
+			}
+
+			keys := w.ackedKeys()
+			t.Status(fmt.Sprintf("verifying %d acknowledged writes", len(keys)))
+			if len(keys) == 0 {
+				t.Fatal("no writes were acknowledged")
+			}
+			if err := verifyAcknowledgedWrites(ctx, db, keys); err != nil {
+				t.Fatal(err)
+			}
+		},
+	})
+}
+
+// txnRestartMetrics are the counters of the restarts of KV transactions, one
+// for each reason for restarting.
+var txnRestartMetrics = []string{
+	"txn.restarts.writetooold",
+	"txn.restarts.serializable",
+	"txn.restarts.possiblereplay",
+	"txn.restarts.asyncwritefailure",
+}
+
+// readTxnRestarts returns the number of committed and of restarted KV
+// transactions coordinated by the given nodes.
+func readTxnRestarts(
+	ctx context.Context, c *cluster, nodes nodeListOption,
+) (commits, restarts float64, _ error) {
+	for _, node := range nodes {
+		m, err := readMetricsFromNode(ctx, c, node, append([]string{"txn.commits"}, txnRestartMetrics...))
+		if err != nil {
+			return 0, 0, err
+		}
+		commits += m["txn.commits"]
+		for _, name := range txnRestartMetrics {
+			restarts += m[name]
+		}
+	}
+	return commits, restarts, nil
+}
+
+func registerKVContention(r *registry) {
+	// runContention runs a write-heavy workload whose writers all hit the same
+	// small set of keys, so that transactions keep conflicting with each
+	// other, unlike in the other kv tests which spread their writes over the
+	// whole keyspace. It reports the number of restarts per committed
+	// transaction and fails if it exceeds maxRestartsPerCommit, which is
+	// deliberately loose: it is meant to catch retry storms in the conflict
+	// path, not to track its performance.
+	runContention := func(ctx context.Context, t *test, c *cluster, maxRestartsPerCommit float64) {
+		nodes := c.nodes - 1
+		c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
+		c.Put(ctx, workload, "./workload", c.Node(nodes+1))
+		c.Start(ctx, t, c.Range(1, nodes))
+		c.WaitForSQLReady(ctx, 1, time.Minute)
+		dumpKVTopology(ctx, t, c)
+
+		c.Run(ctx, c.Node(nodes+1), "./workload init kv --splits=2 "+c.PGUrlTemplate(c.Node(1)))
+
+		commitsBefore, restartsBefore, err := readTxnRestarts(ctx, c, c.Range(1, nodes))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Status("running workload")
+		m := newMonitor(ctx, c, c.Range(1, nodes))
+		m.Go(func(ctx context.Context) error {
+			// Half of the operations are read-modify-write transactions, which
+			// can't be retried transparently by the server once they conflict.
+			cmd := fmt.Sprintf(
+				"./workload run kv --read-percent=0 --rmw-percent=50 --cycle-length=100"+
+					" --tolerate-errors --concurrency=%s --duration=%s %s",
+				ifLocal("16", "256"), ifLocal("30s", "10m"), c.PGUrlTemplate(c.Range(1, nodes)))
+			t.WorkerStatus(cmd)
+			defer t.WorkerStatus()
+			return c.RunE(ctx, c.Node(nodes+1), cmd)
+		})
+		m.Wait()
+
+		commitsAfter, restartsAfter, err := readTxnRestarts(ctx, c, c.Range(1, nodes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		commits, restarts := commitsAfter-commitsBefore, restartsAfter-restartsBefore
+		if commits == 0 {
+			t.Fatal("no transactions committed under contention")
+		}
+		ratio := restarts / commits
+		t.l.Printf("%.0f restarts for %.0f commits: %.2f restarts per commit\n",
+			restarts, commits, ratio)
+		if ratio > maxRestartsPerCommit {
+			t.Fatalf("%.2f restarts per commit exceeds the ceiling of %.2f",
+				ratio, maxRestartsPerCommit)
+		}
+	}
+
+	r.Add(testSpec{
+		Name:       "kv/contention/nodes=3",
+		Cluster:    makeClusterSpec(4),
+		MinVersion: "v2.2.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			runContention(ctx, t, c, 2 /* maxRestartsPerCommit */)
+		},
+	})
+}
+
+func registerKVGCChurn(r *registry) {
+	// This test runs a delete-heavy workload against a table with a short GC
+	// TTL: the workload keeps overwriting a bounded set of keys while the test
+	// continuously deletes rows, so that MVCC garbage is generated at a high
+	// rate. It then checks that the GC queue keeps pace, i.e. that the amount
+	// of garbage (as measured by gcbytesage) stays bounded instead of growing
+	// for the entire duration of the test.
+	r.Add(testSpec{
+		Name:       "kv/gc-churn/nodes=3",
+		Cluster:    makeClusterSpec(4),
+		MinVersion: "v2.1.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			nodes := c.nodes - 1
+			c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
+			c.Put(ctx, workload, "./workload", c.Node(nodes+1))
+			c.Start(ctx, t, c.Range(1, nodes))
+			c.WaitForSQLReady(ctx, 1, time.Minute)
+			dumpKVTopology(ctx, t, c)
+
+			c.Run(ctx, c.Node(nodes+1), "./workload init kv "+c.PGUrlTemplate(c.Node(1)))
+			db := c.Conn(ctx, 1)
+			defer db.Close()
+			if err := c.SetGCTTL(ctx, db, "TABLE kv.kv", time.Minute); err != nil {
+				t.Fatal(err)
+			}
+
+			duration := 20 * time.Minute
+			sampleInterval := time.Minute
+			if local {
+				duration = time.Minute
+				sampleInterval = 5 * time.Second
+			}
+			// done is closed once the workload is over, which stops the other
+			// workers.
+			done := make(chan struct{})
+
+			t.Status("running workload")
+			m := newMonitor(ctx, c, c.Range(1, nodes))
+			m.Go(func(ctx context.Context) error {
+				defer close(done)
+				cmd := fmt.Sprintf(
+					"./workload run kv --read-percent=0 --cycle-length=100000 --tolerate-errors"+
+						" --duration=%s %s", duration, c.PGUrlTemplate(c.Range(1, nodes)))
+				return c.RunE(ctx, c.Node(nodes+1), cmd)
+			})
+			m.Go(func(ctx context.Context) error {
+				// Delete rows as fast as we can; the workload keeps writing them
+				// back since it only uses a bounded set of keys.
+				for {
+					select {
+					case <-done:
+						return nil
+					case <-ctx.Done():
+						return nil
+					default:
+					}
+					if _, err := db.ExecContext(
+						ctx, `DELETE FROM kv.kv WHERE k IN (SELECT k FROM kv.kv LIMIT 1000)`,
+					); err != nil {
+						return err
+					}
+				}
+			})
+
+			var samples []float64
+			m.Go(func(ctx context.Context) error {
+				ticker := time.NewTicker(sampleInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-done:
+						return nil
+					case <-ctx.Done():
+						return nil
+					case <-ticker.C:
+					}
+					v, err := sumNodeMetric(ctx, c, c.Range(1, nodes), "gcbytesage")
+					if err != nil {
+						return err
+					}
+					t.l.Printf("gcbytesage: %.0f\n", v)
+					samples = append(samples, v)
+				}
+			})
+			m.Wait()
+
+			// Once the GC queue has caught up with the garbage generated in the
+			// first half of the test, the amount of garbage must not keep growing.
+			if len(samples) < 4 {
+				t.Fatalf("not enough gcbytesage samples: %v", samples)
+			}
+			half := len(samples) / 2
+			var firstHalfMax float64
+			for _, v := range samples[:half] {
+				if v > firstHalfMax {
+					firstHalfMax = v
+				}
+			}
+			if last := samples[len(samples)-1]; last > 2*firstHalfMax {
+				t.Fatalf("GC did not keep pace: gcbytesage grew from a peak of %.0f in the "+
+					"first half of the test to %.0f; samples: %v", firstHalfMax, last, samples)
+			}
+		},
+	})
+}
+
+func registerKVLeaseChaos(r *registry) {
+	// This test repeatedly moves the leases of a random half of the kv
+	// table's ranges to other replicas while a kv workload runs. After each
+	// round, all ranges have to have a valid lease again and the throughput
+	// has to recover to at least half of its baseline within recoveryTimeout.
+	// How long it took to get there is reported for each round.
+	const fraction = 0.5
+	const recoveryTimeout = time.Minute
+	r.Add(testSpec{
+		Name:       "kv/lease-chaos/nodes=3",
+		Cluster:    makeClusterSpec(4),
+		MinVersion: "v2.1.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			nodes := c.nodes - 1
+			c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
+			c.Put(ctx, workload, "./workload", c.Node(nodes+1))
+			c.Start(ctx, t, c.Range(1, nodes))
+			c.WaitForSQLReady(ctx, 1, time.Minute)
+			dumpKVTopology(ctx, t, c)
+
+			db := c.Conn(ctx, 1)
+			defer db.Close()
+			c.Run(ctx, c.Node(nodes+1), "./workload init kv --splits=100 "+c.PGUrlTemplate(c.Node(1)))
+
+			rng, seed := randutil.NewPseudoRand()
+			t.l.Printf("moving leases with seed %d\n", seed)
+			warmupDur, duration := time.Minute, 10*time.Minute
+			if local {
+				warmupDur, duration = 10*time.Second, time.Minute
+			}
+
+			m := newMonitor(ctx, c, c.Range(1, nodes))
+			progress := newWorkloadProgress(nil /* ticks */)
+			m.Go(func(ctx context.Context) error {
+				return c.RunWithProgress(ctx, c.Node(nodes+1), progress, fmt.Sprintf(
+					"./workload run kv --read-percent=50 --concurrency=%d --duration=%s %s",
+					nodes*32, duration, c.PGUrlTemplate(c.Range(1, nodes))))
+			})
+			m.Go(func(ctx context.Context) error {
+				start := timeutil.Now()
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(warmupDur):
+				}
+				baseline := progress.OpsPerSec()
+				t.l.Printf("baseline: %.1f ops/sec\n", baseline)
+
+				// Leave enough time for the last round to recover before the
+				// workload ends.
+				for round := 1; timeutil.Since(start) < duration-recoveryTimeout; round++ {
+					moved, err := chaosLeaseholders(ctx, db, rng, "kv.kv", fraction)
+					if err != nil {
+						return err
+					}
+					movedAt := timeutil.Now()
+					for {
+						leaseholders, err := sumNodeMetric(ctx, c, c.Range(1, nodes), "replicas.leaseholders")
+						if err != nil {
+							return err
+						}
+						ranges, err := sumNodeMetric(ctx, c, c.Range(1, nodes), "ranges")
+						if err != nil {
+							return err
+						}
+						qps := progress.OpsPerSec()
+						if leaseholders >= ranges && qps >= baseline/2 {
+							t.l.Printf("round %d: moved %d leases, re-established and back at %.1f ops/sec after %s\n",
+								round, moved, qps, timeutil.Since(movedAt))
+							break
+						}
+						if timeutil.Since(movedAt) > recoveryTimeout {
+							return errors.Errorf("round %d: %.0f of %.0f ranges have a leaseholder and "+
+								"throughput is at %.1f ops/sec (baseline %.1f) %s after moving %d leases",
+								round, leaseholders, ranges, qps, baseline, recoveryTimeout, moved)
+						}
+						select {
+						case <-ctx.Done():
+							return ctx.Err()
+						case <-time.After(time.Second):
+						}
+					}
+				}
+				return nil
+			})
+			m.Wait()
+		},
+	})
+}
+
+func registerKVLoadBasedSplit(r *registry) {
+	// This test drives a concentrated write hotspot onto the single range of
+	// the kv table by writing sequential keys and verifies that load-based
+	// splitting relieves it within a time bound: the table has to be split into
+	// several ranges and the load on the hottest range has to drop to a
+	// fraction of the total.
+	r.Add(testSpec{
+		Name:       "kv/loadsplit/nodes=3",
+		Cluster:    makeClusterSpec(4),
+		MinVersion: "v2.2.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			nodes := c.nodes - 1
+			c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
+			c.Put(ctx, workload, "./workload", c.Node(nodes+1))
+			c.Start(ctx, t, c.Range(1, nodes))
+			c.WaitForSQLReady(ctx, 1, time.Minute)
+			dumpKVTopology(ctx, t, c)
+
+			db := c.Conn(ctx, 1)
+			defer db.Close()
+
+			// Keep the kv table in a single range until load-based splitting is
+			// turned on below.
+			if err := disableLoadBasedSplitting(ctx, db); err != nil {
+				t.Fatal(err)
+			}
+			c.Run(ctx, c.Node(nodes+1), "./workload init kv "+c.PGUrlTemplate(c.Node(1)))
+			if err := configureZone(ctx, db, "TABLE kv.kv",
+				"range_max_bytes = 10737418240, range_min_bytes = 16777216"); err != nil {
+				t.Fatal(err)
+			}
+			if rc, err := tableRangeCount(ctx, db, "kv.kv"); err != nil {
+				t.Fatal(err)
+			} else if rc != 1 {
+				t.Fatalf("kv.kv split over %d ranges before load-based splitting was enabled", rc)
+			}
+
+			for _, stmt := range []string{
+				`SET CLUSTER SETTING kv.range_split.load_qps_threshold = 100`,
+				`SET CLUSTER SETTING kv.range_split.by_load_enabled = true`,
+			} {
+				if _, err := db.ExecContext(ctx, stmt); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			const minRanges = 5
+			const maxHotFraction = 0.5
+			timeout := 5 * time.Minute
+
+			// split is closed once the hotspot has been split, which stops the
+			// workload early.
+			split := make(chan struct{})
+			m := newMonitor(ctx, c, c.Range(1, nodes))
+			m.Go(func(ctx context.Context) error {
+				ctx, cancel := context.WithCancel(ctx)
+				defer cancel()
+				go func() {
+					select {
+					case <-split:
+						cancel()
+					case <-ctx.Done():
+					}
+				}()
+				err := c.RunE(ctx, c.Node(nodes+1), fmt.Sprintf(
+					"./workload run kv --read-percent=0 --sequential --concurrency=64"+
+						" --tolerate-errors --duration=%s %s",
+					timeout+time.Minute, c.PGUrlTemplate(c.Range(1, nodes))))
+				select {
+				case <-split:
+					return nil
+				default:
+					return err
+				}
+			})
+
+			m.Go(func(ctx context.Context) error {
+				t.Status("waiting for load-based splits")
+				var progression []string
+				for tBegin := timeutil.Now(); timeutil.Since(tBegin) <= timeout; {
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case <-time.After(10 * time.Second):
+					}
+
+					rc, err := tableRangeCount(ctx, db, "kv.kv")
+					if err != nil {
+						return err
+					}
+					hot, err := c.HotRanges(ctx, db, 10)
+					if err != nil {
+						return err
+					}
+					var total float64
+					for _, r := range hot {
+						total += r.QPS
+					}
+					var hotFraction float64
+					if total > 0 {
+						hotFraction = hot[0].QPS / total
+					}
+					progression = append(progression, fmt.Sprintf(
+						"%s: %d ranges, hottest range at %.0f%% of QPS",
+						time.Duration(timeutil.Since(tBegin).Seconds())*time.Second, rc, 100*hotFraction))
+					t.l.Printf("%s\n", progression[len(progression)-1])
+
+					if rc >= minRanges && total > 0 && hotFraction <= maxHotFraction {
+						close(split)
+						return nil
+					}
+				}
+				return errors.Errorf(
+					"hotspot not split into %d ranges with the hottest at most %.0f%% of QPS within %s:\n%s",
+					minRanges, 100*maxHotFraction, timeout, strings.Join(progression, "\n"))
+			})
+			m.Wait()
+		},
+	})
+}
+
+// parseWorkloadResultP99 extracts the p99 latency (in milliseconds) from the
+// __result summary printed by `./workload run` when it exits.
+func parseWorkloadResultP99(out string) (float64, error) {
+	lines := strings.Split(out, "\n")
+	for i, line := range lines {
+		if !strings.Contains(line, "__result") || i+1 == len(lines) {
+			continue
+		}
+		// _elapsed___errors_____ops(total)___ops/sec(cum)__avg(ms)__p50(ms)__p95(ms)__p99(ms)_pMax(ms)
+		fields := strings.Fields(lines[i+1])
+		if len(fields) < 8 {
+			break
+		}
+		return strconv.ParseFloat(fields[7], 64)
+	}
+	return 0, errors.Errorf("workload result not found in output:\n\n%s\n", out)
+}
+
+func registerKVLocalRouting(r *registry) {
+	// This test measures the benefit of sending each request directly to the
+	// leaseholder of the keys it touches. The kv table is split into one range
+	// per node and each node is made the leaseholder of one range. The workload
+	// is then run twice with the same load: once connecting to random gateways
+	// and once with --affinity, which routes the workers for each range to the
+	// node holding its lease. The local-routing run has to achieve a lower p99.
+	r.Add(testSpec{
+		Name:    "kv95/localrouting/nodes=3",
+		Cluster: makeClusterSpec(4, cpu(8)),
+		ClusterSettings: map[string]string{
+			"kv.allocator.load_based_lease_rebalancing.enabled": "false",
+		},
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			nodes := c.nodes - 1
+			c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
+			c.Put(ctx, workload, "./workload", c.Node(nodes+1))
+			c.Start(ctx, t, c.Range(1, nodes))
+			c.WaitForSQLReady(ctx, 1, time.Minute)
+			dumpKVTopology(ctx, t, c)
+
+			db := c.Conn(ctx, 1)
+			defer db.Close()
+
+			// Keep the range layout and the lease placement set up below.
+			if err := disableLoadBasedSplitting(ctx, db); err != nil {
+				t.Fatal(err)
+			}
+
+			c.Run(ctx, c.Node(nodes+1), fmt.Sprintf("./workload init kv --splits=%d %s", nodes-1, c.PGUrlTemplate(c.Node(1))))
+			// Mirror the split points computed by the kv workload: range i starts
+			// at the i-th of the equally spaced split points.
+			stride := (float64(math.MaxInt64) - float64(math.MinInt64)) / float64(nodes)
+			for i := 0; i < nodes; i++ {
+				start := int64(math.MinInt64)
+				if i > 0 {
+					start = int64(math.MinInt64 + float64(i)*stride)
+				}
+				if _, err := db.ExecContext(ctx,
+					`ALTER TABLE kv.kv EXPERIMENTAL_RELOCATE LEASE VALUES ($1, $2)`, i+1, start,
+				); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			duration := " --duration=" + ifLocal("10s", "5m")
+			run := func(name, extraFlags string) float64 {
+				t.Status(fmt.Sprintf("running %s routing", name))
+				out, err := c.RunWithBuffer(ctx, t.l, c.Node(nodes+1), fmt.Sprintf(
+					"./workload run kv --read-percent=95 --concurrency=%d --splits=%d%s%s %s",
+					nodes*64, nodes-1, extraFlags, duration, c.PGUrlTemplate(c.Range(1, nodes))))
+				if err != nil {
+					t.Fatalf("%v\n\n%s", err, out)
+				}
+				p99, err := parseWorkloadResultP99(string(out))
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.l.Printf("%s routing: p99 %.1fms\n", name, p99)
+				return p99
+			}
+			randomP99 := run("random", "")
+			localP99 := run("local", " --affinity")
+			if localP99 >= randomP99 {
+				t.Fatalf("local routing p99 %.1fms not lower than random routing p99 %.1fms",
+					localP99, randomP99)
+			}
+		},
+	})
+}
+
+func registerKVMerge(r *registry) {
+	// This test splits a table into many ranges with merging disabled, then
+	// lets the merge queue merge them back down while the table is being read,
+	// and finally checks that no data was lost or corrupted along the way. The
+	// nodes run aggressive consistency checks, which check the replicas of a
+	// range against each other after each merge.
+	r.Add(testSpec{
+		Name:       "kv/merge/nodes=3",
+		Cluster:    makeClusterSpec(3),
+		MinVersion: "v2.1.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			c.Put(ctx, cockroach, "./cockroach")
+			c.Start(ctx, t, env(map[string]string{"COCKROACH_CONSISTENCY_AGGRESSIVE": "true"}))
+			var dbs []*gosql.DB
+			for i := 1; i <= c.nodes; i++ {
+				db := c.Conn(ctx, i)
+				defer db.Close()
+				dbs = append(dbs, db)
+			}
+			if _, err := dbs[0].ExecContext(ctx,
+				`SET CLUSTER SETTING kv.range_merge.queue_enabled = false`,
+			); err != nil {
+				t.Fatal(err)
+			}
+
+			_, seed := randutil.NewPseudoRand()
+			t.l.Printf("writing data for seed %d\n", seed)
+			rows, splits := 100000, 1000
+			if local {
+				rows, splits = 1000, 50
+			}
+			if err := writeSeededData(ctx, dbs, seed, rows); err != nil {
+				t.Fatal(err)
+			}
+
+			t.Status("splitting")
+			if _, err := dbs[0].ExecContext(ctx, fmt.Sprintf(
+				`ALTER TABLE %s SPLIT AT SELECT $1::INT, i FROM generate_series(1, $2) AS g(i) WHERE i %% $3 = 0`,
+				seededDataTable), seed, rows, rows/splits,
+			); err != nil {
+				t.Fatal(err)
+			}
+			ranges, err := tableRangeCount(ctx, dbs[0], seededDataTable)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.l.Printf("split %s into %d ranges\n", seededDataTable, ranges)
+			if ranges < splits {
+				t.Fatalf("expected at least %d ranges, found %d", splits, ranges)
+			}
+
+			t.Status("merging")
+			m := newMonitor(ctx, c)
+			merged := make(chan struct{})
+			m.Go(func(ctx context.Context) error {
+				defer close(merged)
+				mergeCtx, cancel := context.WithTimeout(ctx, 30*time.Minute)
+				defer cancel()
+				// The seeded data is small enough to fit into a handful of ranges.
+				return c.MergeRanges(mergeCtx, dbs[0], seededDataTable, 10 /* target */)
+			})
+			m.Go(func(ctx context.Context) error {
+				// Keep reading the table while it is being merged.
+				for i := 0; ; i++ {
+					select {
+					case <-merged:
+						return nil
+					default:
+					}
+					if err := verifyChecksums(ctx, dbs[i%len(dbs)], seed); err != nil {
+						return err
+					}
+				}
+			})
+			m.Wait()
+
+			t.Status("verifying data")
+			for i, db := range dbs {
+				if err := verifyChecksums(ctx, db, seed); err != nil {
+					t.Fatalf("n%d: %s", i+1, err)
+				}
+			}
+		},
+	})
+}
+
+func registerKVQuotaPool(r *registry) {
+	// This test throttles the link from the leaseholder of the kv table's range
+	// to one of its followers. The leaseholder's raft proposal quota pool
+	// doesn't release quota until all active followers have caught up, so the
+	// lagging follower drains it and writes have to wait for quota. The test
+	// verifies that this backpressure slows writes down without failing or
+	// wedging them, and that the follower catches up cleanly once the link is
+	// restored.
+	r.Add(testSpec{
+		Name:       "kv/quotapool/nodes=3",
+		Cluster:    makeClusterSpec(4),
+		MinVersion: "v2.1.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			if c.isLocal() {
+				t.spec.Skip = "throttling replication requires a remote cluster"
+				return
+			}
+			nodes := c.nodes - 1
+			c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
+			c.Put(ctx, workload, "./workload", c.Node(nodes+1))
+			c.Start(ctx, t, c.Range(1, nodes))
+			c.WaitForSQLReady(ctx, 1, time.Minute)
+			dumpKVTopology(ctx, t, c)
+
+			db := c.Conn(ctx, 1)
+			defer db.Close()
+
+			// Keep all writes on a single range whose lease is on n1, so that
+			// throttling n1's link to n3 affects every write.
+			if err := disableLoadBasedSplitting(ctx, db); err != nil {
+				t.Fatal(err)
+			}
+			c.Run(ctx, c.Node(nodes+1), "./workload init kv "+c.PGUrlTemplate(c.Node(1)))
+			waitForFullReplication(t, db)
+			if _, err := db.ExecContext(ctx,
+				`ALTER TABLE kv.kv EXPERIMENTAL_RELOCATE LEASE VALUES (1, 0)`,
+			); err != nil {
+				t.Fatal(err)
+			}
+
+			const (
+				baselineDur = time.Minute
+				pressureDur = 3 * time.Minute
+				recoveryDur = 3 * time.Minute
+				// The throttled bandwidth is far below what the workload writes
+				// unthrottled, so the quota pool is drained quickly.
+				throttledBytesPerSec = 256 << 10
+			)
+
+			m := newMonitor(ctx, c, c.Range(1, nodes))
+			m.Go(func(ctx context.Context) error {
+				// No --tolerate-errors: backpressure must not surface as errors.
+				out, err := c.RunWithBuffer(ctx, t.l, c.Node(nodes+1), fmt.Sprintf(
+					"./workload run kv --read-percent=0 --concurrency=32"+
+						" --min-block-bytes=1024 --max-block-bytes=1024 --duration=%s %s",
+					baselineDur+pressureDur+recoveryDur, c.PGUrlTemplate(c.Range(1, nodes))))
+				if err != nil {
+					return errors.Wrapf(err, "workload failed:\n%s", out)
+				}
+				if p99, err := parseWorkloadResultP99(string(out)); err == nil {
+					t.l.Printf("workload p99 over the whole run: %.1fms\n", p99)
+				}
+				return nil
+			})
+			m.Go(func(ctx context.Context) error {
+				// sample returns the rate of SQL queries served by the cluster
+				// over the given interval and the number of raft log entries n1's
+				// followers are behind at the end of it.
+				sample := func(interval time.Duration) (qps float64, behind float64, _ error) {
+					before, err := sumNodeMetric(ctx, c, c.Range(1, nodes), "sql.query.count")
+					if err != nil {
+						return 0, 0, err
+					}
+					select {
+					case <-ctx.Done():
+						return 0, 0, ctx.Err()
+					case <-time.After(interval):
+					}
+					after, err := sumNodeMetric(ctx, c, c.Range(1, nodes), "sql.query.count")
+					if err != nil {
+						return 0, 0, err
+					}
+					behind, err = getNodeMetric(ctx, db, "raftlog.behind")
+					if err != nil {
+						return 0, 0, err
+					}
+					return (after - before) / interval.Seconds(), behind, nil
+				}
+
+				t.Status("measuring baseline")
+				// Let the workload ramp up before measuring.
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(10 * time.Second):
+				}
+				baselineQPS, _, err := sample(baselineDur - 10*time.Second)
+				if err != nil {
+					return err
+				}
+				t.l.Printf("baseline: %.0f qps\n", baselineQPS)
+
+				t.Status("throttling n1 -> n3")
+				clear, err := c.ThrottleReplication(ctx, 1, 3, throttledBytesPerSec)
+				if err != nil {
+					return err
+				}
+				var pressureQueries float64
+				const interval = 10 * time.Second
+				for i := time.Duration(0); i < pressureDur; i += interval {
+					qps, behind, err := sample(interval)
+					if err != nil {
+						_ = clear()
+						return err
+					}
+					t.l.Printf("throttled: %.0f qps, followers behind by %.0f entries\n", qps, behind)
+					if qps == 0 {
+						_ = clear()
+						return errors.Errorf("writes wedged while n3 was lagging")
+					}
+					pressureQueries += qps * interval.Seconds()
+				}
+				if err := clear(); err != nil {
+					return err
+				}
+				if pressureQPS := pressureQueries / pressureDur.Seconds(); pressureQPS > baselineQPS/2 {
+					return errors.Errorf(
+						"writes were not slowed down by the lagging follower: %.0f qps throttled, %.0f qps baseline",
+						pressureQPS, baselineQPS)
+				}
+
+				t.Status("waiting for n3 to catch up")
+				for tBegin := timeutil.Now(); ; {
+					qps, behind, err := sample(interval)
+					if err != nil {
+						return err
+					}
+					t.l.Printf("recovering: %.0f qps, followers behind by %.0f entries\n", qps, behind)
+					if behind == 0 && qps > baselineQPS/2 {
+						return nil
+					}
+					if timeutil.Since(tBegin) > recoveryDur-interval {
+						return errors.Errorf(
+							"cluster did not recover within %s: %.0f qps, followers behind by %.0f entries",
+							recoveryDur, qps, behind)
+					}
+				}
+			})
+			m.Wait()
+		},
+	})
+}
+
+func registerKVFailover(r *registry) {
+	// This test measures how long it takes the cluster to recover its
+	// throughput after a node holding a share of the leases is killed. The
+	// load is sent to the surviving nodes only, so the recovery time reflects
+	// lease and raft leadership failover rather than clients reconnecting.
+	runFailover := func(ctx context.Context, t *test, c *cluster, electionTimeoutTicks int) {
+		nodes := c.nodes - 1
+		c.Put(ctx, cockroach, "./cockroach", c.Range(1, nodes))
+		c.Put(ctx, workload, "./workload", c.Node(nodes+1))
+		var opts []option
+		if electionTimeoutTicks != 0 {
+			opts = append(opts, raftElectionTimeout(electionTimeoutTicks))
+		}
+		c.Start(ctx, t, append(opts, c.Range(1, nodes))...)
+		for i := 1; i <= nodes; i++ {
+			c.WaitForSQLReady(ctx, i, time.Minute)
+			if err := c.verifyRaftElectionTimeout(ctx, i, electionTimeoutTicks); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dumpKVTopology(ctx, t, c)
+
+		db := c.Conn(ctx, 1)
+		defer db.Close()
+
+		c.Run(ctx, c.Node(nodes+1), "./workload init kv --splits=100 "+c.PGUrlTemplate(c.Node(1)))
+		waitForFullReplication(t, db)
+
+		const maxFailover = 30 * time.Second
+		warmupDur := 2 * time.Minute
+		if local {
+			warmupDur = 20 * time.Second
+		}
+		m := newMonitor(ctx, c, c.Range(1, nodes))
+		m.Go(func(ctx context.Context) error {
+			return c.RunE(ctx, c.Node(nodes+1), fmt.Sprintf(
+				"./workload run kv --read-percent=0 --concurrency=64 --tolerate-errors"+
+					" --duration=%s %s", warmupDur+5*time.Minute, c.PGUrlTemplate(c.Range(1, nodes-1))))
+		})
+		m.Go(func(ctx context.Context) error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(warmupDur):
+			}
+			t.Status(fmt.Sprintf("killing n%d", nodes))
+			m.ExpectDeath()
+			latency, err := measureFailoverLatency(ctx, c, db, nodes)
+			if err != nil {
+				return err
+			}
+			t.l.Printf("failover latency: %s\n", latency)
+			if latency > maxFailover {
+				return errors.Errorf("failover took %s, more than %s", latency, maxFailover)
+			}
+			return nil
+		})
+		m.Wait()
+	}
+
+	r.Add(testSpec{
+		Name:       "kv0/failover/nodes=3",
+		Cluster:    makeClusterSpec(4),
+		MinVersion: "v2.1.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			runFailover(ctx, t, c, 0 /* electionTimeoutTicks */)
+		},
+	})
+	r.Add(testSpec{
+		Name:       "kv0/failover/election-timeout=5/nodes=3",
+		Cluster:    makeClusterSpec(4),
+		MinVersion: "v2.1.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			runFailover(ctx, t, c, 5 /* electionTimeoutTicks */)
+		},
+	})
 }
@@ -0,0 +1,93 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/server"
+	"github.com/cockroachdb/cockroach/pkg/ts/tspb"
+	"github.com/cockroachdb/cockroach/pkg/util/httputil"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/gogo/protobuf/jsonpb"
+)
+
+func TestPostTimeseriesQuery(t *testing.T) {
+	datapoints := []tspb.TimeSeriesDatapoint{
+		{TimestampNanos: 110e9, Value: 1000},
+		{TimestampNanos: 120e9, Value: 990},
+	}
+	defer func(opts retry.Options) {
+		timeseriesRetryOptions = opts
+	}(timeseriesRetryOptions)
+	timeseriesRetryOptions.InitialBackoff = time.Millisecond
+	timeseriesRetryOptions.MaxBackoff = time.Millisecond
+
+	var request tspb.TimeSeriesQueryRequest
+	// The server is unavailable for the first couple of queries, as if it were
+	// restarting.
+	unavailable := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ts/query" {
+			http.NotFound(w, r)
+			return
+		}
+		if unavailable > 0 {
+			unavailable--
+			http.Error(w, "node is draining", http.StatusServiceUnavailable)
+			return
+		}
+		if err := jsonpb.Unmarshal(r.Body, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set(httputil.ContentTypeHeader, httputil.JSONContentType)
+		if err := (&jsonpb.Marshaler{}).Marshal(w, &tspb.TimeSeriesQueryResponse{
+			Results: []tspb.TimeSeriesQueryResponse_Result{
+				{Query: request.Queries[0], Datapoints: datapoints},
+			},
+		}); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	query := rateQuery("cr.node.sql.query.count")
+	start, end := time.Unix(100, 0), time.Unix(130, 0)
+	result, err := postTimeseriesQuery(context.Background(), srv.URL, query, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(datapoints, result) {
+		t.Errorf("expected %+v, found %+v", datapoints, result)
+	}
+
+	if request.StartNanos != start.UnixNano() || request.EndNanos != end.UnixNano() {
+		t.Errorf("expected query from %d to %d, found %d to %d",
+			start.UnixNano(), end.UnixNano(), request.StartNanos, request.EndNanos)
+	}
+	if e := server.DefaultMetricsSampleInterval.Nanoseconds(); request.SampleNanos != e {
+		t.Errorf("expected sample interval %d, found %d", e, request.SampleNanos)
+	}
+	if len(request.Queries) != 1 || !reflect.DeepEqual(request.Queries[0], query) {
+		t.Errorf("expected query %+v, found %+v", query, request.Queries)
+	}
+}
@@ -212,6 +212,18 @@ func (l *logger) ChildLogger(name string, opts ...loggerOption) (*logger, error)
 	return cfg.newLogger(path)
 }
 
+// teeStdout returns a logger which behaves like l, except that the output
+// written to its stdout (e.g. by a command run with it) is also written to w.
+// If l's stdout and stderr are the same, so are the returned logger's.
+func (l *logger) teeStdout(w io.Writer) *logger {
+	cpy := *l
+	cpy.stdout = io.MultiWriter(l.stdout, w)
+	if l.stderr == l.stdout {
+		cpy.stderr = cpy.stdout
+	}
+	return &cpy
+}
+
 func (l *logger) Printf(f string, args ...interface{}) {
 	if err := l.stdoutL.Output(2 /* calldepth */, fmt.Sprintf(f, args...)); err != nil {
 		// Changing our interface to return an Error from a logging method seems too
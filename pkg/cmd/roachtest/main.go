@@ -75,6 +75,8 @@ func main() {
 	f.NoOptDefVal = "true"
 
 	var listBench bool
+	var listMatrix bool
+	var listJSON bool
 
 	var listCmd = &cobra.Command{
 		Use:   "list [tests]",
@@ -84,6 +86,11 @@ func main() {
 If no pattern is passed, all tests are matched.
 Use --bench to list benchmarks instead of tests.
 
+Use --matrix to print the cluster specification, versions, timeout and tags
+of every matched test (including skipped ones), and --json to print them as
+JSON instead of a table. This only consults the registered tests and does not
+create any clusters.
+
 Each test has a set of tags. The tags are used to skip tests which don't match
 the tag filter. The tag filter is specified by specifying a pattern with the
 "tag:" prefix. The default tag filter is "tag:default" which matches any test
@@ -95,6 +102,7 @@ Examples:
    roachtest list acceptance copy/bank/.*false
    roachtest list tag:acceptance
    roachtest list tag:weekly
+   roachtest list --matrix kv
 `,
 		RunE: func(_ *cobra.Command, args []string) error {
 			r := newRegistry(setBuildVersion)
@@ -104,6 +112,9 @@ Examples:
 				registerBenchmarks(r)
 			}
 
+			if listMatrix || listJSON {
+				return r.WriteMatrix(os.Stdout, args, listJSON)
+			}
 			names := r.ListAll(args)
 			for _, name := range names {
 				fmt.Println(name)
@@ -113,6 +124,10 @@ Examples:
 	}
 	listCmd.Flags().BoolVar(
 		&listBench, "bench", false, "list benchmarks instead of tests")
+	listCmd.Flags().BoolVar(
+		&listMatrix, "matrix", false, "print the specification of each test as a table")
+	listCmd.Flags().BoolVar(
+		&listJSON, "json", false, "print the specification of each test as JSON (implies --matrix)")
 
 	var runCmd = &cobra.Command{
 		Use:   "run [tests]",
@@ -167,11 +182,14 @@ the test tags.
 		cmd.Flags().IntVar(
 			&count, "count", 1, "the number of times to run each test")
 		cmd.Flags().BoolVarP(
-			&debugEnabled, "debug", "d", debugEnabled, "don't wipe and destroy cluster if test fails")
+			&debugEnabled, "debug", "d", debugEnabled, "don't wipe and destroy cluster (or the checkpoints taken by the test) if test fails")
 		cmd.Flags().IntVarP(
 			&parallelism, "parallelism", "p", parallelism, "number of tests to run in parallel")
 		cmd.Flags().StringVar(
 			&roachprod, "roachprod", "", "path to roachprod binary to use")
+		cmd.Flags().DurationVar(
+			&soakDuration, "soak", 0,
+			"run the workloads of the tests which support it for this long, e.g. 24h")
 		cmd.Flags().BoolVar(
 			&clusterWipe, "wipe", true,
 			"wipe existing cluster before starting test (for use with --cluster)")
@@ -199,7 +217,7 @@ Cockroach cluster with existing data.
 		&stores, "stores", "n", stores, "number of stores to distribute data across")
 	storeGenCmd.Flags().SetInterspersed(false) // ignore workload flags
 	storeGenCmd.Flags().BoolVarP(
-		&debugEnabled, "debug", "d", debugEnabled, "don't wipe and destroy cluster if test fails")
+		&debugEnabled, "debug", "d", debugEnabled, "don't wipe and destroy cluster (or the checkpoints taken by the test) if test fails")
 
 	rootCmd.AddCommand(listCmd)
 	rootCmd.AddCommand(runCmd)
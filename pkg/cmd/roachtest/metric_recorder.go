@@ -0,0 +1,159 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// metricSample is the value of a metric on a node at some point in time.
+type metricSample struct {
+	Time  time.Time
+	Node  int
+	Name  string
+	Value float64
+}
+
+// metricRecorder periodically samples a set of metrics on a set of nodes,
+// producing a time series of each metric on each node. The samples are kept
+// in memory and written to a CSV file in the test's artifacts as they are
+// taken, so that they survive a test which crashes or times out.
+type metricRecorder struct {
+	c        *cluster
+	nodes    nodeListOption
+	names    []string
+	interval time.Duration
+
+	mu struct {
+		syncutil.Mutex
+		samples []metricSample
+	}
+}
+
+// goroutinesMetric is the name under which a metricRecorder records the number
+// of goroutines on each node (see cluster.GoroutineCount). The nodes don't
+// export it as a metric of their own.
+const goroutinesMetric = "goroutines"
+
+// newMetricRecorder creates a recorder for the named metrics of the given
+// nodes, which may include goroutinesMetric.
+func newMetricRecorder(
+	c *cluster, nodes nodeListOption, interval time.Duration, names ...string,
+) *metricRecorder {
+	return &metricRecorder{c: c, nodes: nodes, names: names, interval: interval}
+}
+
+// run samples the metrics into the artifacts file with the given name until
+// ctx is canceled. Nodes which can't be reached, e.g. because a test killed
+// them, are skipped.
+func (r *metricRecorder) run(ctx context.Context, name string) error {
+	path := filepath.Join(r.c.t.ArtifactsDir(), name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"time", "node", "name", "value"}); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			w.Flush()
+			return w.Error()
+		case <-ticker.C:
+		}
+		now := timeutil.Now()
+		for _, node := range r.nodes {
+			m, err := r.read(ctx, node)
+			if err != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				r.c.l.Printf("recording metrics: %s\n", err)
+				continue
+			}
+			r.mu.Lock()
+			for _, name := range r.names {
+				r.mu.samples = append(r.mu.samples, metricSample{
+					Time: now, Node: node, Name: name, Value: m[name],
+				})
+				if err := w.Write([]string{
+					now.Format(time.RFC3339), strconv.Itoa(node), name,
+					strconv.FormatFloat(m[name], 'f', -1, 64),
+				}); err != nil {
+					r.mu.Unlock()
+					return err
+				}
+			}
+			r.mu.Unlock()
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+	}
+}
+
+// read reads the current values of the recorded metrics on node.
+func (r *metricRecorder) read(ctx context.Context, node int) (map[string]float64, error) {
+	var names []string
+	var goroutines bool
+	for _, name := range r.names {
+		if name == goroutinesMetric {
+			goroutines = true
+			continue
+		}
+		names = append(names, name)
+	}
+	m := make(map[string]float64, len(r.names))
+	if len(names) > 0 {
+		var err error
+		if m, err = readMetricsFromNode(ctx, r.c, node, names); err != nil {
+			return nil, err
+		}
+	}
+	if goroutines {
+		n, err := r.c.GoroutineCount(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+		m[goroutinesMetric] = float64(n)
+	}
+	return m, nil
+}
+
+// samples returns the samples recorded so far, in the order they were taken.
+func (r *metricRecorder) samples() []metricSample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]metricSample(nil), r.mu.samples...)
+}
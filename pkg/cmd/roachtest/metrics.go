@@ -0,0 +1,271 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"context"
+	gosql "database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/pkg/errors"
+)
+
+// getNodeMetric returns the current value of the named metric on the node db
+// is connected to, as exposed by crdb_internal.node_metrics.
+func getNodeMetric(ctx context.Context, db *gosql.DB, name string) (float64, error) {
+	m, err := readMetrics(ctx, db, []string{name})
+	if err != nil {
+		return 0, err
+	}
+	return m[name], nil
+}
+
+// readMetrics returns the current values of the named metrics on the node db
+// is connected to, as exposed by crdb_internal.node_metrics. All the metrics
+// are read with a single query, which keeps sampling loops from perturbing the
+// measurements they take. Store metrics are summed over the node's stores. It
+// is an error for any of the metrics not to exist.
+func readMetrics(ctx context.Context, db *gosql.DB, names []string) (map[string]float64, error) {
+	var buf strings.Builder
+	buf.WriteString(`SELECT name, sum(value) FROM crdb_internal.node_metrics WHERE name IN (`)
+	args := make([]interface{}, len(names))
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "$%d", i+1)
+		args[i] = name
+	}
+	buf.WriteString(`) GROUP BY name`)
+
+	rows, err := db.QueryContext(ctx, buf.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m := make(map[string]float64, len(names))
+	for rows.Next() {
+		var name string
+		var v float64
+		if err := rows.Scan(&name, &v); err != nil {
+			return nil, err
+		}
+		m[name] = v
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if _, ok := m[name]; !ok {
+			return nil, errors.Errorf("metric %s not found in crdb_internal.node_metrics", name)
+		}
+	}
+	return m, nil
+}
+
+// readMetricsFromNode is like readMetrics, but reads the metrics of the given
+// node through a connection to that node, regardless of how the test routes
+// its other queries. The query times out after a minute, so that a node
+// which accepts connections but is stuck (e.g. while it is restarting) fails
+// the poll instead of blocking it.
+func readMetricsFromNode(
+	ctx context.Context, c *cluster, nodeID int, names []string,
+) (map[string]float64, error) {
+	db := c.ConnWithTimeout(ctx, nodeID, time.Minute)
+	defer db.Close()
+	if err := db.PingContext(ctx); err != nil {
+		return nil, errors.Wrapf(err, "reading metrics from n%d: node unreachable", nodeID)
+	}
+	return readMetrics(ctx, db, names)
+}
+
+// NodeMetric returns the current value of the named metric on the given node,
+// as exposed by crdb_internal.node_metrics. It is an error for the metric not
+// to exist.
+func (c *cluster) NodeMetric(ctx context.Context, node int, name string) (float64, error) {
+	m, err := readMetricsFromNode(ctx, c, node, []string{name})
+	if err != nil {
+		return 0, errors.Wrapf(err, "reading %s from n%d", name, node)
+	}
+	return m[name], nil
+}
+
+// measureRate runs f and returns the rate, per second, at which the named
+// counter metric of the given node increased while f ran.
+func measureRate(
+	ctx context.Context, c *cluster, node int, metric string, f func(),
+) (float64, error) {
+	return measureRateOf(func() (float64, error) {
+		return c.NodeMetric(ctx, node, metric)
+	}, timeutil.Now, f)
+}
+
+// measureRateOf is like measureRate, but reads the counter using read, which
+// is called right before and right after f, and the time using now. This
+// allows measuring counters which aren't a single node's metric, such as the
+// sum of a metric over several nodes.
+func measureRateOf(
+	read func() (float64, error), now func() time.Time, f func(),
+) (float64, error) {
+	start := now()
+	before, err := read()
+	if err != nil {
+		return 0, err
+	}
+	f()
+	after, err := read()
+	if err != nil {
+		return 0, err
+	}
+	elapsed := now().Sub(start).Seconds()
+	if elapsed <= 0 {
+		return 0, errors.Errorf("no time elapsed while measuring the rate")
+	}
+	return (after - before) / elapsed, nil
+}
+
+// sqlConcurrency describes the SQL concurrency a cluster is handling.
+type sqlConcurrency struct {
+	// Conns is the number of open SQL connections, summed over all nodes.
+	Conns int
+	// ActiveStatements is the number of SQL statements executing, summed over
+	// all nodes.
+	ActiveStatements int
+}
+
+func (s sqlConcurrency) String() string {
+	return fmt.Sprintf("%d conns, %d active statements", s.Conns, s.ActiveStatements)
+}
+
+// getSQLConcurrency returns the SQL concurrency currently handled by the given
+// nodes, according to their sql.conns and sql.statements.active metrics. The
+// connections and statements used to take the measurement are not included.
+// Comparing the result against the concurrency requested from a workload
+// reveals whether connection limits or queueing capped the achieved
+// concurrency below the target. sql.statements.active only exists as of
+// v2.2.0.
+func getSQLConcurrency(
+	ctx context.Context, c *cluster, nodes nodeListOption,
+) (sqlConcurrency, error) {
+	var s sqlConcurrency
+	for _, node := range nodes {
+		m, err := readMetricsFromNode(ctx, c, node, []string{"sql.conns", "sql.statements.active"})
+		if err != nil {
+			return s, err
+		}
+		// Don't count the connection and the statement we're measuring with.
+		s.Conns += int(m["sql.conns"]) - 1
+		s.ActiveStatements += int(m["sql.statements.active"]) - 1
+	}
+	return s, nil
+}
+
+// sumNodeMetric returns the sum of the values of the named metric over the
+// given nodes.
+func sumNodeMetric(
+	ctx context.Context, c *cluster, nodes nodeListOption, name string,
+) (float64, error) {
+	var sum float64
+	for _, node := range nodes {
+		m, err := readMetricsFromNode(ctx, c, node, []string{name})
+		if err != nil {
+			return 0, err
+		}
+		sum += m[name]
+	}
+	return sum, nil
+}
+
+// engineStats is a snapshot of the storage engine metrics of a set of nodes.
+type engineStats struct {
+	Compactions float64
+	Flushes     float64
+	SSTables    float64
+	// ReadAmp is the highest read amplification of any of the nodes. For a
+	// node with several stores, it is the sum over its stores.
+	ReadAmp float64
+}
+
+func (s engineStats) String() string {
+	return fmt.Sprintf("%.0f compactions, %.0f flushes, %.0f sstables, read amplification %.0f",
+		s.Compactions, s.Flushes, s.SSTables, s.ReadAmp)
+}
+
+// getEngineStats returns the engine metrics summed over the given nodes.
+func getEngineStats(ctx context.Context, c *cluster, nodes nodeListOption) (engineStats, error) {
+	var s engineStats
+	for _, node := range nodes {
+		m, err := readMetricsFromNode(ctx, c, node, []string{
+			"rocksdb.compactions",
+			"rocksdb.flushes",
+			"rocksdb.num-sstables",
+			"rocksdb.read-amplification",
+		})
+		if err != nil {
+			return s, err
+		}
+		s.Compactions += m["rocksdb.compactions"]
+		s.Flushes += m["rocksdb.flushes"]
+		s.SSTables += m["rocksdb.num-sstables"]
+		if readAmp := m["rocksdb.read-amplification"]; readAmp > s.ReadAmp {
+			s.ReadAmp = readAmp
+		}
+	}
+	return s, nil
+}
+
+// replicaMemory relates the memory usage of a node to the number of replicas
+// it holds.
+type replicaMemory struct {
+	Node     int
+	Replicas float64
+	RSS      float64
+}
+
+// PerReplica estimates the memory used per replica. It attributes all of the
+// node's memory to its replicas, so it is most meaningful for nodes holding
+// a large number of replicas.
+func (m replicaMemory) PerReplica() float64 {
+	if m.Replicas == 0 {
+		return 0
+	}
+	return m.RSS / m.Replicas
+}
+
+func (m replicaMemory) String() string {
+	return fmt.Sprintf("n%d: %.0f replicas, %s RSS, %s per replica", m.Node, m.Replicas,
+		humanizeutil.IBytes(int64(m.RSS)), humanizeutil.IBytes(int64(m.PerReplica())))
+}
+
+// getReplicaMemory returns the memory usage of each of the given nodes in
+// relation to the replicas they hold, over all of their stores.
+func getReplicaMemory(
+	ctx context.Context, c *cluster, nodes nodeListOption,
+) ([]replicaMemory, error) {
+	var res []replicaMemory
+	for _, node := range nodes {
+		m, err := readMetricsFromNode(ctx, c, node, []string{"replicas", "sys.rss"})
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, replicaMemory{Node: node, Replicas: m["replicas"], RSS: m["sys.rss"]})
+	}
+	return res, nil
+}
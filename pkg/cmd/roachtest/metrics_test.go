@@ -0,0 +1,135 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/pkg/errors"
+)
+
+func TestGetNodeMetric(t *testing.T) {
+	ctx := context.Background()
+	s, db, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	// The connection we're querying through is open.
+	if v, err := getNodeMetric(ctx, db, "sql.conns"); err != nil {
+		t.Fatal(err)
+	} else if v < 1 {
+		t.Errorf("expected at least one SQL connection, found %f", v)
+	}
+	// So is the statement reading the metric.
+	if v, err := getNodeMetric(ctx, db, "sql.statements.active"); err != nil {
+		t.Fatal(err)
+	} else if v < 1 {
+		t.Errorf("expected at least one active SQL statement, found %f", v)
+	}
+
+	if _, err := getNodeMetric(ctx, db, "no.such.metric"); !testutils.IsError(err,
+		`metric no.such.metric not found in crdb_internal.node_metrics`) {
+		t.Errorf("expected a missing metric error, found %v", err)
+	}
+	if _, err := readMetrics(ctx, db, []string{"sql.conns", "no.such.metric"}); !testutils.IsError(err,
+		`metric no.such.metric not found in crdb_internal.node_metrics`) {
+		t.Errorf("expected a missing metric error, found %v", err)
+	}
+}
+
+func TestGetNodeMetricMultiStore(t *testing.T) {
+	ctx := context.Background()
+	s, db, _ := serverutils.StartServer(t, base.TestServerArgs{
+		StoreSpecs: []base.StoreSpec{{InMemory: true}, {InMemory: true}},
+	})
+	defer s.Stopper().Stop(ctx)
+
+	// Store metrics are reported once per store and must be summed. Replicas
+	// may move between the stores in the meantime, so retry until the two
+	// reads agree.
+	testutils.SucceedsSoon(t, func() error {
+		rows, err := db.Query(
+			`SELECT store_id, value FROM crdb_internal.node_metrics WHERE name = 'replicas'`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var stores int
+		var sum float64
+		for rows.Next() {
+			var storeID int
+			var v float64
+			if err := rows.Scan(&storeID, &v); err != nil {
+				t.Fatal(err)
+			}
+			stores++
+			sum += v
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if stores != 2 {
+			t.Fatalf("expected the replicas metric of 2 stores, found %d", stores)
+		}
+		v, err := getNodeMetric(ctx, db, "replicas")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != sum {
+			return errors.Errorf("expected %f replicas summed over the stores, found %f", sum, v)
+		}
+		return nil
+	})
+}
+
+func TestMeasureRateOf(t *testing.T) {
+	start := time.Date(2018, 11, 1, 0, 0, 0, 0, time.UTC)
+	clock := start
+	now := func() time.Time { return clock }
+	// The counter reads 100 before and 350 after f, which takes 10s.
+	counter := 100.0
+	read := func() (float64, error) { return counter, nil }
+	f := func() {
+		counter += 250
+		clock = clock.Add(10 * time.Second)
+	}
+	if rate, err := measureRateOf(read, now, f); err != nil {
+		t.Fatal(err)
+	} else if rate != 25 {
+		t.Errorf("expected a rate of 25/s, found %f", rate)
+	}
+
+	if _, err := measureRateOf(read, now, func() {}); !testutils.IsError(err,
+		"no time elapsed") {
+		t.Errorf("expected an error about the elapsed time, found %v", err)
+	}
+
+	var calls int
+	failingRead := func() (float64, error) {
+		calls++
+		if calls > 1 {
+			return 0, errors.New("boom")
+		}
+		return 0, nil
+	}
+	if _, err := measureRateOf(failingRead, now, f); !testutils.IsError(err, "boom") {
+		t.Errorf("expected the read error, found %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// planStabilityQueries are the queries whose plans registerPlanStability
+// checks. They cover the main join strategies and index selection.
+var planStabilityQueries = []string{
+	// Point lookup through a secondary index.
+	`SELECT * FROM plans.orders WHERE customer_id = 42`,
+	// Selective join which should use the index on orders.customer_id.
+	`SELECT c.name, o.amount FROM plans.customers AS c JOIN plans.orders AS o
+	     ON c.id = o.customer_id WHERE c.id < 10`,
+	// Join of two large inputs.
+	`SELECT c.region, sum(o.amount) FROM plans.customers AS c JOIN plans.orders AS o
+	     ON c.id = o.customer_id GROUP BY c.region`,
+	// Ordered scan with a limit.
+	`SELECT * FROM plans.orders ORDER BY id DESC LIMIT 10`,
+	// Aggregation over a low-cardinality column.
+	`SELECT region, count(*) FROM plans.customers GROUP BY region`,
+}
+
+func registerPlanStability(r *registry) {
+	// The optimizer's plans only depend on the schema and on the table
+	// statistics, not on the size of the cluster. This test loads a dataset
+	// with fresh statistics, grows the cluster and verifies that the plans of
+	// a representative set of queries don't change along the way. Plans which
+	// flip-flop with the cluster size make performance unpredictable.
+	r.Add(testSpec{
+		Name:       "plan-stability/nodes=5",
+		Cluster:    makeClusterSpec(5),
+		MinVersion: "v2.2.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			c.Put(ctx, cockroach, "./cockroach", c.All())
+			c.Start(ctx, t, c.Node(1))
+
+			db := c.Conn(ctx, 1)
+			defer db.Close()
+
+			t.Status("loading data")
+			for _, stmt := range []string{
+				// Keep the statistics fixed for the duration of the test.
+				`SET CLUSTER SETTING sql.stats.experimental_automatic_collection.enabled = false`,
+				`CREATE DATABASE plans`,
+				`CREATE TABLE plans.customers (
+					id INT PRIMARY KEY, region INT, name STRING, INDEX (region))`,
+				`CREATE TABLE plans.orders (
+					id INT PRIMARY KEY, customer_id INT, amount INT, INDEX (customer_id))`,
+				`INSERT INTO plans.customers
+					SELECT i, i % 10, 'customer ' || i::STRING FROM generate_series(1, 10000) AS g(i)`,
+				`INSERT INTO plans.orders
+					SELECT i, i % 10000 + 1, i % 1000 FROM generate_series(1, 100000) AS g(i)`,
+			} {
+				if _, err := db.ExecContext(ctx, stmt); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Make sure the optimizer sees the cardinalities of the dataset before
+			// looking at any plans.
+			t.Status("collecting statistics")
+			for table, rows := range map[string]int64{
+				"plans.customers": 10000,
+				"plans.orders":    100000,
+			} {
+				if err := c.CreateStatistics(ctx, db, table); err != nil {
+					t.Fatal(err)
+				}
+				stats, err := tableStats(ctx, db, table)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(stats) == 0 {
+					t.Fatalf("no statistics collected for %s", table)
+				}
+				for _, s := range stats {
+					if s.RowCount != rows {
+						t.Fatalf("statistics on %s(%s) report %d rows, expected %d",
+							table, strings.Join(s.Columns, ", "), s.RowCount, rows)
+					}
+				}
+			}
+
+			var expected []string
+			for _, nodes := range []int{1, 3, 5} {
+				if nodes > 1 {
+					c.Start(ctx, t, c.Range(1, nodes))
+				}
+				t.Status(fmt.Sprintf("checking plans on %d nodes", nodes))
+				for i, q := range planStabilityQueries {
+					plan, err := c.ExplainOpt(ctx, db, q)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if nodes == 1 {
+						expected = append(expected, plan)
+						continue
+					}
+					if plan != expected[i] {
+						diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+							A:        difflib.SplitLines(expected[i]),
+							B:        difflib.SplitLines(plan),
+							FromFile: "nodes=1",
+							ToFile:   fmt.Sprintf("nodes=%d", nodes),
+							Context:  3,
+						})
+						t.Fatalf("plan changed when growing the cluster to %d nodes\nquery: %s\n%s",
+							nodes, strings.Join(strings.Fields(q), " "), diff)
+					}
+				}
+			}
+		},
+	})
+}
+
+func registerPlanJoinStrategy(r *registry) {
+	// This test injects statistics to put the optimizer in different plan
+	// regimes and checks the join strategy it picks in each of them. When
+	// the left side of the join is small, looking up its rows in the index of
+	// the right side beats scanning the right side. Once the left side is large
+	// with few distinct join keys, a hash join is cheaper.
+	r.Add(testSpec{
+		Name:       "plan/join-strategy/injected-stats",
+		Cluster:    makeClusterSpec(1),
+		MinVersion: "v2.2.0",
+		Run: func(ctx context.Context, t *test, c *cluster) {
+			c.Put(ctx, cockroach, "./cockroach", c.All())
+			c.Start(ctx, t, c.All())
+
+			db := c.Conn(ctx, 1)
+			defer db.Close()
+
+			for _, stmt := range []string{
+				`SET CLUSTER SETTING sql.stats.experimental_automatic_collection.enabled = false`,
+				`CREATE DATABASE plans`,
+				`CREATE TABLE plans.abc (a INT, b INT, c INT, PRIMARY KEY (a, c))`,
+				`CREATE TABLE plans.def (d INT, e INT, f INT, PRIMARY KEY (f, e))`,
+			} {
+				if _, err := db.ExecContext(ctx, stmt); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.InjectStatistics(ctx, db, "plans.def", injectedStats{
+				{Columns: []string{"f"}, RowCount: 10000, DistinctCount: 10000},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			const query = `SELECT * FROM plans.abc JOIN plans.def ON f = b`
+			for _, tc := range []struct {
+				abc      injectedStats
+				expected string
+			}{
+				{
+					abc: injectedStats{
+						{Columns: []string{"a"}, RowCount: 100, DistinctCount: 100},
+						{Columns: []string{"b"}, RowCount: 100, DistinctCount: 100},
+					},
+					expected: "inner-join (lookup def)",
+				},
+				{
+					abc: injectedStats{
+						{Columns: []string{"a"}, RowCount: 10000000, DistinctCount: 10000000},
+						{Columns: []string{"b"}, RowCount: 10000000, DistinctCount: 5},
+					},
+					expected: "inner-join",
+				},
+			} {
+				if err := c.InjectStatistics(ctx, db, "plans.abc", tc.abc); err != nil {
+					t.Fatal(err)
+				}
+				plan, err := c.ExplainOpt(ctx, db, query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.l.Printf("plan with %d rows in abc:\n%s\n", tc.abc[0].RowCount, plan)
+				if err := assertPlanContains(plan, tc.expected); err != nil {
+					t.Fatal(err)
+				}
+			}
+		},
+	})
+}
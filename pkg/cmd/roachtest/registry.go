@@ -27,6 +27,7 @@ func registerTests(r *registry) {
 	registerCDC(r)
 	registerClearRange(r)
 	registerClock(r)
+	registerCompactionStall(r)
 	registerCopy(r)
 	registerDebug(r)
 	registerDebugHeap(r)
@@ -37,20 +38,39 @@ func registerTests(r *registry) {
 	registerDrop(r)
 	registerElectionAfterRestart(r)
 	registerEncryption(r)
+	registerFollowerReads(r)
+	registerGCLongTxn(r)
 	registerGossip(r)
 	registerHibernate(r)
+	registerHTAP(r)
 	registerHotSpotSplits(r)
 	registerImportTPCC(r)
 	registerImportTPCH(r)
 	registerInterleaved(r)
 	registerJepsen(r)
 	registerKV(r)
+	registerKVAckedWrites(r)
+	registerKVChecksums(r)
+	registerKVContention(r)
+	registerKVEncryptionRotation(r)
+	registerKVFailover(r)
+	registerKVGCChurn(r)
+	registerKVLeaseChaos(r)
+	registerKVLoadBasedSplit(r)
+	registerKVLocalRouting(r)
+	registerKVMerge(r)
+	registerKVQuotaPool(r)
 	registerKVQuiescenceDead(r)
+	registerKVRecovery(r)
 	registerKVGracefulDraining(r)
+	registerKVRollingRestart(r)
 	registerKVScalability(r)
+	registerKVSchemaChange(r)
 	registerKVSplits(r)
 	registerLargeRange(r)
 	registerNetwork(r)
+	registerPlanJoinStrategy(r)
+	registerPlanStability(r)
 	registerQueue(r)
 	registerRebalanceLoad(r)
 	registerReplicaGC(r)
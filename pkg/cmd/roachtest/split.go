@@ -157,9 +157,8 @@ func runLoadSplits(ctx context.Context, t *test, c *cluster, params splitParams)
 
 		t.Status("checking initial range count")
 		rangeCount := func() int {
-			var ranges int
-			const q = "SELECT count(*) FROM [SHOW EXPERIMENTAL_RANGES FROM TABLE kv.kv]"
-			if err := db.QueryRow(q).Scan(&ranges); err != nil {
+			ranges, err := tableRangeCount(ctx, db, "kv.kv")
+			if err != nil {
 				t.Fatalf("failed to get range count: %v", err)
 			}
 			return ranges
@@ -285,9 +284,8 @@ func runLargeRangeSplits(ctx context.Context, t *test, c *cluster, size int) {
 
 		t.Status("checking for single range")
 		rangeCount := func() int {
-			var ranges int
-			const q = "SELECT count(*) FROM [SHOW EXPERIMENTAL_RANGES FROM TABLE bank.bank]"
-			if err := db.QueryRow(q).Scan(&ranges); err != nil {
+			ranges, err := tableRangeCount(ctx, db, "bank.bank")
+			if err != nil {
 				t.Fatalf("failed to get range count: %v", err)
 			}
 			return ranges
@@ -326,3 +324,42 @@ func disableLoadBasedSplitting(ctx context.Context, db *gosql.DB) error {
 	}
 	return nil
 }
+
+// tableRangeCount returns the number of ranges the given table is split into.
+func tableRangeCount(ctx context.Context, db *gosql.DB, table string) (int, error) {
+	var ranges int
+	q := fmt.Sprintf("SELECT count(*) FROM [SHOW EXPERIMENTAL_RANGES FROM TABLE %s]", table)
+	if err := db.QueryRowContext(ctx, q).Scan(&ranges); err != nil {
+		return 0, err
+	}
+	return ranges, nil
+}
+
+// MergeRanges enables the merge queue, merging as fast as it can, and waits
+// until table has been merged down to at most target ranges. The merge queue
+// is left enabled. The caller bounds the wait through ctx.
+func (c *cluster) MergeRanges(ctx context.Context, db *gosql.DB, table string, target int) error {
+	for _, stmt := range []string{
+		`SET CLUSTER SETTING kv.range_merge.queue_enabled = true`,
+		`SET CLUSTER SETTING kv.range_merge.queue_interval = '0s'`,
+	} {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	for {
+		ranges, err := tableRangeCount(ctx, db, table)
+		if err != nil {
+			return err
+		}
+		c.l.Printf("%s: %d ranges, merging down to %d\n", table, ranges, target)
+		if ranges <= target {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "%s still has %d ranges", table, ranges)
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
@@ -18,6 +18,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -30,6 +31,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/cmd/internal/issues"
@@ -43,9 +45,22 @@ var (
 	count        = 1
 	debugEnabled = false
 	postIssues   = true
+	// soakDuration, if set, overrides the duration of the tests' workloads
+	// (see soakOr) to run them as long soaks.
+	soakDuration time.Duration
 	gceNameRE    = regexp.MustCompile(`^[a-z](?:[-a-z0-9]{0,61}[a-z0-9])?$`)
 )
 
+// soakOr returns the duration a test's workload should run for: d, unless
+// the tests are run as soaks, in which case it is the soak duration. Tests
+// which support soaking pass their regular duration through it.
+func soakOr(d time.Duration) time.Duration {
+	if soakDuration > 0 {
+		return soakDuration
+	}
+	return d
+}
+
 // testFilter holds the name and tag filters for filtering tests.
 type testFilter struct {
 	name   *regexp.Regexp
@@ -111,6 +126,12 @@ type testSpec struct {
 	// skipped.
 	MinVersion string
 	minVersion *version.Version
+	// MaxVersion indicates the maximum cockroach version the test is run
+	// against. If the version specified by --cockroach-version is greater than
+	// MaxVersion, Skip will be populated causing the test to be skipped. This
+	// allows keeping tests of behaviors that were since changed.
+	MaxVersion string
+	maxVersion *version.Version
 	// Tags is a set of tags associated with the test that allow grouping
 	// tests. If no tags are specified, the set ["default"] is automatically
 	// given.
@@ -119,6 +140,11 @@ type testSpec struct {
 	// a top-level testSpec may contain a nodes specification. The cluster is
 	// shared by all subtests.
 	Cluster clusterSpec
+	// ClusterSettings are applied via SET CLUSTER SETTING on node 1 whenever the
+	// test starts a set of nodes including node 1, so that they are in place
+	// before the test runs its workload. The values are SQL expressions, e.g.
+	// "true" or "'10s'". The settings are applied in the order of their names.
+	ClusterSettings map[string]string
 
 	// UseIOBarrier controls the local-ssd-no-ext4-barrier flag passed to
 	// roachprod when creating a cluster. If set, the flag is not passed, and so
@@ -382,6 +408,20 @@ func (r *registry) prepareSpec(spec *testSpec, depth int) error {
 		// greater than "v2.1.0-alpha.x".
 		spec.minVersion = version.MustParse(spec.MinVersion + "-0")
 	}
+	if spec.MaxVersion != "" {
+		v, err := version.Parse(spec.MaxVersion)
+		if err != nil {
+			return fmt.Errorf("%s: unable to parse max-version: %s", spec.Name, err)
+		}
+		if v.PreRelease() != "" {
+			return fmt.Errorf("invalid version %s, cannot specify a prerelease (-xxx)", v)
+		}
+		spec.maxVersion = v
+		if spec.MinVersion != "" && version.MustParse(spec.MinVersion).Compare(v) > 0 {
+			return fmt.Errorf("%s: min-version %s is greater than max-version %s",
+				spec.Name, spec.MinVersion, spec.MaxVersion)
+		}
+	}
 	return nil
 }
 
@@ -397,6 +437,19 @@ func (r *registry) Add(spec testSpec) {
 	r.m[spec.Name] = &spec
 }
 
+// versionSkipReason returns why spec must be skipped given the build-version,
+// or an empty string if the build-version is neither older than the spec's
+// MinVersion nor newer than its MaxVersion.
+func (r *registry) versionSkipReason(spec *testSpec) string {
+	if spec.minVersion != nil && !r.buildVersion.AtLeast(spec.minVersion) {
+		return fmt.Sprintf("requires %s, cluster is %s", spec.MinVersion, r.buildVersion)
+	}
+	if spec.maxVersion != nil && r.buildVersion.Compare(spec.maxVersion) > 0 {
+		return fmt.Sprintf("requires at most %s, cluster is %s", spec.MaxVersion, r.buildVersion)
+	}
+	return ""
+}
+
 // ListTopLevel lists the top level tests that match re, or that have a subtests
 // that matches re.
 func (r *registry) ListTopLevel(filter *testFilter) []*testSpec {
@@ -424,11 +477,8 @@ func (r *registry) ListAll(filters []string) []string {
 	}
 	var names []string
 	for _, t := range tests {
-		if t.Skip == "" && t.minVersion != nil {
-			if !r.buildVersion.AtLeast(t.minVersion) {
-				t.Skip = fmt.Sprintf("build-version (%s) < min-version (%s)",
-					r.buildVersion, t.minVersion)
-			}
+		if t.Skip == "" {
+			t.Skip = r.versionSkipReason(&t)
 		}
 		name := t.Name
 		if t.Skip != "" {
@@ -441,6 +491,84 @@ func (r *registry) ListAll(filters []string) []string {
 	return names
 }
 
+// testMatrixEntry describes one of the tests in the matrix printed by
+// WriteMatrix.
+type testMatrixEntry struct {
+	Name string `json:"name"`
+	// Cluster is the specification of the cluster the test runs on. Subtests
+	// report the cluster of their top-level test.
+	Cluster    string `json:"cluster"`
+	Zones      string `json:"zones,omitempty"`
+	MinVersion string `json:"minVersion,omitempty"`
+	MaxVersion string `json:"maxVersion,omitempty"`
+	// Timeout is empty if the test uses the default timeout.
+	Timeout string   `json:"timeout,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+}
+
+// ListMatrix returns the specs of all the tests that match one of the
+// filters, as ListAll does, sorted by name. Only the registered specs are
+// consulted; no cluster is required.
+func (r *registry) ListMatrix(filters []string) []testMatrixEntry {
+	filter := newFilter(filters)
+	var entries []testMatrixEntry
+	var walk func(spec *testSpec, cluster clusterSpec)
+	walk = func(spec *testSpec, cluster clusterSpec) {
+		if filter.name.MatchString(spec.Name) {
+			e := testMatrixEntry{
+				Name:       spec.Name,
+				Cluster:    cluster.String(),
+				Zones:      cluster.Zones,
+				MinVersion: spec.MinVersion,
+				MaxVersion: spec.MaxVersion,
+				Tags:       spec.Tags,
+			}
+			if spec.Timeout > 0 {
+				e.Timeout = spec.Timeout.String()
+			}
+			entries = append(entries, e)
+		}
+		for i := range spec.SubTests {
+			walk(&spec.SubTests[i], cluster)
+		}
+	}
+	for _, spec := range r.m {
+		walk(spec, spec.Cluster)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// WriteMatrix writes the specs of all the tests that match one of the filters
+// to w, either as a table or, if asJSON is set, as a JSON array. This allows
+// reviewing the tests generated by the register functions without
+// provisioning any clusters.
+func (r *registry) WriteMatrix(w io.Writer, filters []string, asJSON bool) error {
+	entries := r.ListMatrix(filters)
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tCLUSTER\tZONES\tMIN-VERSION\tMAX-VERSION\tTIMEOUT\tTAGS")
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Name, e.Cluster, orDash(e.Zones), orDash(e.MinVersion), orDash(e.MaxVersion),
+			orDash(e.Timeout), orDash(strings.Join(e.Tags, ",")))
+	}
+	return tw.Flush()
+}
+
 // Run runs the tests that match the filter.
 //
 // Args:
@@ -456,13 +584,11 @@ func (r *registry) Run(filters []string, parallelism int, artifactsDir string, u
 		return 1
 	}
 
-	// Skip any tests for which the min-version is less than the build-version.
+	// Skip any tests which require a more recent or an older version than the
+	// build-version.
 	for _, t := range tests {
-		if t.Skip == "" && t.minVersion != nil {
-			if !r.buildVersion.AtLeast(t.minVersion) {
-				t.Skip = fmt.Sprintf("build-version (%s) < min-version (%s)",
-					r.buildVersion, t.minVersion)
-			}
+		if t.Skip == "" {
+			t.Skip = r.versionSkipReason(t)
 		}
 	}
 
@@ -655,7 +781,10 @@ type test struct {
 	// this test. It will contain a test.log file, cluster logs, and
 	// subdirectories for subtests.
 	artifactsDir string
-	mu           struct {
+	// deadline is the time at which the test times out. It is set before the
+	// test starts running.
+	deadline time.Time
+	mu       struct {
 		syncutil.RWMutex
 		done   bool
 		failed bool
@@ -841,6 +970,14 @@ func (t *test) ArtifactsDir() string {
 	return t.artifactsDir
 }
 
+// Deadline returns the time at which the test times out, i.e. its Timeout
+// after it started, or shortly before its cluster expires, whichever comes
+// first. ok is false if the test isn't running on a cluster, e.g. in unit
+// tests.
+func (t *test) Deadline() (deadline time.Time, ok bool) {
+	return t.deadline, !t.deadline.IsZero()
+}
+
 // IsBuildVersion returns true if the build version is greater than or equal to
 // minVersion. This allows a test to optionally perform additional checks
 // depending on the cockroach version it is running against. Note that the
@@ -1031,9 +1168,17 @@ func (r *registry) runAsync(
 					}
 					name += "-" + t.Name()
 				}
+				nodes := t.spec.Cluster
+				if soakDuration > 0 {
+					// Make sure the cluster outlives the soak.
+					if nodes.Lifetime == 0 {
+						nodes.Lifetime = defaultClusterLifetime
+					}
+					nodes.Lifetime += soakDuration
+				}
 				cfg := clusterConfig{
 					name:         name,
-					nodes:        t.spec.Cluster,
+					nodes:        nodes,
 					useIOBarrier: t.spec.UseIOBarrier,
 					artifactsDir: t.ArtifactsDir(),
 					localCluster: local,
@@ -1131,9 +1276,16 @@ func (r *registry) runAsync(
 			return
 		}
 
-		if t.spec.Timeout > 0 && timeout > t.spec.Timeout {
-			timeout = t.spec.Timeout
+		if t.spec.Timeout > 0 {
+			limit := t.spec.Timeout
+			if soakDuration > 0 {
+				limit += soakDuration
+			}
+			if timeout > limit {
+				timeout = limit
+			}
 		}
+		t.deadline = timeutil.Now().Add(timeout)
 
 		done := make(chan struct{})
 		defer close(done)
@@ -18,6 +18,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"regexp"
@@ -434,6 +435,34 @@ func TestRegistryPrepareSpec(t *testing.T) {
 			"a: unable to parse min-version: invalid version string 'foo'",
 			nil,
 		},
+		{
+			testSpec{
+				Name:       "a",
+				MaxVersion: "v2.1.0-foo",
+				Run:        dummyRun,
+			},
+			regexp.QuoteMeta(`invalid version v2.1.0-foo, cannot specify a prerelease (-xxx)`),
+			nil,
+		},
+		{
+			testSpec{
+				Name:       "a",
+				MaxVersion: "foo",
+				Run:        dummyRun,
+			},
+			"a: unable to parse max-version: invalid version string 'foo'",
+			nil,
+		},
+		{
+			testSpec{
+				Name:       "a",
+				MinVersion: "v2.1.0",
+				MaxVersion: "v2.0.3",
+				Run:        dummyRun,
+			},
+			"a: min-version v2.1.0 is greater than max-version v2.0.3",
+			nil,
+		},
 		{
 			testSpec{
 				Name:    "a",
@@ -506,3 +535,97 @@ func TestRegistryMinVersion(t *testing.T) {
 		})
 	}
 }
+
+func TestRegistryVersionSkipReason(t *testing.T) {
+	testCases := []struct {
+		buildVersion string
+		minVersion   string
+		maxVersion   string
+		expected     string
+	}{
+		{"v2.0.3", "", "", ""},
+		{"v2.0.3", "v2.1.0", "", "requires v2.1.0, cluster is v2.0.3"},
+		{"v2.1.0", "v2.1.0", "", ""},
+		{"v2.1.1", "v2.1.0", "", ""},
+		{"v2.2.0", "v2.1.0", "", ""},
+		// Prereleases of the min-version satisfy it, but prereleases of older
+		// versions don't.
+		{"v2.1.0-alpha.20180702", "v2.1.0", "", ""},
+		{"v2.1.0-beta.20180910-12-gabcdef", "v2.1.0", "", ""},
+		{"v2.0.0-alpha.20180702", "v2.1.0", "", "requires v2.1.0, cluster is v2.0.0-alpha.20180702"},
+		{"v2.0.99-rc.1", "v2.1.0", "", "requires v2.1.0, cluster is v2.0.99-rc.1"},
+		{"v2.0.3", "", "v2.0.3", ""},
+		{"v2.0.3", "", "v2.1.0", ""},
+		{"v2.1.0-alpha.20180702", "", "v2.1.0", ""},
+		{"v2.1.0", "", "v2.0.3", "requires at most v2.0.3, cluster is v2.1.0"},
+		{"v2.0.4-alpha.1", "", "v2.0.3", "requires at most v2.0.3, cluster is v2.0.4-alpha.1"},
+		{"v2.0.3", "v2.0.0", "v2.1.0", ""},
+		{"v1.1.0", "v2.0.0", "v2.1.0", "requires v2.0.0, cluster is v1.1.0"},
+		{"v2.2.0", "v2.0.0", "v2.1.0", "requires at most v2.1.0, cluster is v2.2.0"},
+	}
+	for _, c := range testCases {
+		t.Run(c.buildVersion+"/"+c.minVersion+"/"+c.maxVersion, func(t *testing.T) {
+			r := newRegistry()
+			if err := r.setBuildVersion(c.buildVersion); err != nil {
+				t.Fatal(err)
+			}
+			spec := testSpec{
+				Name:       "a",
+				MinVersion: c.minVersion,
+				MaxVersion: c.maxVersion,
+				Run:        func(ctx context.Context, t *test, c *cluster) {},
+			}
+			if err := r.prepareSpec(&spec, 0 /* depth */); err != nil {
+				t.Fatal(err)
+			}
+			if reason := r.versionSkipReason(&spec); reason != c.expected {
+				t.Fatalf("expected %q, but found %q", c.expected, reason)
+			}
+		})
+	}
+}
+
+func TestRegistryWriteMatrix(t *testing.T) {
+	r := newRegistry()
+	r.Add(testSpec{
+		Name:       "kv/nodes=3",
+		Cluster:    makeClusterSpec(4, cpu(8)),
+		MinVersion: "v2.1.0",
+		Timeout:    time.Hour,
+		Run:        func(ctx context.Context, t *test, c *cluster) {},
+	})
+	r.Add(testSpec{
+		Name:    "parent",
+		Cluster: makeClusterSpec(3, geo(), zones("us-east1-b,us-west1-b")),
+		Tags:    []string{"weekly"},
+		SubTests: []testSpec{{
+			Name: "child",
+			Run:  func(ctx context.Context, t *test, c *cluster) {},
+		}},
+	})
+
+	var buf bytes.Buffer
+	if err := r.WriteMatrix(&buf, nil /* filters */, false /* asJSON */); err != nil {
+		t.Fatal(err)
+	}
+	const expected = `NAME          CLUSTER     ZONES                  MIN-VERSION  MAX-VERSION  TIMEOUT  TAGS
+kv/nodes=3    n4cpu8      -                      v2.1.0       -            1h0m0s   -
+parent        n3cpu4-geo  us-east1-b,us-west1-b  -            -            -        weekly
+parent/child  n3cpu4-geo  us-east1-b,us-west1-b  -            -            -        -
+`
+	if s := buf.String(); s != expected {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, s)
+	}
+
+	buf.Reset()
+	if err := r.WriteMatrix(&buf, []string{"kv"}, true /* asJSON */); err != nil {
+		t.Fatal(err)
+	}
+	var entries []testMatrixEntry
+	if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "kv/nodes=3" || entries[0].Timeout != "1h0m0s" {
+		t.Fatalf("expected only kv/nodes=3, found %+v", entries)
+	}
+}
@@ -20,7 +20,6 @@ import (
 	"context"
 	"fmt"
 	"math"
-	"math/rand"
 	"strconv"
 	"strings"
 	"time"
@@ -189,7 +188,8 @@ func registerTPCC(r *registry) {
 							Period:   45 * time.Second,
 							DownTime: 10 * time.Second,
 						},
-						Target:       func() nodeListOption { return c.Node(1 + rand.Intn(c.nodes-1)) },
+						// Kill whichever node holds the system range leases.
+						Target:       systemLeasesTarget(ctx, c, c.Range(1, c.nodes-1)),
 						Stopper:      time.After(duration),
 						DrainAndQuit: false,
 					}
@@ -0,0 +1,243 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// workloadHandleSeq numbers the workload handles, so that each of them can
+// tell its process apart from any other workload running on the same node.
+var workloadHandleSeq int32
+
+// workloadHandle is a handle on a `./workload run` process which allows the
+// load to be paused and resumed while the test injects faults. The process is
+// paused and resumed by sending it SIGSTOP and SIGCONT respectively.
+//
+// The handle owns the duration of the workload: the command must not specify
+// --duration. Instead, the handle interrupts the workload once it has been
+// running (i.e. not paused) for the requested duration, so that time spent
+// paused does not count against it.
+type workloadHandle struct {
+	c        *cluster
+	node     nodeListOption
+	cmd      string
+	duration time.Duration
+	// pidFile is the file, on node, to which the process writes its PID as it
+	// starts. Only that process is signaled.
+	pidFile string
+	// started is closed once the process has been launched.
+	started chan struct{}
+
+	mu struct {
+		syncutil.Mutex
+		clock workloadClock
+	}
+}
+
+func newWorkloadHandle(
+	c *cluster, node nodeListOption, cmd string, duration time.Duration,
+) *workloadHandle {
+	h := &workloadHandle{
+		c:        c,
+		node:     node,
+		cmd:      cmd,
+		duration: duration,
+		pidFile:  fmt.Sprintf("workload-%d.pid", atomic.AddInt32(&workloadHandleSeq, 1)),
+		started:  make(chan struct{}),
+	}
+	h.mu.clock.now = timeutil.Now
+	return h
+}
+
+// GoWorkload runs the given workload command on node as one of the monitor's
+// workers, for the given duration of unpaused time. The returned handle can be
+// used to pause and resume the workload, as can PauseWorkloads and
+// ResumeWorkloads.
+func (m *monitor) GoWorkload(
+	c *cluster, node nodeListOption, cmd string, duration time.Duration,
+) *workloadHandle {
+	h := newWorkloadHandle(c, node, cmd, duration)
+	m.mu.Lock()
+	m.mu.workloads = append(m.mu.workloads, h)
+	m.mu.Unlock()
+	m.Go(h.run)
+	return h
+}
+
+// PauseWorkloads pauses all the workloads started with GoWorkload.
+func (m *monitor) PauseWorkloads(ctx context.Context) error {
+	m.mu.Lock()
+	workloads := m.mu.workloads
+	m.mu.Unlock()
+	for _, h := range workloads {
+		if err := h.Pause(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResumeWorkloads resumes all the workloads started with GoWorkload.
+func (m *monitor) ResumeWorkloads(ctx context.Context) error {
+	m.mu.Lock()
+	workloads := m.mu.workloads
+	m.mu.Unlock()
+	for _, h := range workloads {
+		if err := h.Resume(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitStarted waits for the workload process to be launched.
+func (h *workloadHandle) waitStarted(ctx context.Context) error {
+	select {
+	case <-h.started:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// signal sends sig to the workload process. A process which was only just
+// launched is given a few seconds to write its PID file.
+func (h *workloadHandle) signal(ctx context.Context, sig string) error {
+	return h.c.RunE(ctx, h.node, fmt.Sprintf(
+		"for i in $(seq 10); do test -s %[1]s && break; sleep 1; done; kill -%[2]s $(cat %[1]s)",
+		h.pidFile, sig))
+}
+
+// Pause suspends the workload process, waiting for it to be launched if need
+// be. Calling Pause on a paused workload is a no-op.
+func (h *workloadHandle) Pause(ctx context.Context) error {
+	if err := h.waitStarted(ctx); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.mu.clock.paused {
+		return nil
+	}
+	if err := h.signal(ctx, "STOP"); err != nil {
+		return err
+	}
+	h.mu.clock.pause()
+	return nil
+}
+
+// Resume continues a workload process previously suspended by Pause. Calling
+// Resume on a workload which isn't paused is a no-op.
+func (h *workloadHandle) Resume(ctx context.Context) error {
+	if err := h.waitStarted(ctx); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.mu.clock.paused {
+		return nil
+	}
+	if err := h.signal(ctx, "CONT"); err != nil {
+		return err
+	}
+	h.mu.clock.resume()
+	return nil
+}
+
+// remaining returns the amount of unpaused time the workload still has to run.
+func (h *workloadHandle) remaining() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.duration - h.mu.clock.elapsed()
+}
+
+func (h *workloadHandle) run(ctx context.Context) error {
+	h.mu.Lock()
+	h.mu.clock.start()
+	h.mu.Unlock()
+
+	errCh := make(chan error, 1)
+	go func() {
+		// The process takes over the shell, and with it the PID written to the
+		// PID file.
+		errCh <- h.c.RunE(ctx, h.node, fmt.Sprintf(
+			"rm -f %[1]s && echo $$ > %[1]s && exec %[2]s", h.pidFile, h.cmd))
+	}()
+	close(h.started)
+
+	for {
+		select {
+		case err := <-errCh:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(h.remaining()):
+			if h.remaining() > 0 {
+				// The workload was paused in the meantime.
+				continue
+			}
+		}
+		// Make sure the process can handle the interrupt, then let it shut down
+		// gracefully so that it prints its summary and flushes its histograms.
+		if err := h.Resume(ctx); err != nil {
+			return err
+		}
+		if err := h.signal(ctx, "INT"); err != nil {
+			return err
+		}
+		return <-errCh
+	}
+}
+
+// workloadClock measures the time a workload has been running for, not
+// counting the time it spent paused. It is not safe for concurrent use.
+type workloadClock struct {
+	now       func() time.Time
+	started   time.Time
+	paused    bool
+	pausedAt  time.Time
+	pausedFor time.Duration
+}
+
+func (c *workloadClock) start() {
+	c.started = c.now()
+}
+
+func (c *workloadClock) pause() {
+	c.paused = true
+	c.pausedAt = c.now()
+}
+
+func (c *workloadClock) resume() {
+	c.paused = false
+	c.pausedFor += c.now().Sub(c.pausedAt)
+}
+
+// elapsed returns the unpaused time since the clock was started.
+func (c *workloadClock) elapsed() time.Duration {
+	paused := c.pausedFor
+	if c.paused {
+		paused += c.now().Sub(c.pausedAt)
+	}
+	return c.now().Sub(c.started) - paused
+}
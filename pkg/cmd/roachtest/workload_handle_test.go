@@ -0,0 +1,59 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkloadHandleRemaining(t *testing.T) {
+	now := time.Date(2018, 11, 1, 0, 0, 0, 0, time.UTC)
+	h := newWorkloadHandle(nil /* c */, nil /* node */, "./workload run kv", 10*time.Minute)
+	h.mu.clock.now = func() time.Time { return now }
+	h.mu.clock.start()
+
+	// Each step advances the clock by the given amount of time, and then pauses
+	// or resumes the workload if requested.
+	for i, step := range []struct {
+		advance   time.Duration
+		pause     bool
+		resume    bool
+		remaining time.Duration
+	}{
+		{advance: 0, remaining: 10 * time.Minute},
+		{advance: 2 * time.Minute, remaining: 8 * time.Minute},
+		{advance: time.Minute, pause: true, remaining: 7 * time.Minute},
+		// Time spent paused doesn't count, whether the workload is still
+		// paused or not.
+		{advance: 5 * time.Minute, remaining: 7 * time.Minute},
+		{advance: time.Minute, resume: true, remaining: 7 * time.Minute},
+		{advance: 3 * time.Minute, pause: true, remaining: 4 * time.Minute},
+		{advance: time.Hour, resume: true, remaining: 4 * time.Minute},
+		{advance: 5 * time.Minute, remaining: -time.Minute},
+	} {
+		now = now.Add(step.advance)
+		if step.pause {
+			h.mu.clock.pause()
+		}
+		if step.resume {
+			h.mu.clock.resume()
+		}
+		if r := h.remaining(); r != step.remaining {
+			t.Errorf("%d: expected %s remaining, found %s", i, step.remaining, r)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// workloadTick is one of the periodic progress lines printed by `./workload
+// run`, e.g.
+//
+//	_elapsed___errors__ops/sec(inst)___ops/sec(cum)__p50(ms)__p95(ms)__p99(ms)_pMax(ms)
+//	     10s        0         4005.9         3987.2      0.9      2.2      4.5     11.5 write
+//
+// Workloads with several operation types print one line per type and
+// interval.
+type workloadTick struct {
+	Elapsed      time.Duration
+	Errors       int
+	OpsPerSec    float64
+	CumOpsPerSec float64
+	P50, P95     float64
+	P99, PMax    float64
+	Name         string
+}
+
+// parseWorkloadTick parses a periodic progress line. It returns false if line
+// is not one, e.g. because it is a header or part of the final summary.
+func parseWorkloadTick(line string) (workloadTick, bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 9 {
+		return workloadTick{}, false
+	}
+	var tick workloadTick
+	var err error
+	if tick.Elapsed, err = time.ParseDuration(fields[0]); err != nil {
+		return workloadTick{}, false
+	}
+	if tick.Errors, err = strconv.Atoi(fields[1]); err != nil {
+		return workloadTick{}, false
+	}
+	for i, v := range []*float64{
+		&tick.OpsPerSec, &tick.CumOpsPerSec, &tick.P50, &tick.P95, &tick.P99, &tick.PMax,
+	} {
+		if *v, err = strconv.ParseFloat(fields[i+2], 64); err != nil {
+			return workloadTick{}, false
+		}
+	}
+	tick.Name = fields[8]
+	return tick, true
+}
+
+// workloadProgress is an io.Writer which parses the progress lines written to
+// it by a running workload. It keeps track of the latest progress and can
+// optionally publish every tick on a channel.
+type workloadProgress struct {
+	// ticks, if set, receives every parsed tick. Ticks are dropped rather than
+	// blocking the workload's output when the channel is full.
+	ticks chan<- workloadTick
+
+	mu struct {
+		syncutil.Mutex
+		partial []byte
+		// latest holds the most recent tick of each operation type.
+		latest map[string]workloadTick
+	}
+}
+
+func newWorkloadProgress(ticks chan<- workloadTick) *workloadProgress {
+	p := &workloadProgress{ticks: ticks}
+	p.mu.latest = make(map[string]workloadTick)
+	return p
+}
+
+// Write implements io.Writer.
+func (p *workloadProgress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mu.partial = append(p.mu.partial, b...)
+	for {
+		i := bytes.IndexByte(p.mu.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(p.mu.partial[:i])
+		p.mu.partial = p.mu.partial[i+1:]
+		tick, ok := parseWorkloadTick(line)
+		if !ok {
+			continue
+		}
+		p.mu.latest[tick.Name] = tick
+		if p.ticks != nil {
+			select {
+			case p.ticks <- tick:
+			default:
+			}
+		}
+	}
+	return len(b), nil
+}
+
+// OpsPerSec returns the throughput of the workload over its latest progress
+// interval, summed over all operation types.
+func (p *workloadProgress) OpsPerSec() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var latest time.Duration
+	for _, tick := range p.mu.latest {
+		if tick.Elapsed > latest {
+			latest = tick.Elapsed
+		}
+	}
+	var sum float64
+	for _, tick := range p.mu.latest {
+		// Operation types which didn't report in the latest interval had no
+		// throughput.
+		if tick.Elapsed == latest {
+			sum += tick.OpsPerSec
+		}
+	}
+	return sum
+}
+
+// RunWithProgress runs a workload command on node like Run, while feeding its
+// output to p as it is produced. The output also goes to the test log as
+// usual.
+func (c *cluster) RunWithProgress(
+	ctx context.Context, node nodeListOption, p *workloadProgress, args ...string,
+) error {
+	return c.RunL(ctx, c.l.teeStdout(p), node, args...)
+}
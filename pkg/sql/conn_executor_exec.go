@@ -1392,7 +1392,9 @@ func (ex *connExecutor) addActiveQuery(
 	ex.mu.Lock()
 	ex.mu.ActiveQueries[queryID] = qm
 	ex.mu.Unlock()
+	ex.metrics.EngineMetrics.SQLStatementsActive.Inc(1)
 	return func() {
+		ex.metrics.EngineMetrics.SQLStatementsActive.Dec(1)
 		ex.mu.Lock()
 		_, ok := ex.mu.ActiveQueries[queryID]
 		if !ok {
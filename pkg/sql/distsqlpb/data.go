@@ -15,28 +15,51 @@
 package distsqlpb
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/pkg/errors"
 )
 
 // ConvertToColumnOrdering converts an Ordering type (as defined in data.proto)
-// to a sqlbase.ColumnOrdering type.
+// to a sqlbase.ColumnOrdering type. It panics if the ordering is invalid, see
+// ConvertToColumnOrderingE.
 func ConvertToColumnOrdering(specOrdering Ordering) sqlbase.ColumnOrdering {
+	ordering, err := ConvertToColumnOrderingE(specOrdering)
+	if err != nil {
+		panic(err)
+	}
+	return ordering
+}
+
+// ConvertToColumnOrderingE is like ConvertToColumnOrdering, but returns an
+// error if a column has a direction which is neither ASC nor DESC, e.g. one
+// sent by a node with an incompatible version. Note that an unset direction
+// can't be told apart from ASC, which is the zero value.
+func ConvertToColumnOrderingE(specOrdering Ordering) (sqlbase.ColumnOrdering, error) {
 	ordering := make(sqlbase.ColumnOrdering, len(specOrdering.Columns))
 	for i, c := range specOrdering.Columns {
 		ordering[i].ColIdx = int(c.ColIdx)
-		if c.Direction == Ordering_Column_ASC {
+		switch c.Direction {
+		case Ordering_Column_ASC:
 			ordering[i].Direction = encoding.Ascending
-		} else {
+		case Ordering_Column_DESC:
 			ordering[i].Direction = encoding.Descending
+		default:
+			return nil, errors.Errorf("invalid direction %d of column %d in ordering",
+				c.Direction, c.ColIdx)
 		}
 	}
-	return ordering
+	return ordering, nil
 }
 
 // ConvertToSpecOrdering converts a sqlbase.ColumnOrdering type
@@ -50,6 +73,16 @@ func ConvertToSpecOrdering(columnOrdering sqlbase.ColumnOrdering) Ordering {
 // indices contained in planToStreamColMap.
 func ConvertToMappedSpecOrdering(
 	columnOrdering sqlbase.ColumnOrdering, planToStreamColMap []int,
+) Ordering {
+	return ConvertToMappedSpecOrderingWithOffset(columnOrdering, planToStreamColMap, 0 /* offset */)
+}
+
+// ConvertToMappedSpecOrderingWithOffset is like ConvertToMappedSpecOrdering,
+// but shifts the resulting column indices by offset. This is useful when the
+// stream the ordering refers to is part of a larger row, e.g. the right side
+// of a join.
+func ConvertToMappedSpecOrderingWithOffset(
+	columnOrdering sqlbase.ColumnOrdering, planToStreamColMap []int, offset int,
 ) Ordering {
 	specOrdering := Ordering{}
 	specOrdering.Columns = make([]Ordering_Column, len(columnOrdering))
@@ -61,7 +94,7 @@ func ConvertToMappedSpecOrdering(
 				panic(fmt.Sprintf("column %d in sort ordering not available", c.ColIdx))
 			}
 		}
-		specOrdering.Columns[i].ColIdx = uint32(colIdx)
+		specOrdering.Columns[i].ColIdx = uint32(colIdx + offset)
 		if c.Direction == encoding.Ascending {
 			specOrdering.Columns[i].Direction = Ordering_Column_ASC
 		} else {
@@ -71,16 +104,124 @@ func ConvertToMappedSpecOrdering(
 	return specOrdering
 }
 
+// MakeOrdering returns the ordering on the given columns, for use in tests,
+// e.g. MakeOrdering(Asc(0), Desc(2)). The ordering uses cols as is, without
+// copying it.
+func MakeOrdering(cols ...Ordering_Column) Ordering {
+	return Ordering{Columns: cols}
+}
+
+// Asc returns the ordering column which sorts on column colIdx ascendingly.
+func Asc(colIdx uint32) Ordering_Column {
+	return Ordering_Column{ColIdx: colIdx, Direction: Ordering_Column_ASC}
+}
+
+// Desc returns the ordering column which sorts on column colIdx descendingly.
+func Desc(colIdx uint32) Ordering_Column {
+	return Ordering_Column{ColIdx: colIdx, Direction: Ordering_Column_DESC}
+}
+
+// Equals returns whether the two orderings are identical, i.e. consist of the
+// same columns in the same order with the same directions.
+func (o Ordering) Equals(other Ordering) bool {
+	if len(o.Columns) != len(other.Columns) {
+		return false
+	}
+	for i, c := range o.Columns {
+		if c.ColIdx != other.Columns[i].ColIdx || c.Direction != other.Columns[i].Direction {
+			return false
+		}
+	}
+	return true
+}
+
+// IsPrefixOf returns whether o is a prefix of other, i.e. whether other starts
+// with the columns of o, in the same order and with the same directions. Rows
+// ordered according to other are then also ordered according to o, so a sort
+// on o can be skipped. The empty ordering is a prefix of any ordering.
+func (o Ordering) IsPrefixOf(other Ordering) bool {
+	if len(o.Columns) > len(other.Columns) {
+		return false
+	}
+	for i, c := range o.Columns {
+		if c.ColIdx != other.Columns[i].ColIdx || c.Direction != other.Columns[i].Direction {
+			return false
+		}
+	}
+	return true
+}
+
+// Normalize returns an equivalent ordering without duplicate columns. Only the
+// first occurrence of a column is kept, since rows which are equal on all the
+// columns before a later occurrence are also equal on that column, whatever
+// its direction.
+func (o Ordering) Normalize() Ordering {
+	var seen util.FastIntSet
+	normalized := Ordering{Columns: make([]Ordering_Column, 0, len(o.Columns))}
+	for _, c := range o.Columns {
+		if seen.Contains(int(c.ColIdx)) {
+			continue
+		}
+		seen.Add(int(c.ColIdx))
+		normalized.Columns = append(normalized.Columns, c)
+	}
+	return normalized
+}
+
+// Reverse returns the ordering which sorts rows the other way around, i.e. the
+// ordering with the direction of every column flipped, as needed when reading
+// an index backwards.
+func (o Ordering) Reverse() Ordering {
+	reversed := Ordering{Columns: make([]Ordering_Column, len(o.Columns))}
+	for i, c := range o.Columns {
+		reversed.Columns[i] = c
+		if c.Direction == Ordering_Column_ASC {
+			reversed.Columns[i].Direction = Ordering_Column_DESC
+		} else {
+			reversed.Columns[i].Direction = Ordering_Column_ASC
+		}
+	}
+	return reversed
+}
+
+// String implements the fmt.Stringer interface. The columns are listed with
+// their directions, as + or -, and 1-based ordinal references, as used in
+// expressions, e.g. +@1,-@3.
+func (o Ordering) String() string {
+	var buf bytes.Buffer
+	for i, c := range o.Columns {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if c.Direction == Ordering_Column_ASC {
+			buf.WriteByte('+')
+		} else {
+			buf.WriteByte('-')
+		}
+		fmt.Fprintf(&buf, "@%d", c.ColIdx+1)
+	}
+	return buf.String()
+}
+
 // ExprFmtCtxBase produces a FmtCtx used for serializing expressions; a proper
 // IndexedVar formatting function needs to be added on. It replaces placeholders
 // with their values.
 func ExprFmtCtxBase(evalCtx *tree.EvalContext) *tree.FmtCtx {
+	return exprFmtCtx(evalCtx, func(err error) {
+		panic(fmt.Sprintf("failed to serialize placeholder: %s", err))
+	})
+}
+
+// exprFmtCtx is like ExprFmtCtxBase, but passes the errors from evaluating
+// placeholders to onErr, and formats nothing for such placeholders.
+func exprFmtCtx(evalCtx *tree.EvalContext, onErr func(error)) *tree.FmtCtx {
 	fmtCtx := tree.NewFmtCtx(tree.FmtCheckEquivalence)
 	fmtCtx.WithPlaceholderFormat(
 		func(fmtCtx *tree.FmtCtx, p *tree.Placeholder) {
 			d, err := p.Eval(evalCtx)
 			if err != nil {
-				panic(fmt.Sprintf("failed to serialize placeholder: %s", err))
+				onErr(err)
+				return
 			}
 			d.Format(fmtCtx)
 		})
@@ -90,9 +231,9 @@ func ExprFmtCtxBase(evalCtx *tree.EvalContext) *tree.FmtCtx {
 // Expression is the representation of a SQL expression.
 // See data.proto for the corresponding proto definition. Its automatic type
 // declaration is suppressed in the proto via the typedecl=false option, so that
-// we can add the LocalExpr field which is not serialized. It never needs to be
-// serialized because we only use it in the case where we know we won't need to
-// send it, as a proto, to another machine.
+// we can add the LocalExpr field which is not serialized. It is only set when
+// we expect not to need to send the expression, as a proto, to another machine;
+// EnsureSerialized must be used if that changes.
 type Expression struct {
 	// Version is unused.
 	Version string
@@ -125,6 +266,140 @@ func (e Expression) String() string {
 	return "none"
 }
 
+// MarshalJSON implements the json.Marshaler interface. The expression is
+// marshaled as {"expr": "..."}, with the text returned by String, so that
+// tools see the same expression whether it's local or has been serialized.
+// The empty expression is marshaled with an empty text.
+func (e Expression) MarshalJSON() ([]byte, error) {
+	var s string
+	if !e.Empty() {
+		s = e.String()
+	}
+	return json.Marshal(struct {
+		Expr string `json:"expr"`
+	}{s})
+}
+
+// EnsureSerialized fills in Expr from LocalExpr if the expression only has the
+// latter, so that the Expression can be sent to another node. Placeholders are
+// replaced with their values, which are evaluated using evalCtx. The
+// Expression is left unchanged if an error is returned.
+func (e *Expression) EnsureSerialized(evalCtx *tree.EvalContext) error {
+	if e.Expr != "" || e.LocalExpr == nil {
+		return nil
+	}
+	// Unlike ExprFmtCtxBase, we return the errors from evaluating placeholders
+	// rather than panicking.
+	var err error
+	fmtCtx := exprFmtCtx(evalCtx, func(evalErr error) {
+		if err == nil {
+			err = evalErr
+		}
+	})
+	fmtCtx.WithIndexedVarFormat(func(ctx *tree.FmtCtx, idx int) {
+		ctx.Printf("@%d", idx+1)
+	})
+	fmtCtx.FormatNode(e.LocalExpr)
+	s := fmtCtx.CloseAndGetString()
+	if err != nil {
+		return errors.Wrapf(err, "serializing %s", e)
+	}
+	e.Expr = s
+	return nil
+}
+
+// Validate checks that the ordinal references (@1, @2, ...) of the expression
+// all refer to one of the numInputCols input columns. Expr is parsed unless
+// the expression has a LocalExpr, which is checked instead.
+func (e *Expression) Validate(numInputCols int) error {
+	var expr tree.Expr = e.LocalExpr
+	if e.LocalExpr == nil {
+		if e.Expr == "" {
+			return nil
+		}
+		var err error
+		if expr, err = parser.ParseExpr(e.Expr); err != nil {
+			return err
+		}
+	}
+	v := ordinalValidator{numInputCols: numInputCols}
+	tree.WalkExprConst(&v, expr)
+	return v.err
+}
+
+// IsConstant returns whether the expression doesn't refer to any of its input
+// columns, i.e. its value is the same for all rows once its placeholders are
+// replaced. The empty expression is constant. Expr is only scanned for ordinal
+// references (@1, @2, ...) rather than parsed, and LocalExpr, if set, is
+// walked for IndexedVars instead.
+func (e *Expression) IsConstant() bool {
+	if e.LocalExpr != nil {
+		var v ordinalFinder
+		tree.WalkExprConst(&v, e.LocalExpr)
+		return !v.found
+	}
+	return !hasOrdinalReference(e.Expr)
+}
+
+// hasOrdinalReference returns whether the SQL text of an expression contains
+// an ordinal reference, i.e. an @ followed by a digit outside of string
+// literals and quoted identifiers.
+func hasOrdinalReference(expr string) bool {
+	for i := 0; i < len(expr); i++ {
+		switch c := expr[i]; c {
+		case '\'', '"':
+			// Skip to the closing quote. A doubled quote is an escaped quote,
+			// which this handles as two consecutive quoted strings.
+			for i++; i < len(expr) && expr[i] != c; i++ {
+			}
+		case '@':
+			if i+1 < len(expr) && expr[i+1] >= '0' && expr[i+1] <= '9' {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ordinalFinder is a tree.Visitor that finds whether an expression has any
+// IndexedVars.
+type ordinalFinder struct {
+	found bool
+}
+
+func (v *ordinalFinder) VisitPre(expr tree.Expr) (recurse bool, newExpr tree.Expr) {
+	if _, ok := expr.(*tree.IndexedVar); ok {
+		v.found = true
+	}
+	return !v.found, expr
+}
+
+func (*ordinalFinder) VisitPost(expr tree.Expr) tree.Expr { return expr }
+
+// ordinalValidator is a tree.Visitor that checks that all the IndexedVars of
+// an expression are within range.
+type ordinalValidator struct {
+	numInputCols int
+	err          error
+}
+
+func (v *ordinalValidator) VisitPre(expr tree.Expr) (recurse bool, newExpr tree.Expr) {
+	if v.err != nil {
+		return false, expr
+	}
+	if ivar, ok := expr.(*tree.IndexedVar); ok {
+		if ivar.Idx < 0 || ivar.Idx >= v.numInputCols {
+			v.err = pgerror.NewErrorf(pgerror.CodeUndefinedColumnError,
+				"invalid column ordinal @%d: the expression has %d input columns",
+				ivar.Idx+1, v.numInputCols)
+		}
+		return false, expr
+	}
+	return true, expr
+}
+
+func (*ordinalValidator) VisitPost(expr tree.Expr) tree.Expr { return expr }
+
 // String implements fmt.Stringer.
 func (e *Error) String() string {
 	if err := e.ErrorDetail(); err != nil {
@@ -134,16 +409,23 @@ func (e *Error) String() string {
 }
 
 // NewError creates an Error from an error, to be sent on the wire. It will
-// recognize certain errors and marshall them accordingly, and everything
-// unrecognized is turned into a PGError with code "internal".
+// recognize certain errors, even when wrapped, and marshall them accordingly,
+// and everything unrecognized is turned into a PGError with code "internal".
 func NewError(err error) *Error {
 	if pgErr, ok := pgerror.GetPGCause(err); ok {
 		return &Error{Detail: &Error_PGError{PGError: pgErr}}
-	} else if retryErr, ok := err.(*roachpb.UnhandledRetryableError); ok {
+	} else if retryErr, ok := errors.Cause(err).(*roachpb.UnhandledRetryableError); ok {
 		return &Error{
 			Detail: &Error_RetryableTxnError{
 				RetryableTxnError: retryErr,
 			}}
+	} else if cause := errors.Cause(err); cause == context.Canceled || cause == context.DeadlineExceeded {
+		// Postgres uses the same code for queries canceled by the user and
+		// for those that timed out.
+		return &Error{
+			Detail: &Error_PGError{
+				PGError: pgerror.NewError(
+					pgerror.CodeQueryCanceledError, err.Error())}}
 	} else {
 		// Anything unrecognized is an "internal error".
 		return &Error{
@@ -0,0 +1,655 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlpb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/types"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/pkg/errors"
+)
+
+func TestConvertToMappedSpecOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	asc, desc := Ordering_Column_ASC, Ordering_Column_DESC
+	columnOrdering := sqlbase.ColumnOrdering{
+		{ColIdx: 2, Direction: encoding.Ascending},
+		{ColIdx: 0, Direction: encoding.Descending},
+	}
+
+	testCases := []struct {
+		name               string
+		planToStreamColMap []int
+		offset             int
+		expected           Ordering
+	}{
+		{
+			name:     "unmapped",
+			expected: Ordering{Columns: []Ordering_Column{{ColIdx: 2, Direction: asc}, {ColIdx: 0, Direction: desc}}},
+		},
+		{
+			name:               "mapped",
+			planToStreamColMap: []int{1, -1, 0},
+			expected:           Ordering{Columns: []Ordering_Column{{ColIdx: 0, Direction: asc}, {ColIdx: 1, Direction: desc}}},
+		},
+		{
+			name:     "unmapped with offset",
+			offset:   3,
+			expected: Ordering{Columns: []Ordering_Column{{ColIdx: 5, Direction: asc}, {ColIdx: 3, Direction: desc}}},
+		},
+		{
+			name:               "mapped with offset",
+			planToStreamColMap: []int{1, -1, 0},
+			offset:             3,
+			expected:           Ordering{Columns: []Ordering_Column{{ColIdx: 3, Direction: asc}, {ColIdx: 4, Direction: desc}}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := ConvertToMappedSpecOrderingWithOffset(columnOrdering, tc.planToStreamColMap, tc.offset)
+			if !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("expected %v, found %v", tc.expected, result)
+			}
+			if tc.offset == 0 {
+				if result := ConvertToMappedSpecOrdering(columnOrdering, tc.planToStreamColMap); !reflect.DeepEqual(result, tc.expected) {
+					t.Errorf("ConvertToMappedSpecOrdering: expected %v, found %v", tc.expected, result)
+				}
+			}
+		})
+	}
+
+	t.Run("unavailable column", func(t *testing.T) {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("expected a panic for a column missing from the stream")
+			}
+		}()
+		ConvertToMappedSpecOrderingWithOffset(
+			sqlbase.ColumnOrdering{{ColIdx: 1, Direction: encoding.Ascending}}, []int{0, -1}, 3 /* offset */)
+	})
+}
+
+func TestConvertToColumnOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ordering := Ordering{Columns: []Ordering_Column{
+		{ColIdx: 1, Direction: Ordering_Column_DESC},
+		// An unset direction is the zero value, i.e. ASC.
+		{ColIdx: 0},
+	}}
+	expected := sqlbase.ColumnOrdering{
+		{ColIdx: 1, Direction: encoding.Descending},
+		{ColIdx: 0, Direction: encoding.Ascending},
+	}
+	columnOrdering, err := ConvertToColumnOrderingE(ordering)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(columnOrdering, expected) {
+		t.Errorf("expected %+v, found %+v", expected, columnOrdering)
+	}
+	if columnOrdering := ConvertToColumnOrdering(ordering); !reflect.DeepEqual(columnOrdering, expected) {
+		t.Errorf("ConvertToColumnOrdering: expected %+v, found %+v", expected, columnOrdering)
+	}
+
+	invalid := Ordering{Columns: []Ordering_Column{
+		{ColIdx: 0, Direction: Ordering_Column_ASC},
+		{ColIdx: 2, Direction: Ordering_Column_Direction(7)},
+	}}
+	if _, err := ConvertToColumnOrderingE(invalid); !testutils.IsError(err,
+		`invalid direction 7 of column 2 in ordering`) {
+		t.Errorf("expected an invalid direction error, found %v", err)
+	}
+	t.Run("panic", func(t *testing.T) {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("expected a panic for an invalid direction")
+			}
+		}()
+		ConvertToColumnOrdering(invalid)
+	})
+}
+
+func TestMakeOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	testCases := []struct {
+		ordering Ordering
+		expected sqlbase.ColumnOrdering
+	}{
+		{MakeOrdering(), sqlbase.ColumnOrdering{}},
+		{MakeOrdering(Asc(0)), sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}},
+		{
+			MakeOrdering(Asc(0), Desc(2), Asc(1)),
+			sqlbase.ColumnOrdering{
+				{ColIdx: 0, Direction: encoding.Ascending},
+				{ColIdx: 2, Direction: encoding.Descending},
+				{ColIdx: 1, Direction: encoding.Ascending},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		columnOrdering := ConvertToColumnOrdering(tc.ordering)
+		if !reflect.DeepEqual(columnOrdering, tc.expected) {
+			t.Errorf("%s: expected %+v, found %+v", tc.ordering, tc.expected, columnOrdering)
+		}
+		if roundTrip := ConvertToSpecOrdering(columnOrdering); !roundTrip.Equals(tc.ordering) {
+			t.Errorf("%s: round trip produced %s", tc.ordering, roundTrip)
+		}
+	}
+
+	// The only allocation is that of the columns passed to MakeOrdering.
+	if allocs := testing.AllocsPerRun(100, func() {
+		o := MakeOrdering(Asc(0), Desc(2))
+		_ = o
+	}); allocs > 1 {
+		t.Errorf("expected at most one allocation, found %.0f", allocs)
+	}
+}
+
+func TestOrderingNormalize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	asc, desc := Ordering_Column_ASC, Ordering_Column_DESC
+	testCases := []struct {
+		ordering, expected []Ordering_Column
+	}{
+		{nil, nil},
+		{
+			[]Ordering_Column{{ColIdx: 1, Direction: asc}, {ColIdx: 0, Direction: desc}},
+			[]Ordering_Column{{ColIdx: 1, Direction: asc}, {ColIdx: 0, Direction: desc}},
+		},
+		{
+			[]Ordering_Column{{ColIdx: 1, Direction: asc}, {ColIdx: 1, Direction: asc}},
+			[]Ordering_Column{{ColIdx: 1, Direction: asc}},
+		},
+		{
+			// A later duplicate is dropped even if its direction differs.
+			[]Ordering_Column{
+				{ColIdx: 2, Direction: desc}, {ColIdx: 0, Direction: asc},
+				{ColIdx: 2, Direction: asc}, {ColIdx: 3, Direction: desc}, {ColIdx: 0, Direction: desc},
+			},
+			[]Ordering_Column{{ColIdx: 2, Direction: desc}, {ColIdx: 0, Direction: asc}, {ColIdx: 3, Direction: desc}},
+		},
+	}
+	for _, tc := range testCases {
+		ordering, expected := Ordering{Columns: tc.ordering}, Ordering{Columns: tc.expected}
+		normalized := ordering.Normalize()
+		if !normalized.Equals(expected) {
+			t.Errorf("%v: expected %v, found %v", ordering, expected, normalized)
+		}
+		if !normalized.Normalize().Equals(normalized) {
+			t.Errorf("%v: normalizing %v again changed it", ordering, normalized)
+		}
+
+		// Normalization must survive the round trip through a
+		// sqlbase.ColumnOrdering, and commute with it.
+		roundTrip := ConvertToSpecOrdering(ConvertToColumnOrdering(normalized))
+		if !roundTrip.Equals(normalized) {
+			t.Errorf("%v: round trip of %v produced %v", ordering, normalized, roundTrip)
+		}
+		roundTrip = ConvertToSpecOrdering(ConvertToColumnOrdering(ordering)).Normalize()
+		if !roundTrip.Equals(normalized) {
+			t.Errorf("%v: normalized round trip produced %v, expected %v", ordering, roundTrip, normalized)
+		}
+	}
+}
+
+func TestOrderingEquals(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	asc, desc := Ordering_Column_ASC, Ordering_Column_DESC
+	o := Ordering{Columns: []Ordering_Column{{ColIdx: 1, Direction: asc}, {ColIdx: 0, Direction: desc}}}
+	testCases := []struct {
+		other    Ordering
+		expected bool
+	}{
+		{Ordering{Columns: []Ordering_Column{{ColIdx: 1, Direction: asc}, {ColIdx: 0, Direction: desc}}}, true},
+		{Ordering{Columns: []Ordering_Column{{ColIdx: 1, Direction: asc}, {ColIdx: 0, Direction: asc}}}, false},
+		{Ordering{Columns: []Ordering_Column{{ColIdx: 0, Direction: desc}, {ColIdx: 1, Direction: asc}}}, false},
+		{Ordering{Columns: []Ordering_Column{{ColIdx: 1, Direction: asc}}}, false},
+		{Ordering{}, false},
+	}
+	for _, tc := range testCases {
+		if result := o.Equals(tc.other); result != tc.expected {
+			t.Errorf("%v.Equals(%v): expected %t, found %t", o, tc.other, tc.expected, result)
+		}
+	}
+	if !(Ordering{}).Equals(Ordering{Columns: []Ordering_Column{}}) {
+		t.Error("expected empty orderings to be equal")
+	}
+}
+
+func TestOrderingIsPrefixOf(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	o := MakeOrdering(Asc(1), Desc(0))
+	testCases := []struct {
+		name     string
+		other    Ordering
+		expected bool
+	}{
+		{"equal", MakeOrdering(Asc(1), Desc(0)), true},
+		{"strict prefix", MakeOrdering(Asc(1), Desc(0), Asc(2)), true},
+		{"direction mismatch", MakeOrdering(Asc(1), Asc(0), Asc(2)), false},
+		{"column mismatch", MakeOrdering(Asc(1), Desc(2), Desc(0)), false},
+		{"longer than other", MakeOrdering(Asc(1)), false},
+		{"longer than empty", MakeOrdering(), false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if result := o.IsPrefixOf(tc.other); result != tc.expected {
+				t.Errorf("%s.IsPrefixOf(%s): expected %t, found %t", o, tc.other, tc.expected, result)
+			}
+		})
+	}
+	if !MakeOrdering().IsPrefixOf(o) || !MakeOrdering().IsPrefixOf(MakeOrdering()) {
+		t.Error("expected the empty ordering to be a prefix of any ordering")
+	}
+}
+
+func TestOrderingString(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	asc, desc := Ordering_Column_ASC, Ordering_Column_DESC
+	testCases := []struct {
+		columns  []Ordering_Column
+		expected string
+	}{
+		{nil, ""},
+		{[]Ordering_Column{{ColIdx: 0, Direction: asc}}, "+@1"},
+		{[]Ordering_Column{{ColIdx: 4, Direction: desc}}, "-@5"},
+		{
+			[]Ordering_Column{{ColIdx: 0, Direction: asc}, {ColIdx: 2, Direction: desc}, {ColIdx: 1, Direction: asc}},
+			"+@1,-@3,+@2",
+		},
+	}
+	for _, tc := range testCases {
+		o := Ordering{Columns: tc.columns}
+		if result := o.String(); result != tc.expected {
+			t.Errorf("expected %q, found %q", tc.expected, result)
+		}
+		// The pointer is what gets formatted when logging specs.
+		if result := fmt.Sprint(&o); result != tc.expected {
+			t.Errorf("expected %q when formatting a pointer, found %q", tc.expected, result)
+		}
+	}
+}
+
+func TestOrderingReverse(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	asc, desc := Ordering_Column_ASC, Ordering_Column_DESC
+	for _, o := range []Ordering{
+		{},
+		{Columns: []Ordering_Column{{ColIdx: 0, Direction: asc}}},
+		{Columns: []Ordering_Column{{ColIdx: 2, Direction: desc}, {ColIdx: 0, Direction: asc}, {ColIdx: 1, Direction: desc}}},
+	} {
+		reversed := o.Reverse()
+		if !reversed.Reverse().Equals(o) {
+			t.Errorf("%s: reversing twice produced %s", o, reversed.Reverse())
+		}
+
+		columnOrdering := ConvertToColumnOrdering(o)
+		reversedColumnOrdering := ConvertToColumnOrdering(reversed)
+		if len(reversedColumnOrdering) != len(columnOrdering) {
+			t.Fatalf("%s: reversed ordering %s has a different length", o, reversed)
+		}
+		for i, c := range reversedColumnOrdering {
+			if c.ColIdx != columnOrdering[i].ColIdx || c.Direction != columnOrdering[i].Direction.Reverse() {
+				t.Errorf("%s: column %d of the reversed ordering is %+v", o, i, c)
+			}
+		}
+		if !reflect.DeepEqual(columnOrdering.Reverse(), reversedColumnOrdering) {
+			t.Errorf("%s: expected the reversed column ordering %+v, found %+v",
+				o, reversedColumnOrdering, columnOrdering.Reverse())
+		}
+	}
+}
+
+func TestExpressionMarshalJSON(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	eq := tree.NewTypedComparisonExpr(
+		tree.EQ, tree.NewTypedOrdinalReference(0, types.Int), tree.NewDInt(2))
+	testCases := []struct {
+		name     string
+		expr     Expression
+		expected string
+	}{
+		{"local", Expression{LocalExpr: eq}, `{"expr":"@1 = 2"}`},
+		{"serialized", Expression{Expr: "@1 = 2"}, `{"expr":"@1 = 2"}`},
+		{"empty", Expression{}, `{"expr":""}`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := json.Marshal(tc.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := string(b); s != tc.expected {
+				t.Errorf("expected %s, found %s", tc.expected, s)
+			}
+			// The expressions are marshaled as part of the specs embedding them.
+			b, err = json.Marshal(PostProcessSpec{Filter: tc.expr})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := string(b); !strings.Contains(s, `"filter":`+tc.expected) {
+				t.Errorf("expected the filter to be marshaled as %s, found %s", tc.expected, s)
+			}
+		})
+	}
+}
+
+func BenchmarkExpressionString(b *testing.B) {
+	local := tree.NewTypedAndExpr(
+		tree.NewTypedComparisonExpr(tree.LT, tree.NewTypedOrdinalReference(0, types.Int), tree.NewDInt(2)),
+		tree.NewTypedComparisonExpr(tree.EQ, tree.NewTypedOrdinalReference(1, types.String), tree.NewDString("a")),
+	)
+	for _, tc := range []struct {
+		name string
+		e    Expression
+	}{
+		{name: "local", e: Expression{LocalExpr: local}},
+		{name: "serialized", e: Expression{Expr: "@1 < 2 AND @2 = 'a'"}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_ = tc.e.String()
+			}
+		})
+	}
+}
+
+func TestExpressionValidate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	testCases := []struct {
+		expr string
+		// code is the pgerror code of the expected error, if any.
+		code string
+	}{
+		{expr: ""},
+		{expr: "1 + 2 = 3"},
+		{expr: "@1 + @3 > 0"},
+		{expr: "@1 < @3 AND @2 IS NULL"},
+		{expr: "@4 = 1", code: pgerror.CodeUndefinedColumnError},
+		{expr: "@1 = 1 OR (@2 = 2 AND @5 = 5)", code: pgerror.CodeUndefinedColumnError},
+		// The parser rejects ordinals below 1 itself.
+		{expr: "@0 = 1", code: pgerror.CodeSyntaxError},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.expr, func(t *testing.T) {
+			err := (&Expression{Expr: tc.expr}).Validate(3 /* numInputCols */)
+			if tc.code == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			pgErr, ok := pgerror.GetPGCause(err)
+			if !ok || pgErr.Code != tc.code {
+				t.Fatalf("expected error code %s, found %v", tc.code, err)
+			}
+		})
+	}
+
+	e := Expression{LocalExpr: tree.NewTypedAndExpr(
+		tree.NewTypedOrdinalReference(3, types.Bool), tree.DBoolTrue)}
+	if err := e.Validate(3 /* numInputCols */); err == nil {
+		t.Errorf("expected an error for %s", e)
+	}
+	if err := e.Validate(4 /* numInputCols */); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpressionIsConstant(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	testCases := []struct {
+		expr     string
+		constant bool
+	}{
+		{expr: "", constant: true},
+		{expr: "1 + 2 = 3", constant: true},
+		{expr: "$1 > 0", constant: true},
+		{expr: "'a@1' = 'b'", constant: true},
+		{expr: `"x@1" IS NULL`, constant: true},
+		{expr: "'{\"a\": 1}'::JSONB @> '{}'", constant: true},
+		{expr: "@1 = 1", constant: false},
+		{expr: "'it''s' = 'x' OR @12 > 0", constant: false},
+		{expr: "1 = 1 AND (@2 IS NULL)", constant: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.expr, func(t *testing.T) {
+			if result := (&Expression{Expr: tc.expr}).IsConstant(); result != tc.constant {
+				t.Errorf("expected %t, found %t", tc.constant, result)
+			}
+			if tc.expr == "" {
+				return
+			}
+			// The local form of the expression must agree with the serialized one.
+			expr, err := parser.ParseExpr(tc.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var found ordinalFinder
+			tree.WalkExprConst(&found, expr)
+			if found.found == tc.constant {
+				t.Errorf("expected the parsed expression to be constant: %t", tc.constant)
+			}
+		})
+	}
+
+	ivar := tree.NewTypedOrdinalReference(1, types.Int)
+	for _, tc := range []struct {
+		expr     tree.TypedExpr
+		constant bool
+	}{
+		{tree.NewTypedComparisonExpr(tree.EQ, tree.NewDInt(1), tree.NewDInt(2)), true},
+		{tree.NewTypedComparisonExpr(tree.EQ, ivar, tree.NewDInt(2)), false},
+		{tree.NewTypedAndExpr(tree.DBoolTrue, tree.NewTypedComparisonExpr(tree.LT, tree.NewDInt(1), ivar)), false},
+	} {
+		e := Expression{LocalExpr: tc.expr}
+		if result := e.IsConstant(); result != tc.constant {
+			t.Errorf("%s: expected %t, found %t", tc.expr, tc.constant, result)
+		}
+	}
+}
+
+func TestExpressionEnsureSerialized(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	defer evalCtx.Stop(context.Background())
+
+	local := tree.NewTypedAndExpr(
+		tree.NewTypedOrdinalReference(0, types.Bool),
+		tree.NewTypedOrdinalReference(2, types.Bool),
+	)
+	testCases := []struct {
+		name     string
+		e        Expression
+		expected string
+	}{
+		{name: "empty", e: Expression{}, expected: ""},
+		{name: "serialized", e: Expression{Expr: "@2 > 1"}, expected: "@2 > 1"},
+		{name: "serialized-and-local", e: Expression{Expr: "@2 > 1", LocalExpr: local}, expected: "@2 > 1"},
+		{name: "local", e: Expression{LocalExpr: local}, expected: "@1 AND @3"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := tc.e
+			if err := e.EnsureSerialized(&evalCtx); err != nil {
+				t.Fatal(err)
+			}
+			if e.Expr != tc.expected {
+				t.Errorf("expected %q, found %q", tc.expected, e.Expr)
+			}
+			if e.LocalExpr != tc.e.LocalExpr {
+				t.Errorf("expected LocalExpr to be unchanged")
+			}
+			if err := (&Expression{Expr: e.Expr}).Validate(3 /* numInputCols */); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestNewError(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	testCases := []struct {
+		err  error
+		code string
+	}{
+		{err: pgerror.NewError(pgerror.CodeDivisionByZeroError, "division by zero"), code: pgerror.CodeDivisionByZeroError},
+		{err: errors.New("boom"), code: pgerror.CodeInternalError},
+		{err: context.Canceled, code: pgerror.CodeQueryCanceledError},
+		{err: context.DeadlineExceeded, code: pgerror.CodeQueryCanceledError},
+		{err: errors.Wrap(context.Canceled, "reading rows"), code: pgerror.CodeQueryCanceledError},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			err := NewError(tc.err).ErrorDetail()
+			pgErr, ok := pgerror.GetPGCause(err)
+			if !ok {
+				t.Fatalf("expected a pgerror, found %T: %v", err, err)
+			}
+			if pgErr.Code != tc.code {
+				t.Errorf("expected code %s, found %s", tc.code, pgErr.Code)
+			}
+			if pgErr.Message != tc.err.Error() {
+				t.Errorf("expected message %q, found %q", tc.err.Error(), pgErr.Message)
+			}
+		})
+	}
+
+	retryErr := &roachpb.UnhandledRetryableError{}
+	if err := NewError(retryErr).ErrorDetail(); err != retryErr {
+		t.Errorf("expected %v, found %v", retryErr, err)
+	}
+}
+
+func TestNewErrorWrapped(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	wrap := func(err error, depth int) error {
+		for i := 0; i < depth; i++ {
+			err = errors.Wrapf(err, "layer %d", i)
+		}
+		return err
+	}
+
+	testCases := []struct {
+		name   string
+		err    error
+		detail interface{}
+	}{
+		{
+			name:   "pgerror",
+			err:    pgerror.NewError(pgerror.CodeDivisionByZeroError, "division by zero"),
+			detail: &Error_PGError{},
+		},
+		{
+			name:   "retryable",
+			err:    &roachpb.UnhandledRetryableError{},
+			detail: &Error_RetryableTxnError{},
+		},
+		{
+			name:   "canceled",
+			err:    context.Canceled,
+			detail: &Error_PGError{},
+		},
+	}
+	for _, tc := range testCases {
+		for depth := 1; depth <= 2; depth++ {
+			t.Run(fmt.Sprintf("%s/depth=%d", tc.name, depth), func(t *testing.T) {
+				e := NewError(wrap(tc.err, depth))
+				if reflect.TypeOf(e.Detail) != reflect.TypeOf(tc.detail) {
+					t.Fatalf("expected a %T, found %T", tc.detail, e.Detail)
+				}
+				if pgErr, ok := e.Detail.(*Error_PGError); ok &&
+					pgErr.PGError.Code == pgerror.CodeInternalError {
+					t.Errorf("expected the wrapped error to be recognized, found %s", pgErr.PGError)
+				}
+			})
+		}
+	}
+}
+
+func TestErrorDetailRoundTrip(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	if err := (*Error)(nil).ErrorDetail(); err != nil {
+		t.Errorf("expected no error from a nil Error, found %v", err)
+	}
+
+	// roundTrip sends err through NewError and, as if it came from a remote
+	// node, through the wire format.
+	roundTrip := func(err error) error {
+		data, marshalErr := protoutil.Marshal(NewError(err))
+		if marshalErr != nil {
+			t.Fatal(marshalErr)
+		}
+		var e Error
+		if unmarshalErr := protoutil.Unmarshal(data, &e); unmarshalErr != nil {
+			t.Fatal(unmarshalErr)
+		}
+		return e.ErrorDetail()
+	}
+
+	pgErr := pgerror.NewError(pgerror.CodeDivisionByZeroError, "division by zero")
+	if err, ok := roundTrip(pgErr).(*pgerror.Error); !ok {
+		t.Errorf("expected a *pgerror.Error, found %T", err)
+	} else if err.Code != pgErr.Code || err.Message != pgErr.Message {
+		t.Errorf("expected %+v, found %+v", pgErr, err)
+	}
+
+	retryErr := &roachpb.UnhandledRetryableError{
+		PErr: *roachpb.NewError(roachpb.NewTransactionRetryError(roachpb.RETRY_SERIALIZABLE)),
+	}
+	if err, ok := roundTrip(retryErr).(*roachpb.UnhandledRetryableError); !ok {
+		t.Errorf("expected a *roachpb.UnhandledRetryableError, found %T", err)
+	} else if err.Error() != retryErr.Error() {
+		t.Errorf("expected %q, found %q", retryErr, err)
+	}
+
+	plainErr := errors.New("boom")
+	if err, ok := roundTrip(plainErr).(*pgerror.Error); !ok {
+		t.Errorf("expected a *pgerror.Error, found %T", err)
+	} else if err.Code != pgerror.CodeInternalError || err.Message != plainErr.Error() {
+		t.Errorf("expected an internal error %q, found %+v", plainErr, err)
+	}
+}
@@ -110,13 +110,21 @@ type exprHelper struct {
 	types      []sqlbase.ColumnType
 	row        sqlbase.EncDatumRow
 	datumAlloc sqlbase.DatumAlloc
+
+	// str memoizes String, which is otherwise formatting expr every time the
+	// helper is logged. Like the rest of the helper, it is only accessed by
+	// the processor's goroutine.
+	str string
 }
 
 func (eh *exprHelper) String() string {
 	if eh.expr == nil {
 		return "none"
 	}
-	return eh.expr.String()
+	if eh.str == "" {
+		eh.str = eh.expr.String()
+	}
+	return eh.str
 }
 
 // exprHelper implements tree.IndexedVarContainer.
@@ -148,6 +156,7 @@ func (eh *exprHelper) init(
 	if expr.Empty() {
 		return nil
 	}
+	eh.str = ""
 	eh.evalCtx = evalCtx
 	eh.types = types
 	eh.vars = tree.MakeIndexedVarHelper(eh, len(types))
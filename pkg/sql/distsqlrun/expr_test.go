@@ -15,6 +15,7 @@
 package distsqlrun
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"testing"
@@ -23,6 +24,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/distsqlpb"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/types"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 )
 
@@ -90,3 +92,57 @@ func TestProcessExpressionConstantEval(t *testing.T) {
 		t.Errorf("invalid expr '%v', expected '%v'", expr, expected)
 	}
 }
+
+func TestExprHelperString(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	st := cluster.MakeTestingClusterSettings()
+	evalCtx := tree.MakeTestingEvalContext(st)
+	defer evalCtx.Stop(context.Background())
+
+	var h exprHelper
+	if s := h.String(); s != "none" {
+		t.Errorf("expected %q, found %q", "none", s)
+	}
+	colTypes := []sqlbase.ColumnType{sqlbase.IntType, sqlbase.IntType}
+	for _, expr := range []string{"@1 + @2", "@2 * 3"} {
+		if err := h.init(distsqlpb.Expression{Expr: expr}, colTypes, &evalCtx); err != nil {
+			t.Fatal(err)
+		}
+		// The string is memoized by the first call, and must be reset by init.
+		expected := h.expr.String()
+		for i := 0; i < 2; i++ {
+			if s := h.String(); s != expected {
+				t.Errorf("%s: expected %q, found %q", expr, expected, s)
+			}
+		}
+	}
+}
+
+func BenchmarkExprHelperString(b *testing.B) {
+	st := cluster.MakeTestingClusterSettings()
+	evalCtx := tree.MakeTestingEvalContext(st)
+	defer evalCtx.Stop(context.Background())
+
+	e := distsqlpb.Expression{Expr: "@1 < 2 AND @2 = 'a'"}
+	var h exprHelper
+	colTypes := []sqlbase.ColumnType{sqlbase.IntType, sqlbase.StrType}
+	if err := h.init(e, colTypes, &evalCtx); err != nil {
+		b.Fatal(err)
+	}
+	e.LocalExpr = h.expr
+	for _, tc := range []struct {
+		name string
+		s    fmt.Stringer
+	}{
+		{name: "expression", s: e},
+		{name: "helper", s: &h},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_ = tc.s.String()
+			}
+		})
+	}
+}
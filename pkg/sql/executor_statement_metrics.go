@@ -74,6 +74,8 @@ type EngineMetrics struct {
 	SQLOptFallbackCount   *metric.Counter
 	SQLOptPlanCacheHits   *metric.Counter
 	SQLOptPlanCacheMisses *metric.Counter
+	// The number of statements executing at the moment.
+	SQLStatementsActive *metric.Gauge
 
 	DistSQLExecLatency    *metric.Histogram
 	SQLExecLatency        *metric.Histogram
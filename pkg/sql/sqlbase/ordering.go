@@ -46,6 +46,19 @@ func (a ColumnOrdering) IsPrefixOf(b ColumnOrdering) bool {
 	return true
 }
 
+// Reverse returns the ordering which sorts rows the other way around, i.e. the
+// ordering with the direction of every column flipped.
+func (a ColumnOrdering) Reverse() ColumnOrdering {
+	if a == nil {
+		return nil
+	}
+	reversed := make(ColumnOrdering, len(a))
+	for i, c := range a {
+		reversed[i] = ColumnOrderInfo{ColIdx: c.ColIdx, Direction: c.Direction.Reverse()}
+	}
+	return reversed
+}
+
 // CompareDatums compares two datum rows according to a column ordering. Returns:
 //  - 0 if lhs and rhs are equal on the ordering columns;
 //  - less than 0 if lhs comes first;
@@ -20,6 +20,7 @@ import (
 	gosql "database/sql"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
@@ -35,6 +36,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/workload"
+	"github.com/codahale/hdrhistogram"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -59,6 +61,15 @@ var pprofport = initFlags.Int("pprofport", 33333, "Port for pprof endpoint.")
 var histograms = runFlags.String(
 	"histograms", "",
 	"File to write per-op incremental and cumulative histogram data.")
+var histogramsFormat = runFlags.String(
+	"histograms-format", "json",
+	"Format of the histogram data: json writes every op's incremental histograms to the "+
+		"--histograms file, hdr writes every op's cumulative histogram to a file of its own "+
+		"in the --histograms directory.")
+var histogramsMaxLatency = runFlags.Duration(
+	"histograms-max-latency", 100*time.Second,
+	"Highest latency tracked by the histograms written in the hdr format. Higher latencies "+
+		"are recorded as this one.")
 
 func init() {
 	AddSubCmd(func() *cobra.Command {
@@ -275,6 +286,12 @@ func startPProfEndPoint(ctx context.Context) {
 }
 
 func runRun(gen workload.Generator, urls []string, dbName string) error {
+	switch *histogramsFormat {
+	case "json", "hdr":
+	default:
+		return errors.Errorf("unknown histograms format %q, must be json or hdr", *histogramsFormat)
+	}
+
 	ctx := context.Background()
 
 	startPProfEndPoint(ctx)
@@ -383,7 +400,7 @@ func runRun(gen workload.Generator, urls []string, dbName string) error {
 	}
 
 	var jsonEnc *json.Encoder
-	if *histograms != "" {
+	if *histograms != "" && *histogramsFormat == "json" {
 		_ = os.MkdirAll(filepath.Dir(*histograms), 0755)
 		jsonF, err := os.Create(*histograms)
 		if err != nil {
@@ -476,6 +493,11 @@ func runRun(gen workload.Generator, urls []string, dbName string) error {
 					// per-tick histograms.
 					_ = jsonEnc.Encode(t.Snapshot())
 				}
+				if *histograms != "" && *histogramsFormat == "hdr" {
+					if err := writeHDRHistogram(*histograms, t, *histogramsMaxLatency); err != nil {
+						fmt.Printf("failed to write histogram: %v\n", err)
+					}
+				}
 				if ops.ResultHist == `` || ops.ResultHist == t.Name {
 					if resultTick.Cumulative == nil {
 						resultTick.Now = t.Now
@@ -501,3 +523,34 @@ func runRun(gen workload.Generator, urls []string, dbName string) error {
 		}
 	}
 }
+
+// writeHDRHistogram writes the cumulative histogram of t, with latencies above
+// maxLatency recorded as maxLatency, to a file named after the op in dir.
+func writeHDRHistogram(dir string, t workload.HistogramTick, maxLatency time.Duration) error {
+	if t.Cumulative == nil {
+		return nil
+	}
+	h := hdrhistogram.New(t.Cumulative.LowestTrackableValue(), maxLatency.Nanoseconds(),
+		int(t.Cumulative.SignificantFigures()))
+	for _, b := range t.Cumulative.Distribution() {
+		if b.Count == 0 {
+			continue
+		}
+		v := b.To
+		if v > maxLatency.Nanoseconds() {
+			v = maxLatency.Nanoseconds()
+		}
+		if err := h.RecordValues(v, b.Count); err != nil {
+			return err
+		}
+	}
+	buf, err := json.Marshal(h.Export())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := strings.Replace(t.Name, "/", "_", -1) + ".hdr"
+	return ioutil.WriteFile(filepath.Join(dir, name), buf, 0644)
+}
@@ -26,7 +26,9 @@ import (
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
+	"github.com/cockroachdb/cockroach-go/crdb"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/workload"
 	"github.com/pkg/errors"
@@ -54,11 +56,14 @@ type kv struct {
 	cycleLength                          int64
 	readPercent                          int
 	spanPercent                          int
+	rmwPercent                           int
+	followerReadStaleness                time.Duration
 	seed                                 int64
 	writeSeq                             string
 	sequential                           bool
 	zipfian                              bool
 	splits                               int
+	affinity                             bool
 	secondaryIndex                       bool
 	useOpt                               bool
 }
@@ -74,7 +79,9 @@ var kvMeta = workload.Meta{
 	the cluster.
 	--concurrency workers alternate between doing selects and upserts (according
 	to a --read-percent ratio). Each select/upsert reads/writes a batch of --batch
-	rows. The write keys are randomly generated in a deterministic fashion (or
+	rows. --rmw-percent of the operations read a batch of existing keys and write
+	them back within an explicit transaction, which contends with other writers.
+	The write keys are randomly generated in a deterministic fashion (or
 	sequentially if --sequential is specified). Reads select a random batch of ids
 	out of the ones previously written.
 	--write-seq can be used to incorporate data produced by a previous run into
@@ -85,7 +92,8 @@ var kvMeta = workload.Meta{
 		g := &kv{}
 		g.flags.FlagSet = pflag.NewFlagSet(`kv`, pflag.ContinueOnError)
 		g.flags.Meta = map[string]workload.FlagMeta{
-			`batch`: {RuntimeOnly: true},
+			`batch`:    {RuntimeOnly: true},
+			`affinity`: {RuntimeOnly: true},
 		}
 		g.flags.IntVar(&g.batchSize, `batch`, 1,
 			`Number of blocks to read/insert in a single SQL statement.`)
@@ -99,6 +107,11 @@ var kvMeta = workload.Meta{
 			`Percent (0-100) of operations that are reads of existing keys.`)
 		g.flags.IntVar(&g.spanPercent, `span-percent`, 0,
 			`Percent (0-100) of operations that are spanning queries of all ranges.`)
+		g.flags.IntVar(&g.rmwPercent, `rmw-percent`, 0,
+			`Percent (0-100) of operations that are read-modify-write transactions on existing keys.`)
+		g.flags.DurationVar(&g.followerReadStaleness, `follower-read-staleness`, 0,
+			`If non-zero, reads are historical reads this far in the past, which `+
+				`followers can serve once their closed timestamp has passed that time.`)
 		g.flags.Int64Var(&g.seed, `seed`, 1, `Key hash seed.`)
 		g.flags.BoolVar(&g.zipfian, `zipfian`, false,
 			`Pick keys in a zipfian distribution instead of randomly.`)
@@ -110,6 +123,10 @@ var kvMeta = workload.Meta{
 				`previous --sequential run and R implies a previous random run.`)
 		g.flags.IntVar(&g.splits, `splits`, 0,
 			`Number of splits to perform before starting normal operations.`)
+		g.flags.BoolVar(&g.affinity, `affinity`, false,
+			`Partition the keyspace into the ranges created by --splits and have the `+
+				`workers connected to the i-th url only access keys in the i-th range. `+
+				`Requires exactly --splits+1 urls.`)
 		g.flags.BoolVar(&g.secondaryIndex, `secondary-index`, false,
 			`Add a secondary index to the schema`)
 		g.flags.BoolVar(&g.useOpt, `use-opt`, true, `Use cost-based optimizer`)
@@ -138,8 +155,12 @@ func (w *kv) Hooks() workload.Hooks {
 			if w.sequential && w.zipfian {
 				return errors.New("'sequential' and 'zipfian' cannot both be enabled")
 			}
-			if w.readPercent+w.spanPercent > 100 {
-				return errors.New("'read-percent' and 'span-percent' higher than 100")
+			if w.followerReadStaleness != 0 && w.rmwPercent != 0 {
+				// Historical reads can't be part of read-write transactions.
+				return errors.New("'follower-read-staleness' and 'rmw-percent' cannot both be enabled")
+			}
+			if w.readPercent+w.spanPercent+w.rmwPercent > 100 {
+				return errors.New("'read-percent', 'span-percent' and 'rmw-percent' higher than 100")
 			}
 			return nil
 		},
@@ -154,9 +175,7 @@ func (w *kv) Tables() []workload.Table {
 		Splits: workload.Tuples(
 			w.splits,
 			func(splitIdx int) []interface{} {
-				stride := (float64(math.MaxInt64) - float64(math.MinInt64)) / float64(w.splits+1)
-				splitPoint := int(math.MinInt64 + float64(splitIdx+1)*stride)
-				return []interface{}{splitPoint}
+				return []interface{}{int(w.splitPoint(splitIdx))}
 			},
 		),
 	}
@@ -168,6 +187,13 @@ func (w *kv) Tables() []workload.Table {
 	return []workload.Table{table}
 }
 
+// splitPoint returns the key at which the table is split for the given split
+// index. The splits divide the keyspace into --splits+1 equally sized ranges.
+func (w *kv) splitPoint(splitIdx int) int64 {
+	stride := (float64(math.MaxInt64) - float64(math.MinInt64)) / float64(w.splits+1)
+	return int64(math.MinInt64 + float64(splitIdx+1)*stride)
+}
+
 // Ops implements the Opser interface.
 func (w *kv) Ops(urls []string, reg *workload.HistogramRegistry) (workload.QueryLoad, error) {
 	writeSeq := 0
@@ -191,26 +217,50 @@ func (w *kv) Ops(urls []string, reg *workload.HistogramRegistry) (workload.Query
 		}
 	}
 
+	if w.affinity && len(urls) != w.splits+1 {
+		return workload.QueryLoad{}, errors.Errorf(
+			"--affinity requires one url per range, got %d urls for %d ranges", len(urls), w.splits+1)
+	}
+
 	ctx := context.Background()
 	sqlDatabase, err := workload.SanitizeUrls(w, w.connFlags.DBOverride, urls)
 	if err != nil {
 		return workload.QueryLoad{}, err
 	}
-	mcp, err := workload.NewMultiConnPool(w.connFlags.Concurrency+1, urls...)
-	if err != nil {
-		return workload.QueryLoad{}, err
+	// With --affinity, each url gets its own pool so that the workers assigned
+	// to a range only ever talk to the corresponding node.
+	var mcps []*workload.MultiConnPool
+	if w.affinity {
+		for _, url := range urls {
+			mcp, err := workload.NewMultiConnPool(w.connFlags.Concurrency/len(urls)+1, url)
+			if err != nil {
+				return workload.QueryLoad{}, err
+			}
+			mcps = append(mcps, mcp)
+		}
+	} else {
+		mcp, err := workload.NewMultiConnPool(w.connFlags.Concurrency+1, urls...)
+		if err != nil {
+			return workload.QueryLoad{}, err
+		}
+		mcps = append(mcps, mcp)
 	}
 
 	if !w.useOpt {
-		_, err := mcp.Get().Exec("SET optimizer=off")
-		if err != nil {
-			return workload.QueryLoad{}, err
+		for _, mcp := range mcps {
+			if _, err := mcp.Get().Exec("SET optimizer=off"); err != nil {
+				return workload.QueryLoad{}, err
+			}
 		}
 	}
 
 	// Read statement
 	var buf strings.Builder
-	buf.WriteString(`SELECT k, v FROM kv WHERE k IN (`)
+	buf.WriteString(`SELECT k, v FROM kv`)
+	if w.followerReadStaleness != 0 {
+		fmt.Fprintf(&buf, ` AS OF SYSTEM TIME '-%s'`, w.followerReadStaleness)
+	}
+	buf.WriteString(` WHERE k IN (`)
 	for i := 0; i < w.batchSize; i++ {
 		if i > 0 {
 			buf.WriteString(", ")
@@ -239,9 +289,11 @@ func (w *kv) Ops(urls []string, reg *workload.HistogramRegistry) (workload.Query
 	seq := &sequence{config: w, val: int64(writeSeq)}
 	numEmptyResults := new(int64)
 	for i := 0; i < w.connFlags.Concurrency; i++ {
+		mcp := mcps[i%len(mcps)]
 		op := &kvOp{
 			config:          w,
 			hists:           reg.GetHandle(),
+			mcp:             mcp,
 			numEmptyResults: numEmptyResults,
 		}
 		op.readStmt = op.sr.Define(readStmtStr)
@@ -257,6 +309,9 @@ func (w *kv) Ops(urls []string, reg *workload.HistogramRegistry) (workload.Query
 		} else {
 			op.g = newHashGenerator(seq)
 		}
+		if w.affinity {
+			op.g = newPartitionedGenerator(op.g, w, i%len(mcps))
+		}
 		ql.WorkerFns = append(ql.WorkerFns, op.run)
 		ql.Close = op.close
 	}
@@ -266,6 +321,7 @@ func (w *kv) Ops(urls []string, reg *workload.HistogramRegistry) (workload.Query
 type kvOp struct {
 	config          *kv
 	hists           *workload.Histograms
+	mcp             *workload.MultiConnPool
 	sr              workload.SQLRunner
 	readStmt        workload.StmtHandle
 	writeStmt       workload.StmtHandle
@@ -307,6 +363,10 @@ func (o *kvOp) run(ctx context.Context) error {
 		o.hists.Get(`span`).Record(elapsed)
 		return err
 	}
+	statementProbability -= o.config.spanPercent
+	if statementProbability < o.config.rmwPercent {
+		return o.readModifyWrite(ctx)
+	}
 	const argCount = 2
 	args := make([]interface{}, argCount*o.config.batchSize)
 	for i := 0; i < o.config.batchSize; i++ {
@@ -321,6 +381,41 @@ func (o *kvOp) run(ctx context.Context) error {
 	return err
 }
 
+// readModifyWrite reads a batch of existing keys and writes new values for
+// them within the same transaction.
+func (o *kvOp) readModifyWrite(ctx context.Context) error {
+	readArgs := make([]interface{}, o.config.batchSize)
+	writeArgs := make([]interface{}, 2*o.config.batchSize)
+	for i := 0; i < o.config.batchSize; i++ {
+		k := o.g.readKey()
+		readArgs[i] = k
+		writeArgs[2*i] = k
+		writeArgs[2*i+1] = randomBlock(o.config, o.g.rand())
+	}
+	start := timeutil.Now()
+	tx, err := o.mcp.Get().BeginEx(ctx, nil /* txOptions */)
+	if err != nil {
+		return err
+	}
+	err = crdb.ExecuteInTx(ctx, (*workload.PgxTx)(tx), func() error {
+		rows, err := o.readStmt.QueryTx(ctx, tx, readArgs...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			// The values read don't matter, only that the keys are read.
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		_, err = o.writeStmt.ExecTx(ctx, tx, writeArgs...)
+		return err
+	})
+	elapsed := timeutil.Since(start)
+	o.hists.Get(`rmw`).Record(elapsed)
+	return err
+}
+
 func (o *kvOp) close(context.Context) {
 	if empty := atomic.LoadInt64(o.numEmptyResults); empty != 0 {
 		fmt.Printf("Number of reads that didn't return any results: %d.\n", empty)
@@ -405,6 +500,43 @@ func (g *hashGenerator) sequence() int64 {
 	return atomic.LoadInt64(&g.seq.val)
 }
 
+// partitionedGenerator wraps a keyGenerator and maps the keys it generates
+// into a single one of the ranges created by --splits. Since different
+// partitions map the same sequence value to different keys, reads issued by a
+// partition only find the keys written by that same partition.
+type partitionedGenerator struct {
+	keyGenerator
+	start int64
+	width uint64
+}
+
+func newPartitionedGenerator(g keyGenerator, config *kv, partition int) *partitionedGenerator {
+	start, end := int64(math.MinInt64), int64(math.MaxInt64)
+	if partition > 0 {
+		start = config.splitPoint(partition - 1)
+	}
+	if partition < config.splits {
+		end = config.splitPoint(partition)
+	}
+	return &partitionedGenerator{
+		keyGenerator: g,
+		start:        start,
+		width:        uint64(end) - uint64(start),
+	}
+}
+
+func (g *partitionedGenerator) mapKey(k int64) int64 {
+	return int64(uint64(g.start) + uint64(k)%g.width)
+}
+
+func (g *partitionedGenerator) writeKey() int64 {
+	return g.mapKey(g.keyGenerator.writeKey())
+}
+
+func (g *partitionedGenerator) readKey() int64 {
+	return g.mapKey(g.keyGenerator.readKey())
+}
+
 type sequentialGenerator struct {
 	seq    *sequence
 	random *rand.Rand